@@ -1,23 +1,59 @@
 package main
 
 import (
+	"bytes"
+	"crypto/sha256"
 	"database/sql"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
-	"github.com/dgrijalva/jwt-go"
-	"github.com/mitchellh/mapstructure"
+	"io"
+	"math"
+	"mime"
+	"mime/multipart"
 	"net/http"
 	"strconv"
+	"strings"
 	"time"
 )
 
 type Api struct {
-	db   *sql.DB
-	conf *config
+	store       Store
+	live        *liveConfig
+	revocations *revocationStore
+	blobs       BlobStore
 }
 
-func NewApi(db *sql.DB, conf *config) *Api {
-	return &Api{db, conf}
+func NewApi(store Store, conf *config) (*Api, error) {
+	state, err := newConfigState(conf)
+	if err != nil {
+		return nil, err
+	}
+	blobs, err := newBlobStore(conf)
+	if err != nil {
+		return nil, fmt.Errorf("init blob store: %v", err)
+	}
+	live := &liveConfig{}
+	live.store(state)
+	return &Api{store, live, newRevocationStore(store), blobs}, nil
+}
+
+// Current config; it may be replaced by reload at any moment, so the same request should not
+// count on getting the same config twice
+func (a *Api) config() *config {
+	return a.live.load().conf
+}
+
+func (a *Api) keys() *keyring {
+	return a.live.load().keys
+}
+
+func (a *Api) passwords() *passwords {
+	return a.live.load().passwords
+}
+
+func (a *Api) mailer() Mailer {
+	return a.live.load().mailer
 }
 
 // TODO: wrapper for logging requests and responses (maybe x-req-id?)
@@ -26,7 +62,7 @@ func (a *Api) Handler(f func(w http.ResponseWriter, r *http.Request)) *ApiHandle
 }
 
 func (a *Api) HandlerWithAuth(f func(w http.ResponseWriter, r *http.Request, userId int64)) *ApiHandlerWithAuth {
-	return &ApiHandlerWithAuth{conf: a.conf, doHandle: f}
+	return &ApiHandlerWithAuth{live: a.live, revocations: a.revocations, doHandle: f}
 }
 
 // Register new user by putting corresponding row into 'users' table
@@ -35,13 +71,50 @@ func (a *Api) HandleRegistration(w http.ResponseWriter, r *http.Request) {
 		Login    string `json:"login"`
 		Password string `json:"password"`
 		Name     string `json:"name"`
+		Email    string `json:"email"`
+		// Token from invitation sent to email
+		Invitation string `json:"invitation"`
 	}
 	if err := json.NewDecoder(r.Body).Decode(&reqBody); err != nil {
 		replyWithError(w, http.StatusBadRequest, fmt.Errorf("decode request body: %v", err))
 		return
 	}
 	defer r.Body.Close()
-	if err := insertUser(a.db, reqBody.Login, reqBody.Password, reqBody.Name); err != nil {
+	// Records are shared by login or email, so login must not be taken for someone's email
+	if _, ok := parseEmail(reqBody.Login); ok {
+		replyWithError(w, http.StatusBadRequest, fmt.Errorf("login %q must not be an email", reqBody.Login))
+		return
+	}
+	if reqBody.Email != "" {
+		if _, ok := parseEmail(reqBody.Email); !ok {
+			replyWithError(w, http.StatusBadRequest, fmt.Errorf("invalid email %q", reqBody.Email))
+			return
+		}
+	} else if reqBody.Invitation != "" {
+		replyWithError(w, http.StatusBadRequest, fmt.Errorf("email invitation was sent to is not set"))
+		return
+	}
+	if err := validatePassword(reqBody.Password); err != nil {
+		replyWithError(w, http.StatusBadRequest, err)
+		return
+	}
+	hash, err := a.passwords().Hash(reqBody.Password)
+	if err != nil {
+		err = fmt.Errorf("hash password: %v", err)
+		logE.Print(err)
+		replyWithError(w, http.StatusInternalServerError, err)
+		return
+	}
+	err = a.store.RegisterUser(reqBody.Login, hash, reqBody.Name, reqBody.Email, reqBody.Invitation)
+	if err == errInvitationInvalid {
+		replyWithError(w, http.StatusBadRequest, err)
+		return
+	}
+	if err == errEmailTaken {
+		replyWithError(w, http.StatusConflict, err)
+		return
+	}
+	if err != nil {
 		err = fmt.Errorf("insert new user: %v", err)
 		logE.Print(err)
 		replyWithError(w, http.StatusInternalServerError, err)
@@ -49,8 +122,7 @@ func (a *Api) HandleRegistration(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-// Authorize user if exists and provide her with access token
-// TODO: implement refresh token procedure
+// Authorize user if exists and provide her with access and refresh tokens
 func (a *Api) HandleAuthorization(w http.ResponseWriter, r *http.Request) {
 	var reqBody struct {
 		Login    string `json:"login"`
@@ -63,64 +135,144 @@ func (a *Api) HandleAuthorization(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	defer r.Body.Close()
-	rows, err := a.db.Query("SELECT id FROM users WHERE login=$1 AND password=$2", reqBody.Login, reqBody.Password)
+	userId, storedPassword, err := a.store.SelectUserCredentials(reqBody.Login)
+	if err == sql.ErrNoRows {
+		err = fmt.Errorf("no user with login %q", reqBody.Login)
+		logI.Print(err)
+		replyWithError(w, http.StatusForbidden, err)
+		return
+	}
 	if err != nil {
 		err = fmt.Errorf("select user with login %q: %v", reqBody.Login, err)
 		logE.Print(err)
-		replyWithError(w, http.StatusForbidden, err)
+		replyWithError(w, http.StatusInternalServerError, err)
 		return
 	}
-	if !rows.Next() {
-		err = fmt.Errorf("no user with login %q: %v", reqBody.Login, err)
+	ok, needsRehash, err := a.passwords().Verify(storedPassword, reqBody.Password)
+	if err != nil {
+		// Stored credentials that can not be verified are logged, but the client gets the same
+		// reply as for invalid password
+		logE.Printf("verify password of user %d: %v", userId, err)
+	}
+	if err != nil || !ok {
+		// Same reply as for unknown login so that logins can not be enumerated
+		logI.Printf("invalid password for user %d", userId)
+		replyWithError(w, http.StatusForbidden, fmt.Errorf("no user with login %q", reqBody.Login))
+		return
+	}
+	if needsRehash {
+		// Failure here should not prevent user from logging in: rehash will be retried next time
+		if hash, err := a.passwords().Hash(reqBody.Password); err != nil {
+			logE.Printf("rehash password of user %d: %v", userId, err)
+		} else if err := a.store.UpdateUserPassword(userId, hash); err != nil {
+			logE.Printf("update password of user %d: %v", userId, err)
+		}
+	}
+	refreshToken, err := a.store.NewRefreshTokenFamily(userId, a.config().refreshTokenTTL())
+	if err != nil {
+		err = fmt.Errorf("create refresh token for user %d: %v", userId, err)
 		logE.Print(err)
+		replyWithError(w, http.StatusInternalServerError, err)
+		return
+	}
+	a.replyWithTokens(w, userId, reqBody.Login, refreshToken)
+}
+
+// Exchange refresh token for new pair of access and refresh tokens
+func (a *Api) HandleRefresh(w http.ResponseWriter, r *http.Request) {
+	var reqBody struct {
+		RefreshToken string `json:"refresh_token"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&reqBody); err != nil {
+		err = fmt.Errorf("decode request body: %v", err)
+		logI.Print(err)
+		replyWithError(w, http.StatusBadRequest, err)
+		return
+	}
+	defer r.Body.Close()
+	userId, login, refreshToken, err := a.store.RotateRefreshToken(reqBody.RefreshToken, a.config().refreshTokenTTL())
+	if err == errRefreshTokenInvalid || err == errRefreshTokenReused {
+		logI.Printf("refresh tokens: %v", err)
 		replyWithError(w, http.StatusForbidden, err)
 		return
 	}
-	var userId int64
-	if err := rows.Scan(&userId); err != nil {
-		err = fmt.Errorf("retrieve user id from db: %v", err)
+	if err != nil {
+		err = fmt.Errorf("rotate refresh token: %v", err)
+		logE.Print(err)
 		replyWithError(w, http.StatusInternalServerError, err)
 		return
 	}
-	claimsMap := make(map[string]interface{})
-	if err := mapstructure.Decode(&tokenClaims{
-		Login:  reqBody.Login,
-		UserId: userId,
-		Exp:    time.Now().Add(24 * time.Hour).Unix(),
-	}, &claimsMap); err != nil {
-		err = fmt.Errorf("encode token claims: %v", err)
+	a.replyWithTokens(w, userId, login, refreshToken)
+}
+
+// Revoke access token the request is made with and, if provided, the refresh token issued along with it
+// Note: needs auth
+func (a *Api) HandleLogout(w http.ResponseWriter, r *http.Request, userId int64) {
+	var reqBody struct {
+		RefreshToken string `json:"refresh_token"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&reqBody); err != nil && err != io.EOF {
+		err = fmt.Errorf("decode request body: %v", err)
+		logI.Print(err)
+		replyWithError(w, http.StatusBadRequest, err)
+		return
+	}
+	defer r.Body.Close()
+	claims := claimsFromRequest(r)
+	if claims == nil || claims.Jti == "" {
+		replyWithError(w, http.StatusBadRequest, fmt.Errorf("token can not be revoked individually, log out all sessions instead"))
+		return
+	}
+	if err := a.revocations.revokeToken(claims); err != nil {
+		err = fmt.Errorf("revoke access token of user %d: %v", userId, err)
+		logE.Print(err)
 		replyWithError(w, http.StatusInternalServerError, err)
 		return
 	}
-	token := jwt.NewWithClaims(jwt.GetSigningMethod("HS256"), jwt.MapClaims(claimsMap))
-	tokenString, err := token.SignedString([]byte(a.conf.JwtSignKey))
-	if err != nil {
-		err = fmt.Errorf("error signing token for user %d: %v", userId, err)
+	if a.config().AuthCookie {
+		http.SetCookie(w, a.accessTokenCookie("", -1))
+	}
+	if reqBody.RefreshToken == "" {
+		return
+	}
+	if err := a.store.RevokeRefreshTokenFamily(userId, reqBody.RefreshToken); err != nil {
+		err = fmt.Errorf("revoke refresh token of user %d: %v", userId, err)
+		logE.Print(err)
 		replyWithError(w, http.StatusInternalServerError, err)
 		return
 	}
-	resBody, err := json.Marshal(
-		&struct {
-			AccessToken string `json:"access_token"`
-		}{
-			AccessToken: tokenString,
-		},
-	)
-	if err != nil {
-		err = fmt.Errorf("marshall access token for user with id %d: %v", userId, err)
+}
+
+// Revoke all access and refresh tokens issued to user so far
+// Note: needs auth
+func (a *Api) HandleLogoutAll(w http.ResponseWriter, r *http.Request, userId int64) {
+	defer r.Body.Close()
+	if err := a.store.RevokeUserRefreshTokens(userId); err != nil {
+		err = fmt.Errorf("revoke refresh tokens of user %d: %v", userId, err)
+		logE.Print(err)
+		replyWithError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if err := a.revocations.revokeUserTokens(userId); err != nil {
+		err = fmt.Errorf("revoke access tokens of user %d: %v", userId, err)
+		logE.Print(err)
 		replyWithError(w, http.StatusInternalServerError, err)
 		return
 	}
-	fmt.Fprint(w, string(resBody))
+	if a.config().AuthCookie {
+		http.SetCookie(w, a.accessTokenCookie("", -1))
+	}
 }
 
 // Add new record
 // Note: needs auth
 func (a *Api) HandleNewRecord(w http.ResponseWriter, r *http.Request, userId int64) {
 	var reqBody struct {
-		Name     string `json:"name"`
-		Duration int64  `json:"duration"`
-		Content  string `json:"content"`
+		Name        string   `json:"name"`
+		Description string   `json:"description"`
+		Tags        []string `json:"tags"`
+		Duration    float64  `json:"duration"`
+		Content     string   `json:"content"`
 	}
 	if err := json.NewDecoder(r.Body).Decode(&reqBody); err != nil {
 		err = fmt.Errorf("decode request body: %v", err)
@@ -129,20 +281,384 @@ func (a *Api) HandleNewRecord(w http.ResponseWriter, r *http.Request, userId int
 		return
 	}
 	defer r.Body.Close()
-	if err := insertRecord(a.db, reqBody.Name, reqBody.Content, userId); err != nil {
-		err = fmt.Errorf("insert new record: %v", err)
+	if reqBody.Duration < 0 {
+		replyWithError(w, http.StatusBadRequest, fmt.Errorf("duration must not be negative"))
+		return
+	}
+	tags, err := normalizeTags(reqBody.Tags)
+	if err != nil {
+		replyWithError(w, http.StatusBadRequest, err)
+		return
+	}
+	rec := &recordInfo{Name: reqBody.Name, Description: reqBody.Description, OwnerId: userId, Duration: reqBody.Duration,
+		Tags: tags}
+	if err := a.createRecord(r.Context(), rec, strings.NewReader(reqBody.Content)); err != nil {
+		replyWithCreateRecordError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusCreated)
+}
+
+// Upload binary record content either as multipart/form-data with "file" part or as raw audio/* body.
+// Record name is taken from "name" query param, "name" form field preceding the file or file name.
+// Duration can be passed the same way in case it can not be read from content.
+// Note: needs auth
+func (a *Api) HandleUploadRecord(w http.ResponseWriter, r *http.Request, userId int64) {
+	defer r.Body.Close()
+	maxSize := a.config().maxUploadSize()
+	mediaType, params, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil {
+		replyWithError(w, http.StatusUnsupportedMediaType, fmt.Errorf("parse content type: %v", err))
+		return
+	}
+	name := r.URL.Query().Get("name")
+	durationParam := r.URL.Query().Get("duration")
+	var content io.Reader
+	var contentType string
+	switch {
+	case mediaType == "multipart/form-data":
+		r.Body = http.MaxBytesReader(w, r.Body, maxSize+maxMultipartOverhead)
+		mr := multipart.NewReader(r.Body, params["boundary"])
+		for content == nil {
+			part, err := mr.NextPart()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				replyWithError(w, http.StatusBadRequest, fmt.Errorf("read multipart body: %v", err))
+				return
+			}
+			switch part.FormName() {
+			case "name":
+				value, err := readContent(part, 1024)
+				if err != nil {
+					replyWithError(w, http.StatusBadRequest, fmt.Errorf("read name field: %v", err))
+					return
+				}
+				name = string(value)
+			case "duration":
+				value, err := readContent(part, 64)
+				if err != nil {
+					replyWithError(w, http.StatusBadRequest, fmt.Errorf("read duration field: %v", err))
+					return
+				}
+				durationParam = string(value)
+			case "file":
+				content = part
+				contentType = part.Header.Get("Content-Type")
+				if name == "" {
+					name = part.FileName()
+				}
+			}
+		}
+		if content == nil {
+			replyWithError(w, http.StatusBadRequest, fmt.Errorf("no file part in multipart body"))
+			return
+		}
+	case isAudioMediaType(mediaType):
+		if r.ContentLength > maxSize {
+			replyWithError(w, http.StatusRequestEntityTooLarge, errContentTooLarge)
+			return
+		}
+		r.Body = http.MaxBytesReader(w, r.Body, maxSize)
+		content = r.Body
+		contentType = mediaType
+	default:
+		replyWithError(w, http.StatusUnsupportedMediaType, fmt.Errorf("expected multipart/form-data or audio/* body"))
+		return
+	}
+	if name == "" {
+		replyWithError(w, http.StatusBadRequest, fmt.Errorf("record name is not set"))
+		return
+	}
+	rec := &recordInfo{Name: name, OwnerId: userId, ContentType: contentType}
+	if durationParam != "" {
+		// Used only if duration can not be read from content
+		if rec.Duration, err = strconv.ParseFloat(durationParam, 64); err != nil || !(rec.Duration >= 0) || math.IsInf(rec.Duration, 1) {
+			replyWithError(w, http.StatusBadRequest, fmt.Errorf("invalid duration %q", durationParam))
+			return
+		}
+	}
+	if err := a.createRecord(r.Context(), rec, content); err != nil {
+		replyWithCreateRecordError(w, err)
+		return
+	}
+	res, err := json.Marshal(rec)
+	if err != nil {
+		err = fmt.Errorf("encode record %d: %v", rec.Id, err)
+		logE.Print(err)
 		replyWithError(w, http.StatusInternalServerError, err)
 		return
 	}
+	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusCreated)
+	fmt.Fprint(w, string(res))
 }
 
-// Share record to another user by creating new row in 'shared' table
+// Route requests to a single record /v1/records/{id} and its resources /v1/records/{id}/...
+// Note: needs auth
+func (a *Api) HandleRecord(w http.ResponseWriter, r *http.Request, userId int64) {
+	recordId, subresource, err := parseRecordPath(r.URL.Path)
+	if err != nil {
+		replyWithError(w, http.StatusNotFound, err)
+		return
+	}
+	switch subresource {
+	case "":
+		switch r.Method {
+		case http.MethodGet:
+			a.handleGetRecord(w, r, userId, recordId)
+		case http.MethodPatch:
+			a.handleEditRecord(w, r, userId, recordId)
+		case http.MethodDelete:
+			a.handleDeleteRecord(w, r, userId, recordId)
+		default:
+			replyWithError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s is not allowed", r.Method))
+		}
+	case "content":
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			replyWithError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s is not allowed", r.Method))
+			return
+		}
+		a.handleRecordContent(w, r, userId, recordId)
+	case "links":
+		switch r.Method {
+		case http.MethodGet:
+			a.handleShareLinksList(w, r, userId, recordId)
+		case http.MethodPost:
+			a.handleCreateShareLink(w, r, userId, recordId)
+		default:
+			replyWithError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s is not allowed", r.Method))
+		}
+	default:
+		if linkId := strings.TrimPrefix(subresource, "links/"); linkId != subresource && linkId != "" {
+			if r.Method != http.MethodDelete {
+				replyWithError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s is not allowed", r.Method))
+				return
+			}
+			a.handleRevokeShareLink(w, r, userId, recordId, linkId)
+			return
+		}
+		replyWithError(w, http.StatusNotFound, fmt.Errorf("unknown record resource %q", subresource))
+	}
+}
+
+// Select record visible to user replying with 404 if there is no such record and with 403 if
+// user has lower permission than required
+func (a *Api) selectRecordForRequest(w http.ResponseWriter, userId int64, recordId int64, required permission) *recordInfo {
+	rec, err := a.store.SelectRecord(recordId, userId)
+	if err == sql.ErrNoRows {
+		replyWithError(w, http.StatusNotFound, fmt.Errorf("no record %d available to user %d", recordId, userId))
+		return nil
+	}
+	if err != nil {
+		err = fmt.Errorf("select record %d: %v", recordId, err)
+		logE.Print(err)
+		replyWithError(w, http.StatusInternalServerError, err)
+		return nil
+	}
+	if rec.Permission < required {
+		replyWithError(w, http.StatusForbidden, fmt.Errorf("user %d needs %s permission to record %d, has %s",
+			userId, required, recordId, rec.Permission))
+		return nil
+	}
+	if rec.Tags, err = a.store.SelectRecordTags(recordId); err != nil {
+		err = fmt.Errorf("select tags of record %d: %v", recordId, err)
+		logE.Print(err)
+		replyWithError(w, http.StatusInternalServerError, err)
+		return nil
+	}
+	return rec
+}
+
+func replyWithRecord(w http.ResponseWriter, rec *recordInfo) {
+	res, err := json.Marshal(rec)
+	if err != nil {
+		err = fmt.Errorf("encode record %d: %v", rec.Id, err)
+		logE.Print(err)
+		replyWithError(w, http.StatusInternalServerError, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	fmt.Fprint(w, string(res))
+}
+
+func (a *Api) handleGetRecord(w http.ResponseWriter, r *http.Request, userId int64, recordId int64) {
+	if rec := a.selectRecordForRequest(w, userId, recordId, permListen); rec != nil {
+		replyWithRecord(w, rec)
+	}
+}
+
+// Change name, description and/or tags of record; only owner and users with edit permission can edit record
+func (a *Api) handleEditRecord(w http.ResponseWriter, r *http.Request, userId int64, recordId int64) {
+	defer r.Body.Close()
+	var reqBody struct {
+		Name        *string   `json:"name"`
+		Description *string   `json:"description"`
+		Tags        *[]string `json:"tags"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&reqBody); err != nil {
+		err = fmt.Errorf("decode request body: %v", err)
+		logI.Print(err)
+		replyWithError(w, http.StatusBadRequest, err)
+		return
+	}
+	if reqBody.Name != nil && *reqBody.Name == "" {
+		replyWithError(w, http.StatusBadRequest, fmt.Errorf("record name must not be empty"))
+		return
+	}
+	var tags []string
+	if reqBody.Tags != nil {
+		var err error
+		if tags, err = normalizeTags(*reqBody.Tags); err != nil {
+			replyWithError(w, http.StatusBadRequest, err)
+			return
+		}
+	}
+	rec := a.selectRecordForRequest(w, userId, recordId, permEdit)
+	if rec == nil {
+		return
+	}
+	if err := a.store.UpdateRecord(recordId, reqBody.Name, reqBody.Description, tags, a.config().searchConfig()); err != nil {
+		err = fmt.Errorf("update record %d: %v", recordId, err)
+		logE.Print(err)
+		replyWithError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if reqBody.Name != nil {
+		rec.Name = *reqBody.Name
+	}
+	if reqBody.Description != nil {
+		rec.Description = *reqBody.Description
+	}
+	if tags != nil {
+		rec.Tags = tags
+	}
+	replyWithRecord(w, rec)
+}
+
+// Delete record along with its sharings and content; only owner can delete record
+func (a *Api) handleDeleteRecord(w http.ResponseWriter, r *http.Request, userId int64, recordId int64) {
+	if rec := a.selectRecordForRequest(w, userId, recordId, permOwner); rec == nil {
+		return
+	}
+	storageKey, err := a.store.DeleteRecord(recordId)
+	if err == sql.ErrNoRows {
+		// Deleted by concurrent request
+		replyWithError(w, http.StatusNotFound, fmt.Errorf("no record %d available to user %d", recordId, userId))
+		return
+	}
+	if err != nil {
+		err = fmt.Errorf("delete record %d: %v", recordId, err)
+		logE.Print(err)
+		replyWithError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if storageKey != "" {
+		// Record is gone already, so failing to delete content only leaves orphaned blob behind
+		if err := a.blobs.Delete(r.Context(), storageKey); err != nil {
+			logE.Printf("delete blob %q of record %d: %v", storageKey, recordId, err)
+		}
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Stream record content supporting range and conditional requests, so that players can seek. With
+// download param content is served as attachment, which requires download permission.
+func (a *Api) handleRecordContent(w http.ResponseWriter, r *http.Request, userId int64, recordId int64) {
+	download, err := parseDownloadParam(r)
+	if err != nil {
+		replyWithError(w, http.StatusBadRequest, err)
+		return
+	}
+	rec, content, err := a.store.SelectRecordContent(recordId, userId)
+	if err == sql.ErrNoRows {
+		replyWithError(w, http.StatusNotFound, fmt.Errorf("no record %d available to user %d", recordId, userId))
+		return
+	}
+	if err != nil {
+		err = fmt.Errorf("select record %d: %v", recordId, err)
+		logE.Print(err)
+		replyWithError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if download && rec.Permission < permDownload {
+		replyWithError(w, http.StatusForbidden, fmt.Errorf("user %d needs %s permission to download record %d, has %s",
+			userId, permDownload, recordId, rec.Permission))
+		return
+	}
+	a.serveRecordContent(w, r, rec, content, download)
+}
+
+func parseDownloadParam(r *http.Request) (bool, error) {
+	param := r.URL.Query().Get("download")
+	if param == "" {
+		return false, nil
+	}
+	download, err := strconv.ParseBool(param)
+	if err != nil {
+		return false, fmt.Errorf("invalid download param: %q", param)
+	}
+	return download, nil
+}
+
+// Serve content of record selected by selectRecordContent as attachment or for playback according
+// to permission set in rec
+func (a *Api) serveRecordContent(w http.ResponseWriter, r *http.Request, rec *recordInfo, content []byte, download bool) {
+	var body io.ReadSeeker
+	if rec.StorageKey != "" {
+		blob, err := a.blobs.Open(r.Context(), rec.StorageKey)
+		if err != nil {
+			err = fmt.Errorf("open content of record %d: %v", rec.Id, err)
+			logE.Print(err)
+			replyWithError(w, http.StatusInternalServerError, err)
+			return
+		}
+		defer blob.Close()
+		body = blob
+	} else {
+		// Content has not been moved from 'records' table to blob store yet
+		sum := sha256.Sum256(content)
+		rec.Checksum = hex.EncodeToString(sum[:])
+		body = bytes.NewReader(content)
+	}
+	// Records stored before content types were checked may have any type
+	contentType := rec.ContentType
+	if mediaType, _, err := mime.ParseMediaType(contentType); err != nil || !isAudioMediaType(mediaType) {
+		contentType = defaultRecordMediaType
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("ETag", `"`+rec.Checksum+`"`)
+	if rec.Permission < permDownload {
+		// Listen-only content is for playback, it should neither be kept by browser nor offered to be
+		// saved under record name. It is still the original content, so this does not stop users who
+		// save the stream anyway.
+		w.Header().Set("Cache-Control", "no-store")
+	} else {
+		disposition := "inline"
+		if download {
+			disposition = "attachment"
+		}
+		w.Header().Set("Content-Disposition", mime.FormatMediaType(disposition, map[string]string{"filename": rec.Name}))
+	}
+	http.ServeContent(w, r, rec.Name, rec.CreatedAt, body)
+}
+
+// Share record to another user with given permission or change permission of existing sharing.
+// Besides owner, users the record is shared to with reshare permission can share it further with
+// permission not higher than their own. Target user is given either by id or by login or email;
+// people without account are invited by email. Records can also be shared to groups the user is
+// member of.
 // Note: needs auth
 func (a *Api) HandleShareRecord(w http.ResponseWriter, r *http.Request, userId int64) {
 	var reqBody struct {
 		RecordId int64 `json:"record_id"`
 		UserId   int64 `json:"user_id"`
+		GroupId  int64 `json:"group_id"`
+		// Login or email of user
+		To         string `json:"to"`
+		Permission string `json:"permission"`
 	}
 	if err := json.NewDecoder(r.Body).Decode(&reqBody); err != nil {
 		err = fmt.Errorf("decode share request body: %v", err)
@@ -151,28 +667,102 @@ func (a *Api) HandleShareRecord(w http.ResponseWriter, r *http.Request, userId i
 		return
 	}
 	defer r.Body.Close()
-	qres, err := a.db.Exec(`
-INSERT INTO shared(record_id, "to")
-SELECT R.id, $1 FROM records R
-WHERE owner_id=$2 AND R.id=$3;
-`, reqBody.UserId, userId, reqBody.RecordId)
+	perm, err := parseSharePermission(reqBody.Permission)
 	if err != nil {
-		err = fmt.Errorf("insert new shared record: %v", err)
-		replyWithError(w, http.StatusInternalServerError, err)
+		replyWithError(w, http.StatusBadRequest, err)
 		return
 	}
-	if nrows, err := qres.RowsAffected(); err != nil || nrows == 0 {
-		err = fmt.Errorf("while insert shared record: %d rows affected, error: %v", nrows, err)
+	rec, err := a.store.SelectRecord(reqBody.RecordId, userId)
+	if err == sql.ErrNoRows {
+		err = fmt.Errorf("no record %d available to user %d", reqBody.RecordId, userId)
 		replyWithError(w, http.StatusNotAcceptable, err)
+		return
+	}
+	if err != nil {
+		err = fmt.Errorf("select record %d: %v", reqBody.RecordId, err)
+		logE.Print(err)
+		replyWithError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if rec.Permission < permReshare {
+		replyWithError(w, http.StatusForbidden, fmt.Errorf("user %d needs %s permission to share record %d, has %s",
+			userId, permReshare, rec.Id, rec.Permission))
+		return
+	}
+	if rec.Permission != permOwner && perm > rec.Permission {
+		replyWithError(w, http.StatusForbidden, fmt.Errorf("user %d can not share record %d with %s permission",
+			userId, rec.Id, perm))
+		return
+	}
+	if reqBody.GroupId != 0 {
+		a.shareRecordToGroup(w, userId, rec, reqBody.GroupId, perm)
+		return
+	}
+	if reqBody.UserId == 0 {
+		to := strings.TrimSpace(reqBody.To)
+		if to == "" {
+			replyWithError(w, http.StatusBadRequest, fmt.Errorf("either user_id or to must be set"))
+			return
+		}
+		u, err := a.store.SelectUserByLoginOrEmail(to)
+		if err == sql.ErrNoRows {
+			if email, ok := parseEmail(to); ok {
+				a.inviteToRecord(w, r, userId, rec, email, perm)
+				return
+			}
+			replyWithError(w, http.StatusNotFound, fmt.Errorf("no user with login %q", to))
+			return
+		}
+		if err != nil {
+			err = fmt.Errorf("look up user %q: %v", to, err)
+			logE.Print(err)
+			replyWithError(w, http.StatusInternalServerError, err)
+			return
+		}
+		reqBody.UserId = u.Id
+	}
+	if reqBody.UserId == rec.OwnerId || reqBody.UserId == userId {
+		replyWithError(w, http.StatusBadRequest, fmt.Errorf("record %d can not be shared to user %d",
+			rec.Id, reqBody.UserId))
+		return
+	}
+	blocked, err := a.store.IsBlocked(reqBody.UserId, userId)
+	if err != nil {
+		err = fmt.Errorf("check whether user %d is blocked: %v", userId, err)
+		logE.Print(err)
+		replyWithError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if blocked {
+		replyWithError(w, http.StatusForbidden, fmt.Errorf("user %d does not accept records from user %d",
+			reqBody.UserId, userId))
+		return
+	}
+	err = a.store.UpsertSharing(rec.Id, reqBody.UserId, userId, perm, rec.Permission == permOwner)
+	if err == errNoSuchUser {
+		replyWithError(w, http.StatusNotFound, fmt.Errorf("no user %d", reqBody.UserId))
+		return
+	}
+	if err == errNotSharer {
+		replyWithError(w, http.StatusForbidden, fmt.Errorf("record %d was shared to user %d by another user",
+			rec.Id, reqBody.UserId))
+		return
+	}
+	if err != nil {
+		err = fmt.Errorf("insert new shared record: %v", err)
+		replyWithError(w, http.StatusInternalServerError, err)
+		return
 	}
 }
 
-// Unshare user's record by removing corresponding row in 'records' table
+// Unshare record by removing corresponding row in 'shared' table or in 'group_shares' table if
+// group_id is passed. Owner can remove any sharing of the record, other users only the ones they made.
 // Note: needs auth
 func (a *Api) HandleUnshareRecord(w http.ResponseWriter, r *http.Request, userId int64) {
 	var reqBody struct {
 		RecordId int64 `json:"record_id"`
 		UserId   int64 `json:"user_id"`
+		GroupId  int64 `json:"group_id"`
 	}
 	if err := json.NewDecoder(r.Body).Decode(&reqBody); err != nil {
 		err = fmt.Errorf("decode share request body: %v", err)
@@ -181,120 +771,74 @@ func (a *Api) HandleUnshareRecord(w http.ResponseWriter, r *http.Request, userId
 		return
 	}
 	defer r.Body.Close()
-	qres, err := a.db.Exec(`
-DELETE FROM shared S USING records R
-WHERE R.id=$1 AND R.owner_id=$2 AND S.record_id=$1 AND S."to"=$3
-`, reqBody.RecordId, userId, reqBody.UserId)
+	var deleted bool
+	var err error
+	if reqBody.GroupId != 0 {
+		deleted, err = a.store.DeleteGroupSharing(reqBody.RecordId, userId, reqBody.GroupId)
+	} else {
+		deleted, err = a.store.DeleteSharing(reqBody.RecordId, userId, reqBody.UserId)
+	}
 	if err != nil {
 		err = fmt.Errorf("delete shared record: %v", err)
 		replyWithError(w, http.StatusInternalServerError, err)
 		return
 	}
-	if nrows, err := qres.RowsAffected(); err != nil || nrows == 0 {
-		err = fmt.Errorf("while delete shared record: %d rows affected, error: %v", nrows, err)
+	if !deleted {
+		err = fmt.Errorf("while delete shared record: no sharing of record %d to delete", reqBody.RecordId)
 		replyWithError(w, http.StatusNotAcceptable, err)
 	}
 }
 
-// List all records that are available to user by concatenating his own records and records shared to him by other users
+// List all records that are available to user by concatenating his own records and records shared to him by other users.
+// Records can be filtered by owner, scope, creation time, duration and name.
 // Note: needs auth
 func (a *Api) HandleRecordsList(w http.ResponseWriter, r *http.Request, userId int64) {
-	offset, err := strconv.Atoi(r.URL.Query().Get("offset"))
+	sortBy := r.URL.Query().Get("sort_by")
+	order, err := newRecordsOrder(sortBy, r.URL.Query().Get("order"))
 	if err != nil {
-		replyWithError(w, http.StatusBadRequest, fmt.Errorf("invalid offset param: %v", err))
+		replyWithError(w, http.StatusBadRequest, err)
 		return
 	}
-	limit, err := strconv.Atoi(r.URL.Query().Get("limit"))
+	page, err := parsePageRequest(r, order)
 	if err != nil {
-		replyWithError(w, http.StatusBadRequest, fmt.Errorf("invalid offset param: %v", err))
+		replyWithError(w, http.StatusBadRequest, err)
 		return
 	}
-	const (
-		sortByOwner  = "owner"
-		sortByRecord = "record"
-	)
-	sortby := r.URL.Query().Get("sort_by")
-	if sortby != sortByOwner && sortby != sortByRecord {
-		replyWithError(w, http.StatusBadRequest, fmt.Errorf("invalid sort_by param"))
+	filter, err := parseRecordsFilter(r.URL.Query())
+	if err != nil {
+		replyWithError(w, http.StatusBadRequest, err)
 		return
 	}
-	type shared struct {
-		Id   int64  `json:"id"`
-		Name string `json:"name"`
-	}
-	type record struct {
-		Id        int64    `json:"id"`
-		Name      string   `json:"name"`
-		IsOwner   bool     `json:"is_owner"`
-		OwnerId   int64    `json:"owner_id"`
-		OwnerName string   `json:"owner_name"`
-		SharedTo  []shared `json:"shared_to"`
-	}
-	resBody := struct {
-		TotalCount int64    `json:"total_count"`
-		Records    []record `json:"records"`
-	}{}
-	var orderSuffix string
-	if sortby == sortByOwner {
-		orderSuffix = "user_name"
-	} else {
-		orderSuffix = "rec_name"
-	}
-	rows, err := a.db.Query(fmt.Sprintf(`
-SELECT user_records.rec_id,
-       user_records.rec_name,
-       user_records.rec_owner,
-       user_records.user_id,
-       user_records.user_name,
-       S."to",
-       U.name
-FROM (
-        (SELECT R.id AS rec_id,
-                R.name AS rec_name,
-                R.owner_id=$1 AS rec_owner,
-                U.id AS user_id,
-                U.name AS user_name
-         FROM ( (records R
-                 JOIN users U ON R.owner_id=U.id)
-               FULL OUTER JOIN SHARED S ON S.record_id=R.id)
-         WHERE R.owner_id=$1
-           OR S."to"=$1
-         LIMIT $2
-         OFFSET $3) AS user_records
-      FULL OUTER JOIN SHARED S ON S.record_id=user_records.rec_id)
-FULL OUTER JOIN users U ON S."to"=U.id
-ORDER BY user_records.rec_owner DESC,
-         %s,
-         rec_id;
-`, orderSuffix), userId, limit, offset)
+	recs, total, err := a.store.ListRecords(userId, filter, sortBy, order, page)
 	if err != nil {
 		err = fmt.Errorf("select all records for user %d: %v", userId, err)
 		logE.Print(err)
 		replyWithError(w, http.StatusInternalServerError, err)
 		return
 	}
-	for rows.Next() {
-		var rec record
-		var sharedToId sql.NullInt64
-		var sharedToName sql.NullString
-		if err := rows.Scan(&rec.Id, &rec.Name, &rec.IsOwner, &rec.OwnerId, &rec.OwnerName, &sharedToId, &sharedToName); err != nil {
-			err = fmt.Errorf("retrieve record from db for user %d: %v", rec.OwnerId, err)
-			logE.Print(err)
-			replyWithError(w, http.StatusInternalServerError, err)
-			return
-		}
-		if len(resBody.Records) > 0 && resBody.Records[len(resBody.Records)-1].Id == rec.Id {
-			resBody.Records[len(resBody.Records)-1].SharedTo = append(resBody.Records[len(resBody.Records)-1].SharedTo,
-				shared{sharedToId.Int64, sharedToName.String})
-		} else {
-			rec.SharedTo = []shared{}
-			if sharedToId.Valid && sharedToName.Valid {
-				rec.SharedTo = append(rec.SharedTo, shared{sharedToId.Int64, sharedToName.String})
-			}
-			resBody.Records = append(resBody.Records, rec)
-		}
+	resBody := struct {
+		TotalCount int64           `json:"total_count"`
+		Records    []*listedRecord `json:"records"`
+		NextCursor string          `json:"next_cursor,omitempty"`
+	}{TotalCount: total, Records: recs}
+	selected := len(resBody.Records)
+	if selected > page.limit {
+		resBody.Records = resBody.Records[:page.limit]
+	}
+	if resBody.NextCursor, err = page.nextCursor(selected, order, func() []interface{} {
+		return resBody.Records[len(resBody.Records)-1].key(sortBy)
+	}); err != nil {
+		err = fmt.Errorf("encode cursor: %v", err)
+		logE.Print(err)
+		replyWithError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if err := a.store.SelectSharedTo(resBody.Records); err != nil {
+		err = fmt.Errorf("select users records of user %d are shared to: %v", userId, err)
+		logE.Print(err)
+		replyWithError(w, http.StatusInternalServerError, err)
+		return
 	}
-	resBody.TotalCount = int64(len(resBody.Records))
 	res, err := json.Marshal(resBody)
 	if err != nil {
 		err = fmt.Errorf("encode records list: %v", err)
@@ -305,61 +849,117 @@ ORDER BY user_records.rec_owner DESC,
 	fmt.Fprint(w, string(res))
 }
 
-// List all users who share their records
-// Note: needs auth
-func (a *Api) HandleSharersList(w http.ResponseWriter, r *http.Request, userId int64) {
-	offset, err := strconv.Atoi(r.URL.Query().Get("offset"))
+type sharingUser struct {
+	Id            int64  `json:"id"`
+	Name          string `json:"name"`
+	SharedRecords int64  `json:"shared_records"`
+}
+
+var sharingUsersOrder = &keysetOrder{name: "id", columns: []string{"id"}, desc: []bool{false}, sample: []interface{}{int64(0)}}
+
+// Reply with page of users along with number of records shared between them and the caller
+func (a *Api) replyWithSharingUsers(w http.ResponseWriter, r *http.Request, userId int64, what string,
+	list func(userId int64, page *pageRequest) ([]sharingUser, int64, error)) {
+	page, err := parsePageRequest(r, sharingUsersOrder)
 	if err != nil {
-		replyWithError(w, http.StatusBadRequest, fmt.Errorf("invalid offset param: %v", err))
+		replyWithError(w, http.StatusBadRequest, err)
 		return
 	}
-	limit, err := strconv.Atoi(r.URL.Query().Get("limit"))
+	users, total, err := list(userId, page)
 	if err != nil {
-		replyWithError(w, http.StatusBadRequest, fmt.Errorf("invalid limit param: %v", err))
+		err = fmt.Errorf("select %s: %v", what, err)
+		logE.Print(err)
+		replyWithError(w, http.StatusInternalServerError, err)
 		return
 	}
-	rows, err := a.db.Query(`
-SELECT DISTINCT R.owner_id,
-                U.name,
-                COUNT(DISTINCT R.id)
-FROM ( SHARED S
-       JOIN records R ON S.record_id=R.id
-       JOIN users U ON R.owner_id=U.id)
-GROUP BY R.owner_id,
-         U.name
-ORDER BY R.owner_id
-LIMIT $1
-OFFSET $2;
-`, limit, offset)
+	resBody := struct {
+		TotalCount int64         `json:"total_count"`
+		Users      []sharingUser `json:"users"`
+		NextCursor string        `json:"next_cursor,omitempty"`
+	}{TotalCount: total, Users: users}
+	selected := len(resBody.Users)
+	if selected > page.limit {
+		resBody.Users = resBody.Users[:page.limit]
+	}
+	if resBody.NextCursor, err = page.nextCursor(selected, sharingUsersOrder, func() []interface{} {
+		return []interface{}{resBody.Users[len(resBody.Users)-1].Id}
+	}); err != nil {
+		err = fmt.Errorf("encode cursor: %v", err)
+		logE.Print(err)
+		replyWithError(w, http.StatusInternalServerError, err)
+		return
+	}
+	res, err := json.Marshal(resBody)
 	if err != nil {
-		err = fmt.Errorf("select all sharers for user %d: %v", userId, err)
+		err = fmt.Errorf("encode %s: %v", what, err)
 		logE.Print(err)
 		replyWithError(w, http.StatusInternalServerError, err)
 		return
 	}
-	type user struct {
-		Id            int64  `json:"id"`
-		Name          string `json:"name"`
-		SharedRecords int64  `json:"shared_records"`
+	fmt.Fprint(w, string(res))
+}
+
+// List users who share their records to user along with number of records each of them shares
+// Note: needs auth
+func (a *Api) HandleSharersList(w http.ResponseWriter, r *http.Request, userId int64) {
+	a.replyWithSharingUsers(w, r, userId, fmt.Sprintf("sharers for user %d", userId), a.store.ListSharers)
+}
+
+// List users whom user shares records to along with number of records shared to each of them
+// Note: needs auth
+func (a *Api) HandleRecipientsList(w http.ResponseWriter, r *http.Request, userId int64) {
+	a.replyWithSharingUsers(w, r, userId, fmt.Sprintf("recipients of user %d", userId), a.store.ListRecipients)
+}
+
+var sharerRecordsOrder = &keysetOrder{
+	name:    "created_at",
+	columns: []string{"R.created_at", "R.id"},
+	desc:    []bool{true, true},
+	sample:  []interface{}{time.Time{}, int64(0)},
+}
+
+// List records shared to user by another user: /v1/users/sharers/{id}/records
+// Note: needs auth
+func (a *Api) HandleSharerRecords(w http.ResponseWriter, r *http.Request, userId int64) {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/v1/users/sharers/"), "/")
+	sharerId, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil || len(parts) != 2 || parts[1] != "records" {
+		replyWithError(w, http.StatusNotFound, fmt.Errorf("unknown sharer resource %q", r.URL.Path))
+		return
+	}
+	page, err := parsePageRequest(r, sharerRecordsOrder)
+	if err != nil {
+		replyWithError(w, http.StatusBadRequest, err)
+		return
+	}
+	recs, total, err := a.store.ListSharerRecords(sharerId, userId, page)
+	if err != nil {
+		err = fmt.Errorf("select records shared by user %d to user %d: %v", sharerId, userId, err)
+		logE.Print(err)
+		replyWithError(w, http.StatusInternalServerError, err)
+		return
 	}
 	resBody := struct {
-		TotalCount int64  `json:"total_count"`
-		Users      []user `json:"users"`
-	}{}
-	for rows.Next() {
-		var u user
-		if err := rows.Scan(&u.Id, &u.Name, &u.SharedRecords); err != nil {
-			err = fmt.Errorf("scan next user: %v", err)
-			logE.Print(err)
-			replyWithError(w, http.StatusInternalServerError, err)
-			return
-		}
-		resBody.Users = append(resBody.Users, u)
+		TotalCount int64         `json:"total_count"`
+		Records    []*recordInfo `json:"records"`
+		NextCursor string        `json:"next_cursor,omitempty"`
+	}{TotalCount: total, Records: recs}
+	selected := len(resBody.Records)
+	if selected > page.limit {
+		resBody.Records = resBody.Records[:page.limit]
+	}
+	if resBody.NextCursor, err = page.nextCursor(selected, sharerRecordsOrder, func() []interface{} {
+		last := resBody.Records[len(resBody.Records)-1]
+		return []interface{}{last.CreatedAt, last.Id}
+	}); err != nil {
+		err = fmt.Errorf("encode cursor: %v", err)
+		logE.Print(err)
+		replyWithError(w, http.StatusInternalServerError, err)
+		return
 	}
-	resBody.TotalCount = int64(len(resBody.Users))
 	res, err := json.Marshal(resBody)
 	if err != nil {
-		err = fmt.Errorf("encode sharers list: %v", err)
+		err = fmt.Errorf("encode records list: %v", err)
 		logE.Print(err)
 		replyWithError(w, http.StatusInternalServerError, err)
 		return
@@ -0,0 +1,459 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+)
+
+// Properties of audio stream derived from headers of WAV, FLAC, MP3 and Ogg (Vorbis, Opus, FLAC) files
+type audioInfo struct {
+	Codec string
+	// Seconds
+	Duration   float64
+	SampleRate int
+	Channels   int
+	// Bits per second
+	Bitrate int
+}
+
+var errUnknownAudioFormat = errors.New("unknown audio format")
+
+const (
+	// How far from the beginning of MP3 stream the first frame is looked for
+	mp3SyncSearchLimit = 64 << 10
+	// How far from the end of Ogg stream the last page is looked for
+	oggLastPageSearchLimit = 64 << 10
+)
+
+// Media types of codecs for content uploaded without a specific one
+var codecMediaTypes = map[string]string{
+	"pcm":    "audio/wave",
+	"flac":   "audio/flac",
+	"mp3":    "audio/mpeg",
+	"vorbis": "audio/ogg",
+	"opus":   "audio/ogg",
+}
+
+// Detect format of content and read its properties. Only headers and, for Ogg, the last page
+// are read, so probing is cheap even for large remote blobs.
+func probeAudio(r io.ReadSeeker, size int64) (*audioInfo, error) {
+	start, err := skipId3v2(r)
+	if err != nil {
+		return nil, err
+	}
+	magic := make([]byte, 12)
+	if _, err := io.ReadFull(r, magic); err != nil {
+		return nil, errUnknownAudioFormat
+	}
+	if _, err := r.Seek(start, io.SeekStart); err != nil {
+		return nil, err
+	}
+	var info *audioInfo
+	switch {
+	case bytes.Equal(magic[:4], []byte("RIFF")) && bytes.Equal(magic[8:12], []byte("WAVE")):
+		info, err = probeWav(r, size)
+	case bytes.Equal(magic[:4], []byte("fLaC")):
+		info, err = probeFlac(r, size-start)
+	case bytes.Equal(magic[:4], []byte("OggS")):
+		info, err = probeOgg(r, size)
+	default:
+		info, err = probeMpeg(r, start, size)
+	}
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		err = fmt.Errorf("truncated header")
+	}
+	return info, err
+}
+
+// Skip ID3v2 tag some MP3 (and rarely FLAC) files start with, returning offset of audio stream
+func skipId3v2(r io.ReadSeeker) (int64, error) {
+	header := make([]byte, 10)
+	if _, err := io.ReadFull(r, header); err != nil || !bytes.Equal(header[:3], []byte("ID3")) {
+		_, err := r.Seek(0, io.SeekStart)
+		return 0, err
+	}
+	// Size is stored as syncsafe integer: 7 bits per byte
+	size := int64(header[6])<<21 | int64(header[7])<<14 | int64(header[8])<<7 | int64(header[9])
+	start := 10 + size
+	if header[5]&0x10 != 0 {
+		// Footer
+		start += 10
+	}
+	_, err := r.Seek(start, io.SeekStart)
+	return start, err
+}
+
+func probeWav(r io.ReadSeeker, size int64) (*audioInfo, error) {
+	if _, err := r.Seek(12, io.SeekStart); err != nil {
+		return nil, err
+	}
+	info := &audioInfo{}
+	byteRate := 0
+	offset := int64(12)
+	header := make([]byte, 8)
+	for {
+		if _, err := io.ReadFull(r, header); err != nil {
+			return nil, err
+		}
+		chunkSize := int64(binary.LittleEndian.Uint32(header[4:]))
+		offset += 8
+		switch string(header[:4]) {
+		case "fmt ":
+			fmtChunk := make([]byte, 16)
+			if chunkSize < 16 {
+				return nil, fmt.Errorf("invalid wav fmt chunk")
+			}
+			if _, err := io.ReadFull(r, fmtChunk); err != nil {
+				return nil, err
+			}
+			info.Codec = wavCodec(binary.LittleEndian.Uint16(fmtChunk))
+			info.Channels = int(binary.LittleEndian.Uint16(fmtChunk[2:]))
+			info.SampleRate = int(binary.LittleEndian.Uint32(fmtChunk[4:]))
+			byteRate = int(binary.LittleEndian.Uint32(fmtChunk[8:]))
+			info.Bitrate = byteRate * 8
+			if _, err := r.Seek(offset+chunkSize+chunkSize%2, io.SeekStart); err != nil {
+				return nil, err
+			}
+		case "data":
+			if info.Codec == "" {
+				return nil, fmt.Errorf("wav data chunk precedes fmt chunk")
+			}
+			// Streaming writers leave size unset
+			if chunkSize == 0 || chunkSize == 0xFFFFFFFF || offset+chunkSize > size {
+				chunkSize = size - offset
+			}
+			if byteRate > 0 {
+				info.Duration = float64(chunkSize) / float64(byteRate)
+			}
+			return info, nil
+		default:
+			if _, err := r.Seek(offset+chunkSize+chunkSize%2, io.SeekStart); err != nil {
+				return nil, err
+			}
+		}
+		offset += chunkSize + chunkSize%2
+	}
+}
+
+func wavCodec(format uint16) string {
+	switch format {
+	case 0x0001, 0xFFFE:
+		return "pcm"
+	case 0x0003:
+		return "pcm_float"
+	case 0x0006:
+		return "alaw"
+	case 0x0007:
+		return "mulaw"
+	case 0x0055:
+		return "mp3"
+	default:
+		return fmt.Sprintf("wav_0x%04x", format)
+	}
+}
+
+// Parse FLAC stream starting with "fLaC" marker; size is length of the stream
+func probeFlac(r io.Reader, size int64) (*audioInfo, error) {
+	header := make([]byte, 8)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+	// STREAMINFO is mandatory first metadata block
+	if header[4]&0x7F != 0 {
+		return nil, fmt.Errorf("flac stream does not start with STREAMINFO")
+	}
+	streamInfo := make([]byte, 34)
+	if _, err := io.ReadFull(r, streamInfo); err != nil {
+		return nil, err
+	}
+	info := parseFlacStreamInfo(streamInfo)
+	if info.Duration > 0 {
+		info.Bitrate = int(float64(size) * 8 / info.Duration)
+	}
+	return info, nil
+}
+
+func parseFlacStreamInfo(b []byte) *audioInfo {
+	// Sample rate (20 bits), channels - 1 (3 bits), bits per sample - 1 (5 bits), total samples (36 bits)
+	packed := binary.BigEndian.Uint64(b[10:18])
+	info := &audioInfo{
+		Codec:      "flac",
+		SampleRate: int(packed >> 44),
+		Channels:   int(packed>>41&0x7) + 1,
+	}
+	totalSamples := packed & 0xFFFFFFFFF
+	if info.SampleRate > 0 {
+		info.Duration = float64(totalSamples) / float64(info.SampleRate)
+	}
+	return info
+}
+
+type oggPage struct {
+	granule int64
+	serial  uint32
+	// First packet started on the page, possibly truncated
+	data []byte
+}
+
+func readOggPage(r io.Reader) (*oggPage, error) {
+	header := make([]byte, 27)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(header[:4], []byte("OggS")) {
+		return nil, fmt.Errorf("invalid ogg page")
+	}
+	segments := make([]byte, header[26])
+	if _, err := io.ReadFull(r, segments); err != nil {
+		return nil, err
+	}
+	size := 0
+	for _, s := range segments {
+		size += int(s)
+	}
+	data := make([]byte, size)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil, err
+	}
+	return &oggPage{
+		granule: int64(binary.LittleEndian.Uint64(header[6:])),
+		serial:  binary.LittleEndian.Uint32(header[14:]),
+		data:    data,
+	}, nil
+}
+
+func probeOgg(r io.ReadSeeker, size int64) (*audioInfo, error) {
+	first, err := readOggPage(r)
+	if err != nil {
+		return nil, err
+	}
+	info := &audioInfo{}
+	granuleRate := 0
+	preSkip := 0
+	packet := first.data
+	switch {
+	case len(packet) >= 30 && bytes.Equal(packet[:7], []byte("\x01vorbis")):
+		info.Codec = "vorbis"
+		info.Channels = int(packet[11])
+		info.SampleRate = int(binary.LittleEndian.Uint32(packet[12:]))
+		granuleRate = info.SampleRate
+	case len(packet) >= 19 && bytes.Equal(packet[:8], []byte("OpusHead")):
+		info.Codec = "opus"
+		info.Channels = int(packet[9])
+		preSkip = int(binary.LittleEndian.Uint16(packet[10:]))
+		info.SampleRate = int(binary.LittleEndian.Uint32(packet[12:]))
+		// Opus granule position always counts 48 kHz samples
+		granuleRate = 48000
+		if info.SampleRate == 0 {
+			info.SampleRate = granuleRate
+		}
+	case len(packet) >= 51 && bytes.Equal(packet[:5], []byte("\x7fFLAC")) && bytes.Equal(packet[9:13], []byte("fLaC")):
+		info = parseFlacStreamInfo(packet[17:51])
+		granuleRate = info.SampleRate
+	default:
+		return nil, errUnknownAudioFormat
+	}
+	if granuleRate == 0 {
+		return nil, fmt.Errorf("invalid %s header", info.Codec)
+	}
+	granule, err := lastOggGranule(r, size, first.serial)
+	if err != nil {
+		return nil, err
+	}
+	if granule > int64(preSkip) {
+		info.Duration = float64(granule-int64(preSkip)) / float64(granuleRate)
+		info.Bitrate = int(float64(size) * 8 / info.Duration)
+	}
+	return info, nil
+}
+
+// Granule position of the last page of logical stream, which is number of samples in the stream
+func lastOggGranule(r io.ReadSeeker, size int64, serial uint32) (int64, error) {
+	start := size - oggLastPageSearchLimit
+	if start < 0 {
+		start = 0
+	}
+	if _, err := r.Seek(start, io.SeekStart); err != nil {
+		return 0, err
+	}
+	tail, err := ioutil.ReadAll(r)
+	if err != nil {
+		return 0, err
+	}
+	for i := bytes.LastIndex(tail, []byte("OggS")); i >= 0; i = bytes.LastIndex(tail[:i], []byte("OggS")) {
+		header := tail[i:]
+		if len(header) < 27 {
+			continue
+		}
+		granule := int64(binary.LittleEndian.Uint64(header[6:]))
+		// Granule of -1 marks page without finished packets
+		if binary.LittleEndian.Uint32(header[14:]) == serial && granule != -1 {
+			return granule, nil
+		}
+	}
+	return 0, fmt.Errorf("no final ogg page found")
+}
+
+var (
+	mpegBitrates = map[[2]int][16]int{
+		// {version, layer}: kbit/s by index; version 1 is MPEG-1, 2 is MPEG-2 and MPEG-2.5
+		{1, 1}: {0, 32, 64, 96, 128, 160, 192, 224, 256, 288, 320, 352, 384, 416, 448},
+		{1, 2}: {0, 32, 48, 56, 64, 80, 96, 112, 128, 160, 192, 224, 256, 320, 384},
+		{1, 3}: {0, 32, 40, 48, 56, 64, 80, 96, 112, 128, 160, 192, 224, 256, 320},
+		{2, 1}: {0, 32, 48, 56, 64, 80, 96, 112, 128, 144, 160, 176, 192, 224, 256},
+		{2, 2}: {0, 8, 16, 24, 32, 40, 48, 56, 64, 80, 96, 112, 128, 144, 160},
+		{2, 3}: {0, 8, 16, 24, 32, 40, 48, 56, 64, 80, 96, 112, 128, 144, 160},
+	}
+	mpegSampleRates = map[int][3]int{
+		// Keyed by version bits: 3 is MPEG-1, 2 is MPEG-2, 0 is MPEG-2.5
+		3: {44100, 48000, 32000},
+		2: {22050, 24000, 16000},
+		0: {11025, 12000, 8000},
+	}
+)
+
+type mpegFrame struct {
+	versionBits int
+	layer       int
+	bitrate     int
+	sampleRate  int
+	channels    int
+	size        int
+}
+
+func parseMpegFrameHeader(h []byte) (*mpegFrame, bool) {
+	if h[0] != 0xFF || h[1]&0xE0 != 0xE0 {
+		return nil, false
+	}
+	f := &mpegFrame{versionBits: int(h[1] >> 3 & 0x3), layer: 4 - int(h[1]>>1&0x3)}
+	bitrateIdx, sampleRateIdx := int(h[2]>>4), int(h[2]>>2&0x3)
+	if f.versionBits == 1 || f.layer == 4 || bitrateIdx == 0 || bitrateIdx == 15 || sampleRateIdx == 3 {
+		return nil, false
+	}
+	version := 2
+	if f.versionBits == 3 {
+		version = 1
+	}
+	f.bitrate = mpegBitrates[[2]int{version, f.layer}][bitrateIdx] * 1000
+	f.sampleRate = mpegSampleRates[f.versionBits][sampleRateIdx]
+	f.channels = 2
+	if h[3]>>6 == 3 {
+		f.channels = 1
+	}
+	padding := int(h[2] >> 1 & 0x1)
+	if f.layer == 1 {
+		f.size = (12*f.bitrate/f.sampleRate + padding) * 4
+	} else {
+		f.size = f.samples()/8*f.bitrate/f.sampleRate + padding
+	}
+	return f, true
+}
+
+func (f *mpegFrame) samples() int {
+	switch {
+	case f.layer == 1:
+		return 384
+	case f.layer == 3 && f.versionBits != 3:
+		return 576
+	default:
+		return 1152
+	}
+}
+
+// Parse MPEG audio stream. Duration is taken from Xing/Info or VBRI header of the first frame if
+// present, otherwise stream is assumed to have constant bitrate.
+func probeMpeg(r io.ReadSeeker, start, size int64) (*audioInfo, error) {
+	buf := make([]byte, mp3SyncSearchLimit)
+	n, err := io.ReadFull(r, buf)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return nil, err
+	}
+	buf = buf[:n]
+	for i := 0; i+4 <= len(buf); i++ {
+		frame, ok := parseMpegFrameHeader(buf[i:])
+		if !ok {
+			continue
+		}
+		// Require the next frame to follow, so that random bytes are not taken for a frame
+		next := i + frame.size
+		if next+4 <= len(buf) {
+			if _, ok := parseMpegFrameHeader(buf[next:]); !ok {
+				continue
+			}
+		} else if int64(next) < size-start {
+			continue
+		}
+		audioSize := size - start - int64(i)
+		if hasId3v1(r, size) {
+			audioSize -= 128
+		}
+		return mpegInfo(frame, buf[i:], audioSize), nil
+	}
+	return nil, errUnknownAudioFormat
+}
+
+// Check for ID3v1 tag occupying the last 128 bytes of MP3 file
+func hasId3v1(r io.ReadSeeker, size int64) bool {
+	if size < 128 {
+		return false
+	}
+	if _, err := r.Seek(size-128, io.SeekStart); err != nil {
+		return false
+	}
+	tag := make([]byte, 3)
+	_, err := io.ReadFull(r, tag)
+	return err == nil && bytes.Equal(tag, []byte("TAG"))
+}
+
+func mpegInfo(frame *mpegFrame, data []byte, audioSize int64) *audioInfo {
+	codec := "mp3"
+	if frame.layer != 3 {
+		codec = fmt.Sprintf("mp%d", frame.layer)
+	}
+	info := &audioInfo{Codec: codec, SampleRate: frame.sampleRate, Channels: frame.channels, Bitrate: frame.bitrate}
+	frames, bytesCount := mpegVbrHeader(frame, data)
+	if frames > 0 {
+		info.Duration = float64(frames) * float64(frame.samples()) / float64(frame.sampleRate)
+		if bytesCount <= 0 {
+			bytesCount = audioSize
+		}
+		info.Bitrate = int(float64(bytesCount) * 8 / info.Duration)
+		return info
+	}
+	info.Duration = float64(audioSize) * 8 / float64(frame.bitrate)
+	return info
+}
+
+// Number of frames and bytes from Xing/Info or VBRI header, zeros if there is no such header
+func mpegVbrHeader(frame *mpegFrame, data []byte) (frames int64, size int64) {
+	sideInfo := 17
+	switch {
+	case frame.versionBits == 3 && frame.channels == 2:
+		sideInfo = 32
+	case frame.versionBits != 3 && frame.channels == 1:
+		sideInfo = 9
+	}
+	if len(data) >= 4+sideInfo+16 && (bytes.Equal(data[4+sideInfo:8+sideInfo], []byte("Xing")) ||
+		bytes.Equal(data[4+sideInfo:8+sideInfo], []byte("Info"))) {
+		xing := data[4+sideInfo:]
+		flags := binary.BigEndian.Uint32(xing[4:])
+		fields := xing[8:]
+		if flags&0x1 != 0 {
+			frames = int64(binary.BigEndian.Uint32(fields))
+			fields = fields[4:]
+		}
+		if flags&0x2 != 0 && len(fields) >= 4 {
+			size = int64(binary.BigEndian.Uint32(fields))
+		}
+		return frames, size
+	}
+	if len(data) >= 36+18 && bytes.Equal(data[36:40], []byte("VBRI")) {
+		vbri := data[36:]
+		return int64(binary.BigEndian.Uint32(vbri[14:])), int64(binary.BigEndian.Uint32(vbri[10:]))
+	}
+	return 0, 0
+}
@@ -1,11 +1,17 @@
 package main
 
 import (
+	"context"
 	"flag"
 	_ "github.com/lib/pq"
+	_ "github.com/mattn/go-sqlite3"
+	"io"
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
 )
 
 var (
@@ -18,8 +24,21 @@ func init() {
 	logI = log.New(os.Stderr, "[I] ", 0)
 }
 
+// Drop informational messages at error level
+func setLogLevel(level string) {
+	if level == logLevelError {
+		logI.SetOutput(io.Discard)
+	} else {
+		logI.SetOutput(os.Stderr)
+	}
+}
+
 func main() {
 	logI.Println("started :)")
+	// Subscribed before anything else, since SIGHUP kills the process until then; signals received
+	// during startup are handled once config reloads are started
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
 
 	confPath := flag.String("config", "audyos.conf", "path to configuration file")
 	flag.Parse()
@@ -31,21 +50,97 @@ func main() {
 	if err != nil {
 		logE.Fatalf("read config: %v", err)
 	}
+	setLogLevel(conf.LogLevel)
+
+	store, err := newStore(conf)
+	if err != nil {
+		logE.Fatalf("init store: %v", err)
+	}
+	defer store.Close()
 
-	db, err := initDB(conf)
+	// Memory store starts empty each time, so only databases have schema to migrate
+	dbStore, hasSchema := store.(*sqlStore)
+	if flag.Arg(0) == "migrate" {
+		if !hasSchema {
+			logE.Fatalf("migrate: %s database has no schema", conf.Database)
+		}
+		if err := runMigrateCommand(context.Background(), dbStore.db, flag.Args()[1:]); err != nil {
+			logE.Fatalf("migrate: %v", err)
+		}
+		return
+	}
+	if conf.AutoMigrate && hasSchema {
+		m, err := newMigrator(dbStore.db)
+		if err != nil {
+			logE.Fatalf("init migrations: %v", err)
+		}
+		applied, err := m.up(context.Background())
+		if err != nil {
+			logE.Fatalf("apply migrations: %v", err)
+		}
+		for _, mig := range applied {
+			logI.Printf("applied migration %s", mig)
+		}
+	}
+
+	api, err := NewApi(store, conf)
 	if err != nil {
-		logE.Fatalf("init db: %v", err)
+		logE.Fatalf("init api: %v", err)
+	}
+
+	switch flag.Arg(0) {
+	case "":
+	case "migrate-content":
+		// Move contents stored in 'records' table by older versions to blob store
+		moved, err := migrateInlineContent(store, api.blobs, 100)
+		if err != nil {
+			logE.Fatalf("migrate content: %v (moved content of %d records)", err, moved)
+		}
+		logI.Printf("moved content of %d records to blob store", moved)
+		return
+	default:
+		logE.Fatalf("unknown command %q", flag.Arg(0))
+	}
+	if err := api.revocations.sync(conf.accessTokenTTL()); err != nil {
+		logE.Fatalf("load token revocations: %v", err)
 	}
-	defer db.Close()
+	go api.revocations.syncPeriodically(time.Minute, conf.accessTokenTTL())
+	go api.purgeExpiredUploadsPeriodically(time.Hour)
+	go api.reloadConfigOnHangup(hangup, *confPath)
 
-	api := NewApi(db, conf)
+	http.Handle("/.well-known/jwks.json", api.Handler(api.HandleJwks))
 	http.Handle("/v1/users/register", api.Handler(api.HandleRegistration))
 	http.Handle("/v1/users/auth", api.Handler(api.HandleAuthorization))
+	http.Handle("/v1/users/refresh", api.Handler(api.HandleRefresh))
+	http.Handle("/v1/users/logout", api.HandlerWithAuth(api.HandleLogout))
+	http.Handle("/v1/users/logout_all", api.HandlerWithAuth(api.HandleLogoutAll))
 	http.Handle("/v1/users/sharers", api.HandlerWithAuth(api.HandleSharersList))
+	http.Handle("/v1/users/sharers/", api.HandlerWithAuth(api.HandleSharerRecords))
+	http.Handle("/v1/users/settings", api.HandlerWithAuth(api.HandleUserSettings))
+	http.Handle("/v1/users/block", api.HandlerWithAuth(api.HandleBlockUser))
+	http.Handle("/v1/users/unblock", api.HandlerWithAuth(api.HandleUnblockUser))
+	http.Handle("/v1/users/blocked", api.HandlerWithAuth(api.HandleBlockedUsers))
+	http.Handle("/v1/users/lookup", api.HandlerWithAuth(api.HandleUserLookup))
+	http.Handle("/v1/users/email/confirmation", api.HandlerWithAuth(api.HandleEmailConfirmation))
+	http.Handle("/v1/users/email/confirm", api.Handler(api.HandleConfirmEmail))
+	http.Handle("/v1/users/recipients", api.HandlerWithAuth(api.HandleRecipientsList))
+	http.Handle("/v1/groups", api.HandlerWithAuth(api.HandleGroupsList))
+	http.Handle("/v1/groups/new", api.HandlerWithAuth(api.HandleNewGroup))
+	http.Handle("/v1/groups/", api.HandlerWithAuth(api.HandleGroup))
 	http.Handle("/v1/records/new", api.HandlerWithAuth(api.HandleNewRecord))
+	http.Handle("/v1/records/upload", api.HandlerWithAuth(api.HandleUploadRecord))
 	http.Handle("/v1/records/share", api.HandlerWithAuth(api.HandleShareRecord))
 	http.Handle("/v1/records/unshare", api.HandlerWithAuth(api.HandleUnshareRecord))
+	http.Handle("/v1/shares/incoming", api.HandlerWithAuth(api.HandleIncomingShares))
+	http.Handle("/v1/shares/accept", api.HandlerWithAuth(api.HandleAcceptShare))
+	http.Handle("/v1/shares/decline", api.HandlerWithAuth(api.HandleDeclineShare))
 	http.Handle("/v1/records", api.HandlerWithAuth(api.HandleRecordsList))
+	http.Handle("/v1/records/", api.HandlerWithAuth(api.HandleRecord))
+	http.Handle("/v1/links/", api.Handler(api.HandleLink))
+	http.Handle("/v1/search", api.HandlerWithAuth(api.HandleSearch))
+	http.Handle("/v1/uploads", api.UploadsHandler())
+	http.Handle("/v1/uploads/", api.UploadsHandler())
+	http.Handle("/v1/admin/config", api.HandlerWithAuth(api.HandleAdminConfig))
 
 	if err := http.ListenAndServe(conf.Listen, nil); err != nil {
 		logE.Fatalf("listen and serve: %v", err)
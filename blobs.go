@@ -0,0 +1,212 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	storageFs = "fs"
+	storageS3 = "s3"
+	// Directory of fs storage relative to working directory unless storage_dir is set
+	defaultStorageDir = "records"
+)
+
+// Storage of record contents. Blobs are immutable: content is written once under a fresh key and
+// removed along with the record.
+type BlobStore interface {
+	// Store content under key, returning its size and hex encoded sha256
+	Put(ctx context.Context, key string, r io.Reader) (size int64, checksum string, err error)
+	// Open content for reading; readers are seekable so that content can be served by ranges
+	Open(ctx context.Context, key string) (BlobReader, error)
+	// Remove content; removing missing key is not an error
+	Delete(ctx context.Context, key string) error
+}
+
+type BlobReader interface {
+	io.ReadSeeker
+	io.Closer
+}
+
+func newBlobStore(conf *config) (BlobStore, error) {
+	switch conf.Storage {
+	case "", storageFs:
+		return newFsBlobStore(conf.storageDir())
+	case storageS3:
+		return newS3BlobStore(conf)
+	default:
+		return nil, fmt.Errorf("unknown storage %q", conf.Storage)
+	}
+}
+
+// Generate key for new record content
+func newBlobKey() (string, error) {
+	id, err := randomToken(16)
+	if err != nil {
+		return "", fmt.Errorf("generate blob key: %v", err)
+	}
+	return "records/" + id, nil
+}
+
+// Blobs stored as files in local directory
+type fsBlobStore struct {
+	dir string
+}
+
+func newFsBlobStore(dir string) (*fsBlobStore, error) {
+	if err := os.MkdirAll(dir, 0750); err != nil {
+		return nil, fmt.Errorf("create storage dir: %v", err)
+	}
+	return &fsBlobStore{dir}, nil
+}
+
+func (s *fsBlobStore) path(key string) (string, error) {
+	if key == "" || strings.Contains(key, "..") || strings.HasPrefix(key, "/") {
+		return "", fmt.Errorf("invalid blob key %q", key)
+	}
+	return filepath.Join(s.dir, filepath.FromSlash(key)), nil
+}
+
+// Content is written to temporary file first, so that readers never see partially written blobs
+func (s *fsBlobStore) Put(ctx context.Context, key string, r io.Reader) (int64, string, error) {
+	path, err := s.path(key)
+	if err != nil {
+		return 0, "", err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0750); err != nil {
+		return 0, "", fmt.Errorf("create blob dir: %v", err)
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(path), ".upload-")
+	if err != nil {
+		return 0, "", fmt.Errorf("create temp file: %v", err)
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+	hash := sha256.New()
+	size, err := io.Copy(io.MultiWriter(tmp, hash), r)
+	if err != nil {
+		return 0, "", err
+	}
+	if err := tmp.Close(); err != nil {
+		return 0, "", fmt.Errorf("close temp file: %v", err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return 0, "", fmt.Errorf("move blob into place: %v", err)
+	}
+	return size, hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+func (s *fsBlobStore) Open(ctx context.Context, key string) (BlobReader, error) {
+	path, err := s.path(key)
+	if err != nil {
+		return nil, err
+	}
+	return os.Open(path)
+}
+
+func (s *fsBlobStore) Delete(ctx context.Context, key string) error {
+	path, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// Reader failing with errContentTooLarge once more than limit bytes are read. Errors of the
+// underlying reader are kept in readErr, so that they can be told apart from storage errors.
+type limitedReader struct {
+	r         io.Reader
+	remaining int64
+	readErr   error
+}
+
+func (l *limitedReader) Read(p []byte) (int, error) {
+	if l.remaining < 0 {
+		return 0, errContentTooLarge
+	}
+	if int64(len(p)) > l.remaining+1 {
+		p = p[:l.remaining+1]
+	}
+	n, err := l.r.Read(p)
+	l.remaining -= int64(n)
+	if l.remaining < 0 {
+		return n, errContentTooLarge
+	}
+	var maxBytesErr *http.MaxBytesError
+	if errors.As(err, &maxBytesErr) {
+		return n, errContentTooLarge
+	}
+	if err != nil && err != io.EOF {
+		l.readErr = err
+	}
+	return n, err
+}
+
+// Move contents stored inline in 'records' table to blob store. Safe to run while service is
+// working and to restart after failure: rows are updated only if they still hold inline content.
+func migrateInlineContent(store Store, blobs BlobStore, batchSize int) (int, error) {
+	ctx := context.Background()
+	moved := 0
+	lastId := int64(0)
+	for {
+		ids, err := store.SelectInlineContentRecords(lastId, batchSize)
+		if err != nil {
+			return moved, fmt.Errorf("select records with inline content: %v", err)
+		}
+		if len(ids) == 0 {
+			return moved, nil
+		}
+		for _, id := range ids {
+			ok, err := moveRecordContent(ctx, store, blobs, id)
+			if err != nil {
+				return moved, fmt.Errorf("move content of record %d: %v", id, err)
+			}
+			if ok {
+				moved++
+			}
+			lastId = id
+		}
+	}
+}
+
+func moveRecordContent(ctx context.Context, store Store, blobs BlobStore, recordId int64) (bool, error) {
+	content, err := store.SelectInlineContent(recordId)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("select content: %v", err)
+	}
+	key, err := newBlobKey()
+	if err != nil {
+		return false, err
+	}
+	size, checksum, err := blobs.Put(ctx, key, bytes.NewReader(content))
+	if err != nil {
+		return false, fmt.Errorf("put blob: %v", err)
+	}
+	updated, err := store.UpdateRecordStorage(recordId, key, size, checksum)
+	if err != nil || !updated {
+		if delErr := blobs.Delete(ctx, key); delErr != nil {
+			logE.Printf("delete orphaned blob %q: %v", key, delErr)
+		}
+	}
+	if err != nil {
+		return false, fmt.Errorf("update record: %v", err)
+	}
+	return updated, nil
+}
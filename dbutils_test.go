@@ -0,0 +1,333 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Store with direct access to its tables, so that tests can prepare and check state bypassing
+// the api. Tables and columns are named as in Postgres whatever the store is.
+type tableStore interface {
+	Store
+	// Insert row with given columns, the rest ones get their defaults
+	insertRow(table string, values map[string]interface{}) error
+	selectRows(table string) ([]map[string]interface{}, error)
+	// Set columns of rows with given value of key column
+	updateRows(table string, values map[string]interface{}, keyColumn string, key interface{}) error
+	// Delete all rows restarting id sequences
+	clear() error
+}
+
+// Names of tables created by migrations
+var storeTables = []string{"users", "records", "shared", "refresh_tokens", "revoked_tokens",
+	"user_token_revocations", "uploads", "record_tags", "share_links", "invitations", "blocked_users", "user_groups",
+	"group_members", "group_shares"}
+
+// Columns of values sorted by name
+func sortedColumns(values map[string]interface{}) []string {
+	columns := make([]string, 0, len(values))
+	for column := range values {
+		columns = append(columns, column)
+	}
+	sort.Strings(columns)
+	return columns
+}
+
+func (s *sqlStore) insertRow(table string, values map[string]interface{}) error {
+	q := &queryArgs{}
+	columns := sortedColumns(values)
+	placeholders := make([]string, len(columns))
+	for i, column := range columns {
+		placeholders[i] = q.add(values[column])
+		columns[i] = `"` + column + `"`
+	}
+	_, err := s.db.Exec(fmt.Sprintf("INSERT INTO %s(%s) VALUES(%s);", table, strings.Join(columns, ","),
+		strings.Join(placeholders, ",")), q.args...)
+	return err
+}
+
+func (s *sqlStore) selectRows(table string) ([]map[string]interface{}, error) {
+	res := []map[string]interface{}{}
+	rows, err := s.db.Query(fmt.Sprintf("SELECT * FROM %s", table))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	cols, err := rows.Columns()
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		columns := make([]interface{}, len(cols))
+		columnPtrs := make([]interface{}, len(cols))
+		for i := range columns {
+			columnPtrs[i] = &columns[i]
+		}
+		if err := rows.Scan(columnPtrs...); err != nil {
+			return nil, err
+		}
+		m := make(map[string]interface{})
+		for i, colName := range cols {
+			m[colName] = columns[i]
+		}
+		res = append(res, m)
+	}
+	return res, rows.Err()
+}
+
+func (s *sqlStore) updateRows(table string, values map[string]interface{}, keyColumn string, key interface{}) error {
+	q := &queryArgs{}
+	var set []string
+	for _, column := range sortedColumns(values) {
+		set = append(set, `"`+column+`"=`+q.add(values[column]))
+	}
+	_, err := s.db.Exec(fmt.Sprintf(`UPDATE %s SET %s WHERE "%s"=%s;`, table, strings.Join(set, ", "), keyColumn,
+		q.add(key)), q.args...)
+	return err
+}
+
+func (s *sqlStore) clear() error {
+	if s.db.database == databaseSQLite {
+		for _, table := range append(storeTables, "sqlite_sequence") {
+			if _, err := s.db.Exec("DELETE FROM " + table + ";"); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	_, err := s.db.Exec("TRUNCATE " + strings.Join(storeTables, ", ") + " RESTART IDENTITY;")
+	return err
+}
+
+func insertUser(db tableStore, login string, pass string, name string) error {
+	return db.insertRow("users", map[string]interface{}{"login": login, "password": pass, "name": name})
+}
+
+func insertRecord(db tableStore, name string, content string, ownerId int64) error {
+	return db.insertRow("records", map[string]interface{}{"name": name, "content": []byte(content),
+		"owner_id": ownerId, "size": len(content)})
+}
+
+func insertSharing(db tableStore, recordId int64, userId int64) error {
+	return db.insertRow("shared", map[string]interface{}{"record_id": recordId, "to": userId})
+}
+
+func selectAll(db tableStore, tableName string, t *testing.T) []map[string]interface{} {
+	res, err := db.selectRows(tableName)
+	if err != nil {
+		t.Fatalf("select rows from %s: %v", tableName, err)
+	}
+	return res
+}
+
+// Select the only row of table with given value of column
+func selectOne(db tableStore, tableName string, column string, value interface{}, t *testing.T) map[string]interface{} {
+	var found []map[string]interface{}
+	for _, row := range selectAll(db, tableName, t) {
+		if reflect.DeepEqual(row[column], value) {
+			found = append(found, row)
+		}
+	}
+	if len(found) != 1 {
+		t.Fatalf("expected one row of %s with %s=%v; got: %v", tableName, column, value, found)
+	}
+	return found[0]
+}
+
+// Tables by their names in Postgres, as pointers to slices of rows
+func (s *memStore) tables() map[string]interface{} {
+	return map[string]interface{}{
+		"users":                  &s.users,
+		"records":                &s.records,
+		"shared":                 &s.shared,
+		"refresh_tokens":         &s.refreshTokens,
+		"revoked_tokens":         &s.revokedTokens,
+		"user_token_revocations": &s.userRevocations,
+		"uploads":                &s.uploads,
+		"record_tags":            &s.recordTags,
+		"share_links":            &s.shareLinks,
+		"invitations":            &s.invitations,
+		"blocked_users":          &s.blockedUsers,
+		"user_groups":            &s.groups,
+		"group_members":          &s.groupMembers,
+		"group_shares":           &s.groupShares,
+	}
+}
+
+func (s *memStore) table(name string) (reflect.Value, error) {
+	table, ok := s.tables()[name]
+	if !ok {
+		return reflect.Value{}, fmt.Errorf("no such table %q", name)
+	}
+	return reflect.ValueOf(table).Elem(), nil
+}
+
+// Row with column defaults of migrations
+func (s *memStore) newRow(table string) interface{} {
+	now := time.Now()
+	switch table {
+	case "users":
+		return &memUser{Id: s.nextId(table), AutoAcceptShares: true}
+	case "records":
+		return &memRecord{Id: s.nextId(table), CreatedAt: now, ContentType: "application/octet-stream"}
+	case "shared":
+		return &memSharing{Permission: permDownload.String(), Status: shareAccepted}
+	case "refresh_tokens":
+		return &memRefreshToken{Id: s.nextId(table)}
+	case "user_groups":
+		return &memGroup{Id: s.nextId(table)}
+	case "group_members":
+		return &memGroupMember{Status: shareAccepted}
+	case "share_links":
+		return &memShareLink{CreatedAt: now}
+	}
+	return reflect.New(reflect.TypeOf(s.tables()[table]).Elem().Elem().Elem()).Interface()
+}
+
+// Set field of row to column value as database driver would convert it
+func setColumn(field reflect.Value, v interface{}) error {
+	if v == nil {
+		field.Set(reflect.Zero(field.Type()))
+		return nil
+	}
+	value := reflect.ValueOf(v)
+	switch v := v.(type) {
+	case string:
+		switch field.Type() {
+		case reflect.TypeOf([]byte{}):
+			value = reflect.ValueOf([]byte(v))
+		case reflect.TypeOf(time.Time{}):
+			t, err := time.Parse(time.RFC3339Nano, v)
+			if err != nil {
+				return err
+			}
+			value = reflect.ValueOf(t)
+		}
+	case int:
+		value = reflect.ValueOf(int64(v))
+	}
+	target := field.Type()
+	if target.Kind() == reflect.Ptr {
+		target = target.Elem()
+	}
+	if !value.Type().ConvertibleTo(target) {
+		return fmt.Errorf("can not set %s column to %T", field.Type(), v)
+	}
+	value = value.Convert(target)
+	if field.Kind() == reflect.Ptr {
+		ptr := reflect.New(target)
+		ptr.Elem().Set(value)
+		value = ptr
+	}
+	field.Set(value)
+	return nil
+}
+
+// Apply values keyed by column names to row
+func setColumns(row reflect.Value, values map[string]interface{}) error {
+	for column, v := range values {
+		found := false
+		for i := 0; i < row.NumField(); i++ {
+			if row.Type().Field(i).Tag.Get("db") == column {
+				if err := setColumn(row.Field(i), v); err != nil {
+					return fmt.Errorf("column %s: %v", column, err)
+				}
+				found = true
+			}
+		}
+		if !found {
+			return fmt.Errorf("no such column %q", column)
+		}
+	}
+	return nil
+}
+
+func (s *memStore) insertRow(table string, values map[string]interface{}) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	rows, err := s.table(table)
+	if err != nil {
+		return err
+	}
+	row := reflect.ValueOf(s.newRow(table))
+	if err := setColumns(row.Elem(), values); err != nil {
+		return err
+	}
+	rows.Set(reflect.Append(rows, row))
+	return nil
+}
+
+func (s *memStore) selectRows(table string) ([]map[string]interface{}, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	rows, err := s.table(table)
+	if err != nil {
+		return nil, err
+	}
+	res := []map[string]interface{}{}
+	for i := 0; i < rows.Len(); i++ {
+		row := rows.Index(i).Elem()
+		m := make(map[string]interface{})
+		for j := 0; j < row.NumField(); j++ {
+			field := row.Field(j)
+			var v interface{}
+			switch {
+			case field.Kind() == reflect.Ptr && field.IsNil():
+			case field.Kind() == reflect.Ptr:
+				v = field.Elem().Interface()
+			case field.Kind() == reflect.Slice && field.IsNil():
+			case field.Kind() == reflect.Slice:
+				v = append([]byte{}, field.Bytes()...)
+			default:
+				v = field.Interface()
+			}
+			m[row.Type().Field(j).Tag.Get("db")] = v
+		}
+		res = append(res, m)
+	}
+	return res, nil
+}
+
+func (s *memStore) updateRows(table string, values map[string]interface{}, keyColumn string, key interface{}) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	rows, err := s.table(table)
+	if err != nil {
+		return err
+	}
+	for i := 0; i < rows.Len(); i++ {
+		row := rows.Index(i).Elem()
+		matched := false
+		for j := 0; j < row.NumField(); j++ {
+			if row.Type().Field(j).Tag.Get("db") != keyColumn {
+				continue
+			}
+			field := reflect.New(row.Field(j).Type()).Elem()
+			if err := setColumn(field, key); err != nil {
+				return fmt.Errorf("column %s: %v", keyColumn, err)
+			}
+			matched = reflect.DeepEqual(field.Interface(), row.Field(j).Interface())
+		}
+		if matched {
+			if err := setColumns(row, values); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (s *memStore) clear() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, table := range s.tables() {
+		rows := reflect.ValueOf(table).Elem()
+		rows.Set(reflect.Zero(rows.Type()))
+	}
+	s.lastIds = make(map[string]int64)
+	return nil
+}
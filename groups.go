@@ -0,0 +1,395 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Roles of group members: owners manage the group and its members, members only get access to
+// records shared to the group
+const (
+	groupRoleOwner  = "owner"
+	groupRoleMember = "member"
+)
+
+const maxGroupNameLength = 128
+
+var errLastGroupOwner = errors.New("group must have at least one owner")
+
+type groupInfo struct {
+	Id        int64     `json:"id"`
+	Name      string    `json:"name"`
+	CreatedAt time.Time `json:"created_at"`
+	// Role of user the group is selected for and whether the user has accepted membership: pending
+	// or accepted
+	Role    string        `json:"role"`
+	Status  string        `json:"status"`
+	Members []groupMember `json:"members,omitempty"`
+}
+
+type groupMember struct {
+	Id     int64  `json:"id"`
+	Login  string `json:"login"`
+	Name   string `json:"name"`
+	Role   string `json:"role"`
+	Status string `json:"status"`
+}
+
+func parseGroupName(name string) (string, error) {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return "", fmt.Errorf("group name is not set")
+	}
+	if len(name) > maxGroupNameLength {
+		return "", fmt.Errorf("group name is longer than %d bytes", maxGroupNameLength)
+	}
+	return name, nil
+}
+
+func parseGroupRole(role string) (string, error) {
+	switch role {
+	case "":
+		return groupRoleMember, nil
+	case groupRoleOwner, groupRoleMember:
+		return role, nil
+	}
+	return "", fmt.Errorf("invalid role %q: expected owner or member", role)
+}
+
+// Share record to group user is member of
+func (a *Api) shareRecordToGroup(w http.ResponseWriter, userId int64, rec *recordInfo, groupId int64,
+	perm permission) {
+	if _, err := a.store.SelectGroup(groupId, userId); err == sql.ErrNoRows {
+		replyWithError(w, http.StatusNotFound, fmt.Errorf("no group %d available to user %d", groupId, userId))
+		return
+	} else if err != nil {
+		err = fmt.Errorf("select group %d: %v", groupId, err)
+		logE.Print(err)
+		replyWithError(w, http.StatusInternalServerError, err)
+		return
+	}
+	err := a.store.UpsertGroupSharing(rec.Id, groupId, userId, perm, rec.Permission == permOwner)
+	if err == errNotSharer {
+		replyWithError(w, http.StatusForbidden, fmt.Errorf("record %d was shared to group %d by another user",
+			rec.Id, groupId))
+		return
+	}
+	if err != nil {
+		err = fmt.Errorf("insert sharing of record %d to group %d: %v", rec.Id, groupId, err)
+		logE.Print(err)
+		replyWithError(w, http.StatusInternalServerError, err)
+		return
+	}
+}
+
+// List groups user is member of
+// Note: needs auth
+func (a *Api) HandleGroupsList(w http.ResponseWriter, r *http.Request, userId int64) {
+	groups, err := a.store.SelectGroups(userId)
+	if err != nil {
+		err = fmt.Errorf("select groups of user %d: %v", userId, err)
+		logE.Print(err)
+		replyWithError(w, http.StatusInternalServerError, err)
+		return
+	}
+	res, err := json.Marshal(struct {
+		Groups []*groupInfo `json:"groups"`
+	}{groups})
+	if err != nil {
+		err = fmt.Errorf("encode groups of user %d: %v", userId, err)
+		logE.Print(err)
+		replyWithError(w, http.StatusInternalServerError, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	fmt.Fprint(w, string(res))
+}
+
+// Create group with user as its owner
+// Note: needs auth
+func (a *Api) HandleNewGroup(w http.ResponseWriter, r *http.Request, userId int64) {
+	defer r.Body.Close()
+	var reqBody struct {
+		Name string `json:"name"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&reqBody); err != nil {
+		err = fmt.Errorf("decode request body: %v", err)
+		logI.Print(err)
+		replyWithError(w, http.StatusBadRequest, err)
+		return
+	}
+	name, err := parseGroupName(reqBody.Name)
+	if err != nil {
+		replyWithError(w, http.StatusBadRequest, err)
+		return
+	}
+	g, err := a.store.InsertGroup(name, userId)
+	if err != nil {
+		err = fmt.Errorf("insert group of user %d: %v", userId, err)
+		logE.Print(err)
+		replyWithError(w, http.StatusInternalServerError, err)
+		return
+	}
+	replyWithGroup(w, http.StatusCreated, g)
+}
+
+func replyWithGroup(w http.ResponseWriter, code int, g *groupInfo) {
+	res, err := json.Marshal(g)
+	if err != nil {
+		err = fmt.Errorf("encode group %d: %v", g.Id, err)
+		logE.Print(err)
+		replyWithError(w, http.StatusInternalServerError, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	fmt.Fprint(w, string(res))
+}
+
+// Parse path of single group resource: /v1/groups/{id}, /v1/groups/{id}/members,
+// /v1/groups/{id}/members/{user_id}, /v1/groups/{id}/accept or /v1/groups/{id}/decline
+func parseGroupPath(path string) (groupId int64, subresource string, err error) {
+	parts := strings.SplitN(strings.TrimPrefix(path, "/v1/groups/"), "/", 2)
+	if groupId, err = strconv.ParseInt(parts[0], 10, 64); err != nil || groupId <= 0 {
+		return 0, "", fmt.Errorf("invalid group id %q", parts[0])
+	}
+	if len(parts) == 2 {
+		subresource = parts[1]
+	}
+	return groupId, subresource, nil
+}
+
+// Get group with its members, rename it with PATCH or delete it with DELETE, manage members with
+// /members subresource, accept or decline membership with /accept and /decline. Groups are
+// available to members who have accepted membership only; only owners can change them.
+// Note: needs auth
+func (a *Api) HandleGroup(w http.ResponseWriter, r *http.Request, userId int64) {
+	groupId, subresource, err := parseGroupPath(r.URL.Path)
+	if err != nil {
+		replyWithError(w, http.StatusNotFound, err)
+		return
+	}
+	if subresource == "accept" || subresource == "decline" {
+		a.handleAnswerGroupMembership(w, r, userId, groupId, subresource == "accept")
+		return
+	}
+	g, err := a.store.SelectGroup(groupId, userId)
+	if err == sql.ErrNoRows {
+		replyWithError(w, http.StatusNotFound, fmt.Errorf("no group %d available to user %d", groupId, userId))
+		return
+	}
+	if err != nil {
+		err = fmt.Errorf("select group %d: %v", groupId, err)
+		logE.Print(err)
+		replyWithError(w, http.StatusInternalServerError, err)
+		return
+	}
+	switch subresource {
+	case "":
+		switch r.Method {
+		case http.MethodGet:
+			if g.Members, err = a.store.SelectGroupMembers(groupId); err != nil {
+				err = fmt.Errorf("select members of group %d: %v", groupId, err)
+				logE.Print(err)
+				replyWithError(w, http.StatusInternalServerError, err)
+				return
+			}
+			replyWithGroup(w, http.StatusOK, g)
+		case http.MethodPatch:
+			if requireGroupOwner(w, g, userId) {
+				a.handleRenameGroup(w, r, g)
+			}
+		case http.MethodDelete:
+			if !requireGroupOwner(w, g, userId) {
+				return
+			}
+			if err := a.store.DeleteGroup(groupId); err != nil {
+				err = fmt.Errorf("delete group %d: %v", groupId, err)
+				logE.Print(err)
+				replyWithError(w, http.StatusInternalServerError, err)
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			replyWithError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s is not allowed", r.Method))
+		}
+	case "members":
+		if r.Method != http.MethodPost {
+			replyWithError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s is not allowed", r.Method))
+			return
+		}
+		if requireGroupOwner(w, g, userId) {
+			a.handleAddGroupMember(w, r, userId, g)
+		}
+	default:
+		member := strings.TrimPrefix(subresource, "members/")
+		memberId, err := strconv.ParseInt(member, 10, 64)
+		if member == subresource || err != nil {
+			replyWithError(w, http.StatusNotFound, fmt.Errorf("unknown group resource %q", subresource))
+			return
+		}
+		if r.Method != http.MethodDelete {
+			replyWithError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s is not allowed", r.Method))
+			return
+		}
+		// Members can leave group on their own
+		if memberId == userId || requireGroupOwner(w, g, userId) {
+			a.handleRemoveGroupMember(w, g, memberId)
+		}
+	}
+}
+
+func requireGroupOwner(w http.ResponseWriter, g *groupInfo, userId int64) bool {
+	if g.Role != groupRoleOwner {
+		replyWithError(w, http.StatusForbidden, fmt.Errorf("user %d is not owner of group %d", userId, g.Id))
+		return false
+	}
+	return true
+}
+
+func (a *Api) handleRenameGroup(w http.ResponseWriter, r *http.Request, g *groupInfo) {
+	defer r.Body.Close()
+	var reqBody struct {
+		Name string `json:"name"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&reqBody); err != nil {
+		err = fmt.Errorf("decode request body: %v", err)
+		logI.Print(err)
+		replyWithError(w, http.StatusBadRequest, err)
+		return
+	}
+	name, err := parseGroupName(reqBody.Name)
+	if err != nil {
+		replyWithError(w, http.StatusBadRequest, err)
+		return
+	}
+	if err := a.store.RenameGroup(g.Id, name); err != nil {
+		err = fmt.Errorf("update group %d: %v", g.Id, err)
+		logE.Print(err)
+		replyWithError(w, http.StatusInternalServerError, err)
+		return
+	}
+	g.Name = name
+	replyWithGroup(w, http.StatusOK, g)
+}
+
+// Accept or decline pending membership of user in group
+func (a *Api) handleAnswerGroupMembership(w http.ResponseWriter, r *http.Request, userId, groupId int64, accept bool) {
+	if r.Method != http.MethodPost {
+		replyWithError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s is not allowed", r.Method))
+		return
+	}
+	answer := a.store.DeclineGroupMembership
+	if accept {
+		answer = a.store.AcceptGroupMembership
+	}
+	ok, err := answer(groupId, userId)
+	if err != nil {
+		err = fmt.Errorf("update membership of user %d in group %d: %v", userId, groupId, err)
+		logE.Print(err)
+		replyWithError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if !ok {
+		replyWithError(w, http.StatusNotFound, fmt.Errorf("no pending membership of user %d in group %d",
+			userId, groupId))
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Add user given by id or by login or email to group, or change role of existing member. User who
+// does not accept sharings automatically has to accept membership first, so that records shared to
+// group are not pushed to them.
+func (a *Api) handleAddGroupMember(w http.ResponseWriter, r *http.Request, userId int64, g *groupInfo) {
+	defer r.Body.Close()
+	var reqBody struct {
+		UserId int64 `json:"user_id"`
+		// Login or email of user
+		To   string `json:"to"`
+		Role string `json:"role"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&reqBody); err != nil {
+		err = fmt.Errorf("decode request body: %v", err)
+		logI.Print(err)
+		replyWithError(w, http.StatusBadRequest, err)
+		return
+	}
+	role, err := parseGroupRole(reqBody.Role)
+	if err != nil {
+		replyWithError(w, http.StatusBadRequest, err)
+		return
+	}
+	if reqBody.UserId == 0 {
+		to := strings.TrimSpace(reqBody.To)
+		if to == "" {
+			replyWithError(w, http.StatusBadRequest, fmt.Errorf("either user_id or to must be set"))
+			return
+		}
+		u, err := a.store.SelectUserByLoginOrEmail(to)
+		if err == sql.ErrNoRows {
+			replyWithError(w, http.StatusNotFound, fmt.Errorf("no user with login or email %q", to))
+			return
+		}
+		if err != nil {
+			err = fmt.Errorf("look up user %q: %v", to, err)
+			logE.Print(err)
+			replyWithError(w, http.StatusInternalServerError, err)
+			return
+		}
+		reqBody.UserId = u.Id
+	}
+	blocked, err := a.store.IsBlocked(reqBody.UserId, userId)
+	if err != nil {
+		err = fmt.Errorf("check whether user %d is blocked: %v", userId, err)
+		logE.Print(err)
+		replyWithError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if blocked {
+		replyWithError(w, http.StatusForbidden, fmt.Errorf("user %d does not accept groups from user %d",
+			reqBody.UserId, userId))
+		return
+	}
+	err = a.store.UpsertGroupMember(g.Id, reqBody.UserId, role)
+	if err == errNoSuchUser {
+		replyWithError(w, http.StatusNotFound, fmt.Errorf("no user %d", reqBody.UserId))
+		return
+	}
+	if err == errLastGroupOwner {
+		replyWithError(w, http.StatusConflict, err)
+		return
+	}
+	if err != nil {
+		err = fmt.Errorf("add user %d to group %d: %v", reqBody.UserId, g.Id, err)
+		logE.Print(err)
+		replyWithError(w, http.StatusInternalServerError, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (a *Api) handleRemoveGroupMember(w http.ResponseWriter, g *groupInfo, memberId int64) {
+	err := a.store.DeleteGroupMember(g.Id, memberId)
+	if err == sql.ErrNoRows {
+		replyWithError(w, http.StatusNotFound, fmt.Errorf("user %d is not member of group %d", memberId, g.Id))
+		return
+	}
+	if err == errLastGroupOwner {
+		replyWithError(w, http.StatusConflict, err)
+		return
+	}
+	if err != nil {
+		err = fmt.Errorf("remove user %d from group %d: %v", memberId, g.Id, err)
+		logE.Print(err)
+		replyWithError(w, http.StatusInternalServerError, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -1,11 +1,15 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"github.com/dgrijalva/jwt-go"
 	"github.com/mitchellh/mapstructure"
+	"math"
 	"net/http"
+	"strings"
+	"time"
 )
 
 type ApiHandler struct {
@@ -20,29 +24,40 @@ type tokenClaims struct {
 	Login  string `mapstructure:"login"`
 	UserId int64  `mapstructure:"user_id"`
 	Exp    int64  `mapstructure:"exp"`
+	// Seconds with microsecond fraction, so that tokens issued right after revocation of all
+	// tokens of user are told from revoked ones
+	Iat float64 `mapstructure:"iat"`
+	Jti string  `mapstructure:"jti"`
+}
+
+func (c *tokenClaims) issuedAt() time.Time {
+	return time.UnixMicro(int64(math.Round(c.Iat * 1e6)))
+}
+
+type tokenClaimsKey struct{}
+
+// Claims of access token the request was authorized with
+func claimsFromRequest(r *http.Request) *tokenClaims {
+	claims, _ := r.Context().Value(tokenClaimsKey{}).(*tokenClaims)
+	return claims
 }
 
 type ApiHandlerWithAuth struct {
 	ApiHandler
-	conf     *config
-	doHandle func(w http.ResponseWriter, r *http.Request, userId int64)
+	live        *liveConfig
+	revocations *revocationStore
+	doHandle    func(w http.ResponseWriter, r *http.Request, userId int64)
 }
 
 // TODO: close all bodies
 func (h *ApiHandlerWithAuth) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	defer r.Body.Close()
-	cookie, err := r.Cookie("access_token")
+	accessToken, err := accessTokenFromRequest(r)
 	if err != nil {
-		err = fmt.Errorf("extract auth cookie: %v", err)
 		replyWithError(w, http.StatusForbidden, err)
 		return
 	}
-	token, err := jwt.Parse(cookie.Value, func(tok *jwt.Token) (interface{}, error) {
-		if _, ok := tok.Method.(*jwt.SigningMethodHMAC); !ok {
-			return nil, fmt.Errorf("unexpected signature method")
-		}
-		return []byte(h.conf.JwtSignKey), nil
-	})
+	token, err := jwt.Parse(accessToken, h.live.load().keys.keyFunc)
 	if err != nil {
 		replyWithError(w, http.StatusForbidden, fmt.Errorf("parse jwt token: %v", err))
 		return
@@ -60,9 +75,33 @@ func (h *ApiHandlerWithAuth) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		replyWithError(w, http.StatusForbidden, err)
 		return
 	}
+	if h.revocations.isRevoked(claims) {
+		replyWithError(w, http.StatusForbidden, fmt.Errorf("token has been revoked"))
+		return
+	}
+	r = r.WithContext(context.WithValue(r.Context(), tokenClaimsKey{}, claims))
 	h.doHandle(w, r, claims.UserId)
 }
 
+const accessTokenCookie = "access_token"
+
+// Take access token from "Authorization: Bearer" header if it is present, otherwise from cookie.
+// Malformed header is an error rather than a reason to fall back to cookie.
+func accessTokenFromRequest(r *http.Request) (string, error) {
+	if header := r.Header.Get("Authorization"); header != "" {
+		const prefix = "bearer "
+		if len(header) <= len(prefix) || strings.ToLower(header[:len(prefix)]) != prefix {
+			return "", fmt.Errorf("unsupported authorization scheme, expected bearer token")
+		}
+		return strings.TrimSpace(header[len(prefix):]), nil
+	}
+	cookie, err := r.Cookie(accessTokenCookie)
+	if err != nil {
+		return "", fmt.Errorf("extract auth cookie: %v", err)
+	}
+	return cookie.Value, nil
+}
+
 func replyWithError(w http.ResponseWriter, code int, err error) {
 	res := struct {
 		Error string `json:"error"`
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/mail"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	defaultInvitationTTL = 30 * 24 * time.Hour
+	emailConfirmationTTL = 24 * time.Hour
+)
+
+var (
+	errInvitationInvalid   = errors.New("invalid or expired invitation")
+	errEmailTaken          = errors.New("email is used by another user")
+	errNoEmailToConfirm    = errors.New("user has no email to confirm")
+	errConfirmationInvalid = errors.New("invalid or expired email confirmation")
+)
+
+// Parse email address given without display name
+func parseEmail(s string) (string, bool) {
+	addr, err := mail.ParseAddress(s)
+	if err != nil || addr.Address != s {
+		return "", false
+	}
+	return addr.Address, true
+}
+
+type userInfo struct {
+	Id    int64  `json:"id"`
+	Login string `json:"login"`
+	Name  string `json:"name"`
+}
+
+// Send invitation to register for record shared to person without account
+func (a *Api) sendInvitation(ctx context.Context, email, token string, rec *recordInfo, invitedBy int64) error {
+	inviterName, err := a.store.SelectUserName(invitedBy)
+	if err != nil {
+		return fmt.Errorf("select inviting user %d: %v", invitedBy, err)
+	}
+	link := strings.TrimSuffix(a.config().PublicUrl, "/") + "/register?" + url.Values{
+		"email":      {email},
+		"invitation": {token},
+	}.Encode()
+	body := fmt.Sprintf("%s shared record \"%s\" with you on audyos.\n\n"+
+		"Register to listen to it: %s\n\nThe invitation expires in %d days.\n",
+		inviterName, rec.Name, link, int(a.config().invitationTTL()/(24*time.Hour)))
+	return a.mailer().Send(ctx, email, inviterName+" shared a record with you", body)
+}
+
+// Share record to person with given email who has not registered yet
+func (a *Api) inviteToRecord(w http.ResponseWriter, r *http.Request, userId int64, rec *recordInfo,
+	email string, perm permission) {
+	token, err := a.store.UpsertInvitation(rec.Id, email, perm, userId, a.config().invitationTTL())
+	if err != nil {
+		err = fmt.Errorf("insert invitation to record %d: %v", rec.Id, err)
+		logE.Print(err)
+		replyWithError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if err := a.sendInvitation(r.Context(), email, token, rec, userId); err != nil {
+		err = fmt.Errorf("send invitation to record %d: %v", rec.Id, err)
+		logE.Print(err)
+		replyWithError(w, http.StatusBadGateway, err)
+		return
+	}
+	res, _ := json.Marshal(struct {
+		Invited string `json:"invited"`
+	}{email})
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	fmt.Fprint(w, string(res))
+}
+
+// Find user by exact login or verified email, so that records can be shared to users known by login.
+// Users can not be listed or searched by prefix.
+// Note: needs auth
+func (a *Api) HandleUserLookup(w http.ResponseWriter, r *http.Request, userId int64) {
+	query := strings.TrimSpace(r.URL.Query().Get("q"))
+	if query == "" {
+		replyWithError(w, http.StatusBadRequest, fmt.Errorf("q param is not set"))
+		return
+	}
+	u, err := a.store.SelectUserByLoginOrEmail(query)
+	if err == sql.ErrNoRows {
+		replyWithError(w, http.StatusNotFound, fmt.Errorf("no user with login or email %q", query))
+		return
+	}
+	if err != nil {
+		err = fmt.Errorf("look up user %q: %v", query, err)
+		logE.Print(err)
+		replyWithError(w, http.StatusInternalServerError, err)
+		return
+	}
+	res, err := json.Marshal(u)
+	if err != nil {
+		err = fmt.Errorf("encode user %d: %v", u.Id, err)
+		logE.Print(err)
+		replyWithError(w, http.StatusInternalServerError, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	fmt.Fprint(w, string(res))
+}
+
+// Send mail with token confirming email of user, so that user can be found by the email
+// Note: needs auth
+func (a *Api) HandleEmailConfirmation(w http.ResponseWriter, r *http.Request, userId int64) {
+	if r.Method != http.MethodPost {
+		replyWithError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s is not allowed", r.Method))
+		return
+	}
+	email, token, err := a.store.InsertEmailConfirmation(userId, emailConfirmationTTL)
+	if err == errNoEmailToConfirm {
+		replyWithError(w, http.StatusConflict, err)
+		return
+	}
+	if err != nil {
+		err = fmt.Errorf("insert email confirmation of user %d: %v", userId, err)
+		logE.Print(err)
+		replyWithError(w, http.StatusInternalServerError, err)
+		return
+	}
+	link := strings.TrimSuffix(a.config().PublicUrl, "/") + "/confirm-email?" + url.Values{"token": {token}}.Encode()
+	body := fmt.Sprintf("Confirm your email on audyos to let other users share records to it: %s\n\n"+
+		"The link expires in %d hours.\n", link, int(emailConfirmationTTL/time.Hour))
+	if err := a.mailer().Send(r.Context(), email, "Confirm your email on audyos", body); err != nil {
+		err = fmt.Errorf("send email confirmation to user %d: %v", userId, err)
+		logE.Print(err)
+		replyWithError(w, http.StatusBadGateway, err)
+		return
+	}
+	res, _ := json.Marshal(struct {
+		SentTo string `json:"sent_to"`
+	}{email})
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	fmt.Fprint(w, string(res))
+}
+
+// Verify email by token from confirmation mail; token is enough, so auth is not needed
+func (a *Api) HandleConfirmEmail(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		replyWithError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s is not allowed", r.Method))
+		return
+	}
+	var reqBody struct {
+		Token string `json:"token"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&reqBody); err != nil {
+		replyWithError(w, http.StatusBadRequest, fmt.Errorf("decode request body: %v", err))
+		return
+	}
+	defer r.Body.Close()
+	err := a.store.ConfirmEmail(reqBody.Token)
+	if err == errConfirmationInvalid {
+		logI.Print(err)
+		replyWithError(w, http.StatusBadRequest, err)
+		return
+	}
+	if err != nil {
+		err = fmt.Errorf("confirm email: %v", err)
+		logE.Print(err)
+		replyWithError(w, http.StatusInternalServerError, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
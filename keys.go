@@ -0,0 +1,306 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"github.com/dgrijalva/jwt-go"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"sort"
+)
+
+const (
+	signMethodHS256 = "HS256"
+	signMethodRS256 = "RS256"
+	signMethodES256 = "ES256"
+	signMethodEdDSA = "EdDSA"
+)
+
+func init() {
+	jwt.RegisterSigningMethod(signMethodEdDSA, func() jwt.SigningMethod {
+		return signingMethodEdDSA{}
+	})
+}
+
+type jwtKey struct {
+	kid    string
+	method jwt.SigningMethod
+	// Private key or hmac secret; nil for keys that are only used for verification
+	signKey   interface{}
+	verifyKey interface{}
+}
+
+// Keys for signing and verification of access tokens. Tokens are signed with a single key and
+// verified with any of the configured ones, which allows to rotate keys without invalidating
+// tokens already issued.
+type keyring struct {
+	signing *jwtKey
+	byKid   map[string]*jwtKey
+	// Key for tokens without kid header: tokens issued before key ids were introduced
+	noKid *jwtKey
+}
+
+func newKeyring(conf *config) (*keyring, error) {
+	k := &keyring{byKid: make(map[string]*jwtKey)}
+	var hmacKey *jwtKey
+	if conf.JwtSignKey != "" {
+		secret := []byte(conf.JwtSignKey)
+		hmacKey = &jwtKey{method: jwt.SigningMethodHS256, signKey: secret, verifyKey: secret}
+	}
+	switch conf.jwtSignMethod() {
+	case signMethodHS256:
+		if hmacKey == nil {
+			return nil, fmt.Errorf("jwt_sign_key is required for %s", signMethodHS256)
+		}
+		hmacKey.kid = conf.JwtKeyId
+		k.signing = hmacKey
+	default:
+		signing, err := loadPrivateKey(conf.JwtPrivateKeyFile, conf.jwtSignMethod())
+		if err != nil {
+			return nil, fmt.Errorf("load jwt private key: %v", err)
+		}
+		signing.kid = conf.JwtKeyId
+		k.signing = signing
+	}
+	if k.signing.kid != "" {
+		k.byKid[k.signing.kid] = k.signing
+	}
+	// HMAC secret keeps verifying tokens issued without kid, e.g. before switch to asymmetric signing
+	k.noKid = hmacKey
+	for _, vk := range conf.JwtVerifyKeys {
+		key, err := loadPublicKey(vk.File, vk.Method)
+		if err != nil {
+			return nil, fmt.Errorf("load jwt verification key %q: %v", vk.Kid, err)
+		}
+		key.kid = vk.Kid
+		if _, ok := k.byKid[key.kid]; ok {
+			return nil, fmt.Errorf("duplicate jwt key id %q", key.kid)
+		}
+		k.byKid[key.kid] = key
+	}
+	return k, nil
+}
+
+func (k *keyring) sign(claims jwt.MapClaims) (string, error) {
+	token := jwt.NewWithClaims(k.signing.method, claims)
+	if k.signing.kid != "" {
+		token.Header["kid"] = k.signing.kid
+	}
+	return token.SignedString(k.signing.signKey)
+}
+
+// Select verification key for token. Key must have been configured for exactly the algorithm the
+// token claims to be signed with, otherwise e.g. public RSA key could be used as HMAC secret.
+func (k *keyring) keyFunc(tok *jwt.Token) (interface{}, error) {
+	key := k.noKid
+	if kid, ok := tok.Header["kid"].(string); ok {
+		key = k.byKid[kid]
+	}
+	if key == nil {
+		return nil, fmt.Errorf("unknown signing key")
+	}
+	if tok.Method.Alg() != key.method.Alg() {
+		return nil, fmt.Errorf("unexpected signature method")
+	}
+	return key.verifyKey, nil
+}
+
+type jwk struct {
+	Kty string `json:"kty"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+	N   string `json:"n,omitempty"`
+	E   string `json:"e,omitempty"`
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+	Y   string `json:"y,omitempty"`
+}
+
+// Public keys in JWK format; HMAC secrets and keys without kid are never published
+func (k *keyring) jwks() []jwk {
+	keys := []jwk{}
+	for kid, key := range k.byKid {
+		b64 := base64.RawURLEncoding.EncodeToString
+		res := jwk{Use: "sig", Alg: key.method.Alg(), Kid: kid}
+		switch pub := key.verifyKey.(type) {
+		case *rsa.PublicKey:
+			res.Kty = "RSA"
+			res.N = b64(pub.N.Bytes())
+			res.E = b64(big.NewInt(int64(pub.E)).Bytes())
+		case *ecdsa.PublicKey:
+			size := (pub.Curve.Params().BitSize + 7) / 8
+			res.Kty = "EC"
+			res.Crv = pub.Curve.Params().Name
+			res.X = b64(pub.X.FillBytes(make([]byte, size)))
+			res.Y = b64(pub.Y.FillBytes(make([]byte, size)))
+		case ed25519.PublicKey:
+			res.Kty = "OKP"
+			res.Crv = "Ed25519"
+			res.X = b64(pub)
+		default:
+			continue
+		}
+		keys = append(keys, res)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i].Kid < keys[j].Kid })
+	return keys
+}
+
+// Publish public keys so that other services can verify access tokens
+func (a *Api) HandleJwks(w http.ResponseWriter, r *http.Request) {
+	res, err := json.Marshal(struct {
+		Keys []jwk `json:"keys"`
+	}{a.keys().jwks()})
+	if err != nil {
+		err = fmt.Errorf("encode jwks: %v", err)
+		logE.Print(err)
+		replyWithError(w, http.StatusInternalServerError, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	fmt.Fprint(w, string(res))
+}
+
+func readPemBlock(path string) (*pem.Block, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("no pem data in %s", path)
+	}
+	return block, nil
+}
+
+func loadPrivateKey(path string, method string) (*jwtKey, error) {
+	block, err := readPemBlock(path)
+	if err != nil {
+		return nil, err
+	}
+	var priv interface{}
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		priv, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		priv, err = x509.ParseECPrivateKey(block.Bytes)
+	case "PRIVATE KEY":
+		priv, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	default:
+		return nil, fmt.Errorf("unsupported pem block %q", block.Type)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("parse private key: %v", err)
+	}
+	signer, ok := priv.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("unsupported private key type %T", priv)
+	}
+	key, err := newAsymmetricKey(signer.Public(), method)
+	if err != nil {
+		return nil, err
+	}
+	key.signKey = priv
+	return key, nil
+}
+
+func loadPublicKey(path string, method string) (*jwtKey, error) {
+	block, err := readPemBlock(path)
+	if err != nil {
+		return nil, err
+	}
+	var pub interface{}
+	switch block.Type {
+	case "PUBLIC KEY":
+		pub, err = x509.ParsePKIXPublicKey(block.Bytes)
+	case "RSA PUBLIC KEY":
+		pub, err = x509.ParsePKCS1PublicKey(block.Bytes)
+	case "CERTIFICATE":
+		var cert *x509.Certificate
+		if cert, err = x509.ParseCertificate(block.Bytes); err == nil {
+			pub = cert.PublicKey
+		}
+	default:
+		return nil, fmt.Errorf("unsupported pem block %q", block.Type)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("parse public key: %v", err)
+	}
+	return newAsymmetricKey(pub, method)
+}
+
+// Check that key matches signing method; empty method means the one implied by key type
+func newAsymmetricKey(pub interface{}, method string) (*jwtKey, error) {
+	switch pub := pub.(type) {
+	case *rsa.PublicKey:
+		if method != "" && method != signMethodRS256 {
+			break
+		}
+		if pub.N.BitLen() < 2048 {
+			return nil, fmt.Errorf("rsa key must be at least 2048 bits long")
+		}
+		return &jwtKey{method: jwt.SigningMethodRS256, verifyKey: pub}, nil
+	case *ecdsa.PublicKey:
+		if method != "" && method != signMethodES256 {
+			break
+		}
+		if pub.Curve != elliptic.P256() {
+			return nil, fmt.Errorf("%s requires P-256 key", signMethodES256)
+		}
+		return &jwtKey{method: jwt.SigningMethodES256, verifyKey: pub}, nil
+	case ed25519.PublicKey:
+		if method != "" && method != signMethodEdDSA {
+			break
+		}
+		return &jwtKey{method: signingMethodEdDSA{}, verifyKey: pub}, nil
+	default:
+		return nil, fmt.Errorf("unsupported key type %T", pub)
+	}
+	return nil, fmt.Errorf("key of type %T can not be used for %s", pub, method)
+}
+
+// Ed25519 signatures (RFC 8037), not provided by jwt-go
+type signingMethodEdDSA struct{}
+
+func (m signingMethodEdDSA) Alg() string {
+	return signMethodEdDSA
+}
+
+func (m signingMethodEdDSA) Sign(signingString string, key interface{}) (string, error) {
+	priv, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return "", jwt.ErrInvalidKeyType
+	}
+	sig, err := priv.Sign(rand.Reader, []byte(signingString), crypto.Hash(0))
+	if err != nil {
+		return "", err
+	}
+	return jwt.EncodeSegment(sig), nil
+}
+
+func (m signingMethodEdDSA) Verify(signingString, signature string, key interface{}) error {
+	pub, ok := key.(ed25519.PublicKey)
+	if !ok {
+		return jwt.ErrInvalidKeyType
+	}
+	sig, err := jwt.DecodeSegment(signature)
+	if err != nil {
+		return err
+	}
+	if !ed25519.Verify(pub, []byte(signingString), sig) {
+		return jwt.ErrSignatureInvalid
+	}
+	return nil
+}
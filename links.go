@@ -0,0 +1,391 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Public link to record that can be opened without account. Link token is link id signed with
+// link_sign_key, so tokens can not be guessed from ids and forged tokens are rejected without
+// querying database.
+type shareLink struct {
+	Id       string `json:"id"`
+	Token    string `json:"token"`
+	RecordId int64  `json:"record_id"`
+	// Either listen or download
+	Permission permission `json:"permission"`
+	CreatedBy  int64      `json:"created_by"`
+	CreatedAt  time.Time  `json:"created_at"`
+	ExpiresAt  *time.Time `json:"expires_at"`
+	// Number of plays and downloads after which link stops working; 0 means unlimited
+	MaxUses          int        `json:"max_uses"`
+	Uses             int        `json:"uses"`
+	RevokedAt        *time.Time `json:"revoked_at"`
+	PasswordHash     string     `json:"-"`
+	PasswordRequired bool       `json:"password_required"`
+}
+
+var (
+	errLinkExpired   = fmt.Errorf("link has expired")
+	errLinkRevoked   = fmt.Errorf("link has been revoked")
+	errLinkExhausted = fmt.Errorf("link has been used max number of times")
+)
+
+// Reason the link can not be used any more or nil if it is still active
+func (l *shareLink) inactive(now time.Time) error {
+	switch {
+	case l.RevokedAt != nil:
+		return errLinkRevoked
+	case l.ExpiresAt != nil && !now.Before(*l.ExpiresAt):
+		return errLinkExpired
+	case l.MaxUses > 0 && l.Uses >= l.MaxUses:
+		return errLinkExhausted
+	}
+	return nil
+}
+
+func (a *Api) signLinkId(id string) string {
+	mac := hmac.New(sha256.New, []byte(a.config().linkSignKey()))
+	mac.Write([]byte(id))
+	return id + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// Id of link the token was issued for if token signature is valid
+func (a *Api) parseLinkToken(token string) (string, bool) {
+	dot := strings.IndexByte(token, '.')
+	if dot <= 0 {
+		return "", false
+	}
+	id := token[:dot]
+	return id, hmac.Equal([]byte(a.signLinkId(id)), []byte(token))
+}
+
+const (
+	// Cookie with token of playback counted as use of link; ranges past the beginning are served
+	// only to requests having it
+	linkPlayCookie = "audyos_link_play"
+	linkPlayTTL    = 3 * time.Hour
+)
+
+// Token of playback is link id and time the playback may be continued until signed with
+// link_sign_key; prefix keeps these signatures apart from ones of link tokens
+func (a *Api) signLinkPlay(linkId string, expiresAt int64) string {
+	payload := linkId + "." + strconv.FormatInt(expiresAt, 10)
+	mac := hmac.New(sha256.New, []byte(a.config().linkSignKey()))
+	mac.Write([]byte("play:" + payload))
+	return payload + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func (a *Api) linkPlayCookie(token, linkId string) *http.Cookie {
+	return &http.Cookie{
+		Name:     linkPlayCookie,
+		Value:    a.signLinkPlay(linkId, time.Now().Add(linkPlayTTL).Unix()),
+		Path:     "/v1/links/" + token + "/content",
+		MaxAge:   int(linkPlayTTL.Seconds()),
+		HttpOnly: true,
+		Secure:   !a.config().CookieInsecure,
+		SameSite: http.SameSiteLaxMode,
+	}
+}
+
+// Report whether request continues playback of link counted before
+func (a *Api) continuesLinkPlay(r *http.Request, linkId string) bool {
+	c, err := r.Cookie(linkPlayCookie)
+	if err != nil {
+		return false
+	}
+	parts := strings.Split(c.Value, ".")
+	if len(parts) != 3 || parts[0] != linkId {
+		return false
+	}
+	expiresAt, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil || time.Now().Unix() >= expiresAt {
+		return false
+	}
+	return hmac.Equal([]byte(a.signLinkPlay(linkId, expiresAt)), []byte(c.Value))
+}
+
+// Create public link to record; only owner can create links
+func (a *Api) handleCreateShareLink(w http.ResponseWriter, r *http.Request, userId int64, recordId int64) {
+	defer r.Body.Close()
+	var reqBody struct {
+		Permission string     `json:"permission"`
+		ExpiresAt  *time.Time `json:"expires_at"`
+		MaxUses    int        `json:"max_uses"`
+		Password   string     `json:"password"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&reqBody); err != nil {
+		err = fmt.Errorf("decode request body: %v", err)
+		logI.Print(err)
+		replyWithError(w, http.StatusBadRequest, err)
+		return
+	}
+	perm, err := parseSharePermission(reqBody.Permission)
+	if err != nil || perm > permDownload {
+		replyWithError(w, http.StatusBadRequest, fmt.Errorf("link permission must be listen or download"))
+		return
+	}
+	if reqBody.ExpiresAt != nil && !reqBody.ExpiresAt.After(time.Now()) {
+		replyWithError(w, http.StatusBadRequest, fmt.Errorf("expires_at must be in the future"))
+		return
+	}
+	if reqBody.MaxUses < 0 {
+		replyWithError(w, http.StatusBadRequest, fmt.Errorf("max_uses must not be negative"))
+		return
+	}
+	if rec := a.selectRecordForRequest(w, userId, recordId, permOwner); rec == nil {
+		return
+	}
+	link := &shareLink{RecordId: recordId, Permission: perm, CreatedBy: userId, ExpiresAt: reqBody.ExpiresAt,
+		MaxUses: reqBody.MaxUses}
+	if link.Id, err = randomToken(16); err != nil {
+		err = fmt.Errorf("generate link id: %v", err)
+		logE.Print(err)
+		replyWithError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if reqBody.Password != "" {
+		if err := validatePassword(reqBody.Password); err != nil {
+			replyWithError(w, http.StatusBadRequest, err)
+			return
+		}
+		if link.PasswordHash, err = a.passwords().Hash(reqBody.Password); err != nil {
+			err = fmt.Errorf("hash link password: %v", err)
+			logE.Print(err)
+			replyWithError(w, http.StatusInternalServerError, err)
+			return
+		}
+		link.PasswordRequired = true
+	}
+	if err := a.store.InsertShareLink(link); err != nil {
+		err = fmt.Errorf("insert link to record %d: %v", recordId, err)
+		logE.Print(err)
+		replyWithError(w, http.StatusInternalServerError, err)
+		return
+	}
+	link.Token = a.signLinkId(link.Id)
+	res, err := json.Marshal(link)
+	if err != nil {
+		err = fmt.Errorf("encode link %s: %v", link.Id, err)
+		logE.Print(err)
+		replyWithError(w, http.StatusInternalServerError, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	fmt.Fprint(w, string(res))
+}
+
+// List links to record including expired and revoked ones; only owner can list links
+func (a *Api) handleShareLinksList(w http.ResponseWriter, r *http.Request, userId int64, recordId int64) {
+	if rec := a.selectRecordForRequest(w, userId, recordId, permOwner); rec == nil {
+		return
+	}
+	links, err := a.store.SelectShareLinks(recordId)
+	if err != nil {
+		err = fmt.Errorf("select links to record %d: %v", recordId, err)
+		logE.Print(err)
+		replyWithError(w, http.StatusInternalServerError, err)
+		return
+	}
+	for _, l := range links {
+		l.Token = a.signLinkId(l.Id)
+	}
+	res, err := json.Marshal(struct {
+		Links []*shareLink `json:"links"`
+	}{links})
+	if err != nil {
+		err = fmt.Errorf("encode links to record %d: %v", recordId, err)
+		logE.Print(err)
+		replyWithError(w, http.StatusInternalServerError, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	fmt.Fprint(w, string(res))
+}
+
+// Revoke link to record; only owner can revoke links
+func (a *Api) handleRevokeShareLink(w http.ResponseWriter, r *http.Request, userId int64, recordId int64, linkId string) {
+	if rec := a.selectRecordForRequest(w, userId, recordId, permOwner); rec == nil {
+		return
+	}
+	revoked, err := a.store.RevokeShareLink(recordId, linkId)
+	if err != nil {
+		err = fmt.Errorf("revoke link %s: %v", linkId, err)
+		logE.Print(err)
+		replyWithError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if !revoked {
+		replyWithError(w, http.StatusNotFound, fmt.Errorf("no active link %s to record %d", linkId, recordId))
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+const linkPasswordHeader = "Audyos-Link-Password"
+
+// Route requests to public link /v1/links/{token} and its content /v1/links/{token}/content. These
+// do not need auth: access is granted by link token and password of the link if it is set.
+func (a *Api) HandleLink(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/v1/links/"), "/", 2)
+	if len(parts) == 2 && parts[1] != "content" {
+		replyWithError(w, http.StatusNotFound, fmt.Errorf("unknown link resource %q", parts[1]))
+		return
+	}
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		replyWithError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s is not allowed", r.Method))
+		return
+	}
+	linkId, ok := a.parseLinkToken(parts[0])
+	if !ok {
+		replyWithError(w, http.StatusNotFound, fmt.Errorf("invalid link"))
+		return
+	}
+	link, err := a.store.SelectShareLink(linkId)
+	if err == sql.ErrNoRows {
+		replyWithError(w, http.StatusNotFound, fmt.Errorf("invalid link"))
+		return
+	}
+	if err != nil {
+		err = fmt.Errorf("select link %s: %v", linkId, err)
+		logE.Print(err)
+		replyWithError(w, http.StatusInternalServerError, err)
+		return
+	}
+	// Playback counted as the last use of link may still be continued
+	if err := link.inactive(time.Now()); err != nil &&
+		(err != errLinkExhausted || len(parts) == 1 || !a.continuesLinkPlay(r, linkId)) {
+		replyWithError(w, http.StatusGone, err)
+		return
+	}
+	if link.PasswordRequired {
+		password := r.Header.Get(linkPasswordHeader)
+		if password == "" {
+			replyWithError(w, http.StatusUnauthorized, fmt.Errorf("link password is required"))
+			return
+		}
+		if ok, _, err := a.passwords().Verify(link.PasswordHash, password); err != nil || !ok {
+			logI.Printf("wrong password for link %s", linkId)
+			replyWithError(w, http.StatusUnauthorized, fmt.Errorf("wrong link password"))
+			return
+		}
+	}
+	rec, content, err := a.store.SelectLinkedRecordContent(link.RecordId)
+	if err != nil {
+		err = fmt.Errorf("select record %d of link %s: %v", link.RecordId, linkId, err)
+		logE.Print(err)
+		replyWithError(w, http.StatusInternalServerError, err)
+		return
+	}
+	rec.Permission = link.Permission
+	if len(parts) == 1 {
+		a.replyWithLinkInfo(w, link, rec)
+		return
+	}
+	download, err := parseDownloadParam(r)
+	if err != nil {
+		replyWithError(w, http.StatusBadRequest, err)
+		return
+	}
+	if download && link.Permission < permDownload {
+		replyWithError(w, http.StatusForbidden, fmt.Errorf("link does not allow download"))
+		return
+	}
+	if startsPlayback(r, rec) {
+		used, err := a.store.UseShareLink(linkId)
+		if err != nil {
+			err = fmt.Errorf("count use of link %s: %v", linkId, err)
+			logE.Print(err)
+			replyWithError(w, http.StatusInternalServerError, err)
+			return
+		}
+		if !used {
+			replyWithError(w, http.StatusGone, errLinkExhausted)
+			return
+		}
+		http.SetCookie(w, a.linkPlayCookie(parts[0], linkId))
+	} else if r.Method == http.MethodGet && !a.continuesLinkPlay(r, linkId) {
+		// Ranges past the beginning only continue playback counted before
+		replyWithError(w, http.StatusConflict, fmt.Errorf("playback must be started from the beginning"))
+		return
+	}
+	a.serveRecordContent(w, r, rec, content, download)
+}
+
+// Report whether request may get content from its beginning rather than only continue playback or
+// check headers: such requests are counted as uses of link. Range header is parsed the way
+// http.ServeContent does; only a single range starting past the first byte continues playback,
+// since suffix ranges, multiple ones and invalid ones may be served as whole content.
+func startsPlayback(r *http.Request, rec *recordInfo) bool {
+	if r.Method != http.MethodGet {
+		return false
+	}
+	// Range is ignored by http.ServeContent unless If-Range matches, only ETag is checked here
+	if ifRange := r.Header.Get("If-Range"); ifRange != "" && ifRange != `"`+rec.Checksum+`"` {
+		return true
+	}
+	start, ok := singleRangeStart(r.Header.Get("Range"))
+	return !ok || start == 0
+}
+
+// Start of range in Range header if it has the only range of form start-[end]
+func singleRangeStart(header string) (int64, bool) {
+	const prefix = "bytes="
+	if !strings.HasPrefix(header, prefix) {
+		return 0, false
+	}
+	spec := strings.TrimSpace(header[len(prefix):])
+	i := strings.Index(spec, "-")
+	if i <= 0 || strings.Contains(spec, ",") {
+		return 0, false
+	}
+	start, err := strconv.ParseInt(strings.TrimSpace(spec[:i]), 10, 64)
+	if err != nil || start < 0 {
+		return 0, false
+	}
+	if end := strings.TrimSpace(spec[i+1:]); end != "" {
+		if end, err := strconv.ParseInt(end, 10, 64); err != nil || end < start {
+			return 0, false
+		}
+	}
+	return start, true
+}
+
+func (a *Api) replyWithLinkInfo(w http.ResponseWriter, link *shareLink, rec *recordInfo) {
+	resBody := struct {
+		Name        string     `json:"name"`
+		Description string     `json:"description"`
+		ContentType string     `json:"content_type"`
+		Size        int64      `json:"size"`
+		Duration    float64    `json:"duration"`
+		Codec       string     `json:"codec"`
+		Permission  permission `json:"permission"`
+		ExpiresAt   *time.Time `json:"expires_at"`
+		// Omitted for links without limit
+		RemainingUses *int `json:"remaining_uses,omitempty"`
+	}{Name: rec.Name, Description: rec.Description, ContentType: rec.ContentType, Size: rec.Size,
+		Duration: rec.Duration, Codec: rec.Codec, Permission: link.Permission, ExpiresAt: link.ExpiresAt}
+	if link.MaxUses > 0 {
+		remaining := link.MaxUses - link.Uses
+		resBody.RemainingUses = &remaining
+	}
+	res, err := json.Marshal(resBody)
+	if err != nil {
+		err = fmt.Errorf("encode link %s: %v", link.Id, err)
+		logE.Print(err)
+		replyWithError(w, http.StatusInternalServerError, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	fmt.Fprint(w, string(res))
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"mime"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"strings"
+	"time"
+)
+
+// Delivery of emails to users, e.g. invitations to records shared to people not registered yet
+type Mailer interface {
+	// Send plain text message
+	Send(ctx context.Context, to, subject, body string) error
+}
+
+func newMailer(conf *config) Mailer {
+	if conf.SmtpAddr == "" {
+		return logMailer{}
+	}
+	return &smtpMailer{addr: conf.SmtpAddr, user: conf.SmtpUser, password: conf.SmtpPassword, from: conf.MailFrom}
+}
+
+// Mailer that only logs messages; used when no SMTP server is configured
+type logMailer struct{}
+
+func (logMailer) Send(ctx context.Context, to, subject, body string) error {
+	logI.Printf("mail to %s is not sent, smtp_addr is not set: %s", to, subject)
+	return nil
+}
+
+// Mailer delivering messages through SMTP server. STARTTLS is used if server supports it;
+// credentials are only sent over TLS or to localhost.
+type smtpMailer struct {
+	addr     string
+	user     string
+	password string
+	from     string
+}
+
+func (m *smtpMailer) Send(ctx context.Context, to, subject, body string) error {
+	msg, err := m.message(to, subject, body)
+	if err != nil {
+		return err
+	}
+	var auth smtp.Auth
+	if m.user != "" {
+		host, _, _ := net.SplitHostPort(m.addr)
+		auth = smtp.PlainAuth("", m.user, m.password, host)
+	}
+	from, err := mail.ParseAddress(m.from)
+	if err != nil {
+		return fmt.Errorf("parse mail_from: %v", err)
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- smtp.SendMail(m.addr, auth, from.Address, []string{to}, msg)
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (m *smtpMailer) message(to, subject, body string) ([]byte, error) {
+	if strings.ContainsAny(to, "\r\n") {
+		return nil, fmt.Errorf("invalid recipient address %q", to)
+	}
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\n", m.from)
+	fmt.Fprintf(&msg, "To: %s\r\n", to)
+	fmt.Fprintf(&msg, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", subject))
+	fmt.Fprintf(&msg, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	msg.WriteString("MIME-Version: 1.0\r\n")
+	msg.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	msg.WriteString("Content-Transfer-Encoding: 8bit\r\n\r\n")
+	msg.WriteString(strings.Replace(body, "\n", "\r\n", -1))
+	return msg.Bytes(), nil
+}
@@ -0,0 +1,1581 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Rows of memStore tables. Fields are tagged with names of columns of the same tables in Postgres,
+// nullable columns are pointers.
+
+type memUser struct {
+	Id               int64   `db:"id"`
+	Login            string  `db:"login"`
+	Password         string  `db:"password"`
+	Name             string  `db:"name"`
+	Email            *string `db:"email"`
+	AutoAcceptShares bool    `db:"auto_accept_shares"`
+	EmailVerified    bool    `db:"email_verified"`
+	// Hash of token confirming email and its expiration time
+	EmailTokenHash      *string    `db:"email_token_hash"`
+	EmailTokenExpiresAt *time.Time `db:"email_token_expires_at"`
+}
+
+type memRecord struct {
+	Id          int64     `db:"id"`
+	Name        string    `db:"name"`
+	Content     []byte    `db:"content"`
+	OwnerId     int64     `db:"owner_id"`
+	Size        int64     `db:"size"`
+	CreatedAt   time.Time `db:"created_at"`
+	Description string    `db:"description"`
+	ContentType string    `db:"content_type"`
+	StorageKey  *string   `db:"storage_key"`
+	Checksum    *string   `db:"checksum"`
+	Duration    float64   `db:"duration"`
+	Codec       string    `db:"codec"`
+	SampleRate  int64     `db:"sample_rate"`
+	Channels    int64     `db:"channels"`
+	Bitrate     int64     `db:"bitrate"`
+}
+
+type memSharing struct {
+	RecordId   int64  `db:"record_id"`
+	To         int64  `db:"to"`
+	Permission string `db:"permission"`
+	SharedBy   *int64 `db:"shared_by"`
+	Status     string `db:"status"`
+}
+
+type memRefreshToken struct {
+	Id        int64      `db:"id"`
+	UserId    int64      `db:"user_id"`
+	FamilyId  string     `db:"family_id"`
+	TokenHash string     `db:"token_hash"`
+	CreatedAt time.Time  `db:"created_at"`
+	ExpiresAt time.Time  `db:"expires_at"`
+	UsedAt    *time.Time `db:"used_at"`
+	RevokedAt *time.Time `db:"revoked_at"`
+}
+
+type memRevokedToken struct {
+	Jti       string    `db:"jti"`
+	UserId    int64     `db:"user_id"`
+	ExpiresAt time.Time `db:"expires_at"`
+}
+
+type memUserRevocation struct {
+	UserId        int64     `db:"user_id"`
+	RevokedBefore time.Time `db:"revoked_before"`
+}
+
+type memUpload struct {
+	Id        string    `db:"id"`
+	OwnerId   int64     `db:"owner_id"`
+	Length    int64     `db:"length"`
+	Offset    int64     `db:"upload_offset"`
+	Metadata  string    `db:"metadata"`
+	ExpiresAt time.Time `db:"expires_at"`
+	RecordId  *int64    `db:"record_id"`
+}
+
+type memRecordTag struct {
+	RecordId int64  `db:"record_id"`
+	Tag      string `db:"tag"`
+}
+
+type memShareLink struct {
+	Id           string     `db:"id"`
+	RecordId     int64      `db:"record_id"`
+	Permission   string     `db:"permission"`
+	CreatedBy    int64      `db:"created_by"`
+	CreatedAt    time.Time  `db:"created_at"`
+	ExpiresAt    *time.Time `db:"expires_at"`
+	MaxUses      int64      `db:"max_uses"`
+	Uses         int64      `db:"uses"`
+	RevokedAt    *time.Time `db:"revoked_at"`
+	PasswordHash *string    `db:"password_hash"`
+}
+
+type memInvitation struct {
+	RecordId   int64     `db:"record_id"`
+	Email      string    `db:"email"`
+	Permission string    `db:"permission"`
+	InvitedBy  int64     `db:"invited_by"`
+	TokenHash  string    `db:"token_hash"`
+	CreatedAt  time.Time `db:"created_at"`
+	ExpiresAt  time.Time `db:"expires_at"`
+}
+
+type memBlockedUser struct {
+	UserId    int64     `db:"user_id"`
+	BlockedId int64     `db:"blocked_id"`
+	CreatedAt time.Time `db:"created_at"`
+}
+
+type memGroup struct {
+	Id        int64     `db:"id"`
+	Name      string    `db:"name"`
+	CreatedBy int64     `db:"created_by"`
+	CreatedAt time.Time `db:"created_at"`
+}
+
+type memGroupMember struct {
+	GroupId int64     `db:"group_id"`
+	UserId  int64     `db:"user_id"`
+	Role    string    `db:"role"`
+	AddedAt time.Time `db:"added_at"`
+	Status  string    `db:"status"`
+}
+
+type memGroupSharing struct {
+	RecordId   int64     `db:"record_id"`
+	GroupId    int64     `db:"group_id"`
+	Permission string    `db:"permission"`
+	SharedBy   int64     `db:"shared_by"`
+	CreatedAt  time.Time `db:"created_at"`
+}
+
+// Store keeping everything in memory, so that the service can run without database for development
+// and tests. Its tables mirror the ones created by migrations and every method behaves the same
+// way as sqlStore one does, except that full-text search is emulated. Everything is lost on restart.
+type memStore struct {
+	mu sync.Mutex
+
+	users           []*memUser
+	records         []*memRecord
+	shared          []*memSharing
+	refreshTokens   []*memRefreshToken
+	revokedTokens   []*memRevokedToken
+	userRevocations []*memUserRevocation
+	uploads         []*memUpload
+	recordTags      []*memRecordTag
+	shareLinks      []*memShareLink
+	invitations     []*memInvitation
+	blockedUsers    []*memBlockedUser
+	groups          []*memGroup
+	groupMembers    []*memGroupMember
+	groupShares     []*memGroupSharing
+	lastIds         map[string]int64
+}
+
+func newMemStore() *memStore {
+	return &memStore{lastIds: make(map[string]int64)}
+}
+
+func (s *memStore) Close() error {
+	return nil
+}
+
+// Next value of id sequence of table
+func (s *memStore) nextId(table string) int64 {
+	s.lastIds[table]++
+	return s.lastIds[table]
+}
+
+func stringPtr(s string) *string {
+	return &s
+}
+
+func (s *memStore) user(userId int64) *memUser {
+	for _, u := range s.users {
+		if u.Id == userId {
+			return u
+		}
+	}
+	return nil
+}
+
+func (s *memStore) record(recordId int64) *memRecord {
+	for _, rec := range s.records {
+		if rec.Id == recordId {
+			return rec
+		}
+	}
+	return nil
+}
+
+func (s *memStore) sharing(recordId, toUserId int64) *memSharing {
+	for _, sh := range s.shared {
+		if sh.RecordId == recordId && sh.To == toUserId {
+			return sh
+		}
+	}
+	return nil
+}
+
+func (s *memStore) isBlocked(userId, blockedId int64) bool {
+	for _, b := range s.blockedUsers {
+		if b.UserId == userId && b.BlockedId == blockedId {
+			return true
+		}
+	}
+	return false
+}
+
+// User has accepted membership in group
+func (s *memStore) isGroupMember(groupId, userId int64) bool {
+	m := s.groupMember(groupId, userId)
+	return m != nil && m.Status == shareAccepted
+}
+
+func (s *memStore) groupMember(groupId, userId int64) *memGroupMember {
+	for _, m := range s.groupMembers {
+		if m.GroupId == groupId && m.UserId == userId {
+			return m
+		}
+	}
+	return nil
+}
+
+// Sharings of record to groups user has accepted membership in, skipping ones made by users the user has blocked
+func (s *memStore) groupSharesTo(recordId, userId int64) []*memGroupSharing {
+	var shares []*memGroupSharing
+	for _, g := range s.groupShares {
+		if g.RecordId == recordId && s.isGroupMember(g.GroupId, userId) && !s.isBlocked(userId, g.SharedBy) {
+			shares = append(shares, g)
+		}
+	}
+	return shares
+}
+
+func parsePermission(name string) permission {
+	var p permission
+	if err := p.UnmarshalText([]byte(name)); err != nil {
+		return permNone
+	}
+	return p
+}
+
+// Level of permission of user to record, the same as recordPermission expression gives
+func (s *memStore) recordPermission(rec *memRecord, userId int64) permission {
+	if rec.OwnerId == userId {
+		return permOwner
+	}
+	perm := permNone
+	if sh := s.sharing(rec.Id, userId); sh != nil && sh.Status == shareAccepted {
+		perm = parsePermission(sh.Permission)
+	}
+	for _, g := range s.groupSharesTo(rec.Id, userId) {
+		if p := parsePermission(g.Permission); p > perm {
+			perm = p
+		}
+	}
+	return perm
+}
+
+// Record is visible to user, the same as recordVisibleTo condition checks
+func (s *memStore) recordVisibleTo(rec *memRecord, userId int64) bool {
+	if rec.OwnerId == userId {
+		return true
+	}
+	if sh := s.sharing(rec.Id, userId); sh != nil && sh.Status == shareAccepted {
+		return true
+	}
+	return len(s.groupSharesTo(rec.Id, userId)) > 0
+}
+
+func (rec *memRecord) info() *recordInfo {
+	info := &recordInfo{
+		Id:          rec.Id,
+		Name:        rec.Name,
+		Description: rec.Description,
+		OwnerId:     rec.OwnerId,
+		ContentType: rec.ContentType,
+		Size:        rec.Size,
+		CreatedAt:   rec.CreatedAt,
+		Duration:    rec.Duration,
+		Codec:       rec.Codec,
+		SampleRate:  int(rec.SampleRate),
+		Channels:    int(rec.Channels),
+		Bitrate:     int(rec.Bitrate),
+	}
+	if rec.StorageKey != nil {
+		info.StorageKey = *rec.StorageKey
+	}
+	if rec.Checksum != nil {
+		info.Checksum = *rec.Checksum
+	}
+	return info
+}
+
+// Content of record unless it has been moved to blob store
+func (rec *memRecord) inlineContent() []byte {
+	if rec.StorageKey != nil || rec.Content == nil {
+		return nil
+	}
+	return append([]byte{}, rec.Content...)
+}
+
+func (s *memStore) RegisterUser(login, passwordHash, name, email, invitation string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, u := range s.users {
+		if u.Login == login {
+			return fmt.Errorf("duplicate key value violates unique constraint \"users_login_key\"")
+		}
+	}
+	now := time.Now()
+	invited := func(inv *memInvitation) bool {
+		return strings.EqualFold(inv.Email, email) && inv.ExpiresAt.After(now)
+	}
+	if invitation != "" {
+		valid := false
+		for _, inv := range s.invitations {
+			if inv.TokenHash == hashRefreshToken(invitation) && invited(inv) {
+				valid = true
+			}
+		}
+		if !valid {
+			return errInvitationInvalid
+		}
+		for _, u := range s.users {
+			if u.Email != nil && strings.EqualFold(*u.Email, email) && !u.EmailVerified {
+				u.Email, u.EmailTokenHash, u.EmailTokenExpiresAt = nil, nil, nil
+			}
+		}
+	}
+	if email != "" && s.userByEmail(email) != nil {
+		return errEmailTaken
+	}
+	u := &memUser{Id: s.nextId("users"), Login: login, Password: passwordHash, Name: name, AutoAcceptShares: true,
+		EmailVerified: invitation != ""}
+	if email != "" {
+		u.Email = stringPtr(email)
+	}
+	s.users = append(s.users, u)
+	if invitation == "" {
+		return nil
+	}
+	var rest []*memInvitation
+	for _, inv := range s.invitations {
+		if invited(inv) && s.record(inv.RecordId) != nil {
+			invitedBy := inv.InvitedBy
+			s.shared = append(s.shared, &memSharing{RecordId: inv.RecordId, To: u.Id, Permission: inv.Permission,
+				SharedBy: &invitedBy, Status: shareAccepted})
+		}
+		if !strings.EqualFold(inv.Email, email) {
+			rest = append(rest, inv)
+		}
+	}
+	s.invitations = rest
+	return nil
+}
+
+// User with given email whether it is verified or not
+func (s *memStore) userByEmail(email string) *memUser {
+	for _, u := range s.users {
+		if u.Email != nil && strings.EqualFold(*u.Email, email) {
+			return u
+		}
+	}
+	return nil
+}
+
+func (s *memStore) InsertEmailConfirmation(userId int64, ttl time.Duration) (email, token string, err error) {
+	if token, err = randomToken(32); err != nil {
+		return "", "", fmt.Errorf("generate confirmation token: %v", err)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	u := s.user(userId)
+	if u == nil || u.Email == nil || u.EmailVerified {
+		return "", "", errNoEmailToConfirm
+	}
+	expiresAt := time.Now().Add(ttl)
+	u.EmailTokenHash, u.EmailTokenExpiresAt = stringPtr(hashRefreshToken(token)), &expiresAt
+	return *u.Email, token, nil
+}
+
+func (s *memStore) ConfirmEmail(token string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	var u *memUser
+	for _, user := range s.users {
+		if user.EmailTokenHash != nil && *user.EmailTokenHash == hashRefreshToken(token) && user.Email != nil &&
+			user.EmailTokenExpiresAt.After(now) {
+			u = user
+		}
+	}
+	if u == nil {
+		return errConfirmationInvalid
+	}
+	u.EmailVerified, u.EmailTokenHash, u.EmailTokenExpiresAt = true, nil, nil
+	status := sharePending
+	if u.AutoAcceptShares {
+		status = shareAccepted
+	}
+	var rest []*memInvitation
+	for _, inv := range s.invitations {
+		if !strings.EqualFold(inv.Email, *u.Email) {
+			rest = append(rest, inv)
+			continue
+		}
+		rec := s.record(inv.RecordId)
+		if rec == nil || !inv.ExpiresAt.After(now) || rec.OwnerId == u.Id || s.sharing(rec.Id, u.Id) != nil ||
+			s.isBlocked(u.Id, inv.InvitedBy) {
+			continue
+		}
+		invitedBy := inv.InvitedBy
+		s.shared = append(s.shared, &memSharing{RecordId: inv.RecordId, To: u.Id, Permission: inv.Permission,
+			SharedBy: &invitedBy, Status: status})
+	}
+	s.invitations = rest
+	return nil
+}
+
+func (s *memStore) SelectUserCredentials(login string) (userId int64, passwordHash string, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, u := range s.users {
+		if u.Login == login {
+			return u.Id, u.Password, nil
+		}
+	}
+	return 0, "", sql.ErrNoRows
+}
+
+func (s *memStore) UpdateUserPassword(userId int64, passwordHash string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if u := s.user(userId); u != nil {
+		u.Password = passwordHash
+	}
+	return nil
+}
+
+func (s *memStore) SelectUserName(userId int64) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	u := s.user(userId)
+	if u == nil {
+		return "", sql.ErrNoRows
+	}
+	return u.Name, nil
+}
+
+func (s *memStore) SelectUserByLoginOrEmail(loginOrEmail string) (*userInfo, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	found := s.userByEmail(loginOrEmail)
+	if found == nil || !found.EmailVerified {
+		found = nil
+		for _, u := range s.users {
+			if u.Login == loginOrEmail {
+				found = u
+			}
+		}
+	}
+	if found == nil {
+		return nil, sql.ErrNoRows
+	}
+	return &userInfo{Id: found.Id, Login: found.Login, Name: found.Name}, nil
+}
+
+func (s *memStore) SelectUserSettings(userId int64) (*userSettings, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	u := s.user(userId)
+	if u == nil {
+		return nil, sql.ErrNoRows
+	}
+	return &userSettings{AutoAcceptShares: u.AutoAcceptShares}, nil
+}
+
+func (s *memStore) UpdateUserSettings(userId int64, autoAcceptShares *bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if u := s.user(userId); u != nil && autoAcceptShares != nil {
+		u.AutoAcceptShares = *autoAcceptShares
+	}
+	return nil
+}
+
+func (s *memStore) IsBlocked(userId, blockedId int64) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.isBlocked(userId, blockedId), nil
+}
+
+func (s *memStore) BlockUser(userId, blockedId int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.isBlocked(userId, blockedId) {
+		s.blockedUsers = append(s.blockedUsers, &memBlockedUser{UserId: userId, BlockedId: blockedId,
+			CreatedAt: time.Now()})
+	}
+	for _, sh := range s.shared {
+		if sh.To == userId && sh.SharedBy != nil && *sh.SharedBy == blockedId && sh.Status == sharePending {
+			sh.Status = shareDeclined
+		}
+	}
+	return nil
+}
+
+func (s *memStore) UnblockUser(userId, blockedId int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var rest []*memBlockedUser
+	for _, b := range s.blockedUsers {
+		if b.UserId != userId || b.BlockedId != blockedId {
+			rest = append(rest, b)
+		}
+	}
+	s.blockedUsers = rest
+	return nil
+}
+
+func (s *memStore) SelectBlockedUsers(userId int64) ([]*userInfo, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	users := []*userInfo{}
+	for _, b := range s.blockedUsers {
+		if u := s.user(b.BlockedId); b.UserId == userId && u != nil {
+			users = append(users, &userInfo{Id: u.Id, Login: u.Login, Name: u.Name})
+		}
+	}
+	sort.Slice(users, func(i, j int) bool { return users[i].Id < users[j].Id })
+	return users, nil
+}
+
+func (s *memStore) insertRefreshToken(userId int64, familyId string, ttl time.Duration) (string, error) {
+	token, err := randomToken(32)
+	if err != nil {
+		return "", fmt.Errorf("generate refresh token: %v", err)
+	}
+	now := time.Now()
+	s.refreshTokens = append(s.refreshTokens, &memRefreshToken{Id: s.nextId("refresh_tokens"), UserId: userId,
+		FamilyId: familyId, TokenHash: hashRefreshToken(token), CreatedAt: now, ExpiresAt: now.Add(ttl)})
+	return token, nil
+}
+
+func (s *memStore) NewRefreshTokenFamily(userId int64, ttl time.Duration) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	familyId, err := randomToken(16)
+	if err != nil {
+		return "", fmt.Errorf("generate token family id: %v", err)
+	}
+	return s.insertRefreshToken(userId, familyId, ttl)
+}
+
+func (s *memStore) RotateRefreshToken(token string, ttl time.Duration) (userId int64, login string, newToken string, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var rt *memRefreshToken
+	var u *memUser
+	for _, t := range s.refreshTokens {
+		if t.TokenHash == hashRefreshToken(token) {
+			rt, u = t, s.user(t.UserId)
+		}
+	}
+	if rt == nil || u == nil || rt.RevokedAt != nil {
+		return 0, "", "", errRefreshTokenInvalid
+	}
+	now := time.Now()
+	if rt.UsedAt != nil {
+		for _, t := range s.refreshTokens {
+			if t.FamilyId == rt.FamilyId && t.RevokedAt == nil {
+				revokedAt := now
+				t.RevokedAt = &revokedAt
+			}
+		}
+		return 0, "", "", errRefreshTokenReused
+	}
+	if !now.Before(rt.ExpiresAt) {
+		return 0, "", "", errRefreshTokenInvalid
+	}
+	if newToken, err = s.insertRefreshToken(u.Id, rt.FamilyId, ttl); err != nil {
+		return 0, "", "", fmt.Errorf("insert refresh token: %v", err)
+	}
+	rt.UsedAt = &now
+	return u.Id, u.Login, newToken, nil
+}
+
+func (s *memStore) RevokeRefreshTokenFamily(userId int64, token string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	families := make(map[string]bool)
+	for _, t := range s.refreshTokens {
+		if t.TokenHash == hashRefreshToken(token) {
+			families[t.FamilyId] = true
+		}
+	}
+	now := time.Now()
+	for _, t := range s.refreshTokens {
+		if t.RevokedAt == nil && t.UserId == userId && families[t.FamilyId] {
+			t.RevokedAt = &now
+		}
+	}
+	return nil
+}
+
+func (s *memStore) RevokeUserRefreshTokens(userId int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	for _, t := range s.refreshTokens {
+		if t.UserId == userId && t.RevokedAt == nil {
+			t.RevokedAt = &now
+		}
+	}
+	return nil
+}
+
+func (s *memStore) InsertRevokedToken(jti string, userId int64, expiresAt time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, t := range s.revokedTokens {
+		if t.Jti == jti {
+			return nil
+		}
+	}
+	s.revokedTokens = append(s.revokedTokens, &memRevokedToken{Jti: jti, UserId: userId, ExpiresAt: expiresAt})
+	return nil
+}
+
+func (s *memStore) UpsertUserTokenRevocation(userId int64, revokedBefore time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, r := range s.userRevocations {
+		if r.UserId == userId {
+			r.RevokedBefore = revokedBefore
+			return nil
+		}
+	}
+	s.userRevocations = append(s.userRevocations, &memUserRevocation{UserId: userId, RevokedBefore: revokedBefore})
+	return nil
+}
+
+func (s *memStore) DeleteOutdatedRevocations(now, revokedBefore time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var tokens []*memRevokedToken
+	for _, t := range s.revokedTokens {
+		if !t.ExpiresAt.Before(now) {
+			tokens = append(tokens, t)
+		}
+	}
+	s.revokedTokens = tokens
+	var users []*memUserRevocation
+	for _, r := range s.userRevocations {
+		if !r.RevokedBefore.Before(revokedBefore) {
+			users = append(users, r)
+		}
+	}
+	s.userRevocations = users
+	return nil
+}
+
+func (s *memStore) SelectRevocations() (map[string]time.Time, map[int64]time.Time, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	tokens := make(map[string]time.Time)
+	for _, t := range s.revokedTokens {
+		tokens[t.Jti] = t.ExpiresAt
+	}
+	revokedBefore := make(map[int64]time.Time)
+	for _, r := range s.userRevocations {
+		revokedBefore[r.UserId] = r.RevokedBefore
+	}
+	return tokens, revokedBefore, nil
+}
+
+func (s *memStore) replaceRecordTags(recordId int64, tags []string) {
+	var rest []*memRecordTag
+	for _, t := range s.recordTags {
+		if t.RecordId != recordId {
+			rest = append(rest, t)
+		}
+	}
+	for _, tag := range tags {
+		rest = append(rest, &memRecordTag{RecordId: recordId, Tag: tag})
+	}
+	s.recordTags = rest
+}
+
+func (s *memStore) recordTagsOf(recordId int64) []string {
+	tags := []string{}
+	for _, t := range s.recordTags {
+		if t.RecordId == recordId {
+			tags = append(tags, t.Tag)
+		}
+	}
+	sort.Strings(tags)
+	return tags
+}
+
+// Search config is ignored: text is always searched as with 'simple' config
+func (s *memStore) InsertRecord(rec *recordInfo, searchConfig string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	seen := make(map[string]bool)
+	for _, tag := range rec.Tags {
+		if seen[tag] {
+			return fmt.Errorf("insert tags: duplicate tag %q", tag)
+		}
+		seen[tag] = true
+	}
+	var u *memUpload
+	if rec.UploadId != "" {
+		if u = s.upload(rec.UploadId); u == nil || u.RecordId != nil {
+			return fmt.Errorf("upload %s already has record", rec.UploadId)
+		}
+	}
+	rec.Id = s.nextId("records")
+	if u != nil {
+		recordId := rec.Id
+		u.RecordId = &recordId
+	}
+	rec.CreatedAt = time.Now()
+	s.records = append(s.records, &memRecord{
+		Id:          rec.Id,
+		Name:        rec.Name,
+		OwnerId:     rec.OwnerId,
+		Size:        rec.Size,
+		CreatedAt:   rec.CreatedAt,
+		Description: rec.Description,
+		ContentType: rec.ContentType,
+		StorageKey:  stringPtr(rec.StorageKey),
+		Checksum:    stringPtr(rec.Checksum),
+		Duration:    rec.Duration,
+		Codec:       rec.Codec,
+		SampleRate:  int64(rec.SampleRate),
+		Channels:    int64(rec.Channels),
+		Bitrate:     int64(rec.Bitrate),
+	})
+	s.replaceRecordTags(rec.Id, rec.Tags)
+	return nil
+}
+
+func (s *memStore) SelectRecord(recordId int64, userId int64) (*recordInfo, error) {
+	rec, _, err := s.SelectRecordContent(recordId, userId)
+	return rec, err
+}
+
+func (s *memStore) SelectRecordContent(recordId int64, userId int64) (*recordInfo, []byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	rec := s.record(recordId)
+	if rec == nil || !s.recordVisibleTo(rec, userId) {
+		return nil, nil, sql.ErrNoRows
+	}
+	info := rec.info()
+	info.Permission = s.recordPermission(rec, userId)
+	return info, rec.inlineContent(), nil
+}
+
+func (s *memStore) SelectLinkedRecordContent(recordId int64) (*recordInfo, []byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	rec := s.record(recordId)
+	if rec == nil {
+		return nil, nil, sql.ErrNoRows
+	}
+	return rec.info(), rec.inlineContent(), nil
+}
+
+func (s *memStore) SelectRecordTags(recordId int64) ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.recordTagsOf(recordId), nil
+}
+
+func (s *memStore) UpdateRecord(recordId int64, name, description *string, tags []string, searchConfig string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	rec := s.record(recordId)
+	if rec == nil {
+		return nil
+	}
+	if name != nil {
+		rec.Name = *name
+	}
+	if description != nil {
+		rec.Description = *description
+	}
+	if tags != nil {
+		s.replaceRecordTags(recordId, tags)
+	}
+	return nil
+}
+
+func (s *memStore) DeleteRecord(recordId int64) (storageKey string, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	rec := s.record(recordId)
+	if rec == nil {
+		return "", sql.ErrNoRows
+	}
+	var shared []*memSharing
+	for _, sh := range s.shared {
+		if sh.RecordId != recordId {
+			shared = append(shared, sh)
+		}
+	}
+	s.shared = shared
+	var groupShares []*memGroupSharing
+	for _, g := range s.groupShares {
+		if g.RecordId != recordId {
+			groupShares = append(groupShares, g)
+		}
+	}
+	s.groupShares = groupShares
+	s.replaceRecordTags(recordId, nil)
+	var links []*memShareLink
+	for _, l := range s.shareLinks {
+		if l.RecordId != recordId {
+			links = append(links, l)
+		}
+	}
+	s.shareLinks = links
+	var invitations []*memInvitation
+	for _, inv := range s.invitations {
+		if inv.RecordId != recordId {
+			invitations = append(invitations, inv)
+		}
+	}
+	s.invitations = invitations
+	var records []*memRecord
+	for _, r := range s.records {
+		if r.Id != recordId {
+			records = append(records, r)
+		}
+	}
+	s.records = records
+	if rec.StorageKey != nil {
+		storageKey = *rec.StorageKey
+	}
+	return storageKey, nil
+}
+
+func (f *recordsFilter) matches(rec *memRecord, userId int64) bool {
+	switch {
+	case f.scope == "mine" && rec.OwnerId != userId,
+		f.scope == "shared" && rec.OwnerId == userId,
+		f.ownerId != 0 && rec.OwnerId != f.ownerId,
+		!f.createdFrom.IsZero() && rec.CreatedAt.Before(f.createdFrom),
+		!f.createdTo.IsZero() && rec.CreatedAt.After(f.createdTo),
+		f.durationMin > 0 && rec.Duration < f.durationMin,
+		f.durationMax > 0 && rec.Duration > f.durationMax,
+		f.search != "" && !strings.Contains(strings.ToLower(rec.Name), strings.ToLower(f.search)):
+		return false
+	}
+	return true
+}
+
+func (s *memStore) ListRecords(userId int64, filter *recordsFilter, sortBy string, order *keysetOrder,
+	page *pageRequest) ([]*listedRecord, int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var visible []*listedRecord
+	var keys [][]interface{}
+	for _, rec := range s.records {
+		owner := s.user(rec.OwnerId)
+		if owner == nil || !s.recordVisibleTo(rec, userId) || !filter.matches(rec, userId) {
+			continue
+		}
+		listed := &listedRecord{
+			Id:         rec.Id,
+			Name:       rec.Name,
+			IsOwner:    rec.OwnerId == userId,
+			OwnerId:    rec.OwnerId,
+			OwnerName:  owner.Name,
+			Size:       rec.Size,
+			Duration:   rec.Duration,
+			Codec:      rec.Codec,
+			SampleRate: int(rec.SampleRate),
+			Channels:   int(rec.Channels),
+			Bitrate:    int(rec.Bitrate),
+			CreatedAt:  rec.CreatedAt,
+			SharedTo:   []sharedTo{},
+		}
+		visible = append(visible, listed)
+		keys = append(keys, listed.key(sortBy))
+	}
+	recs := []*listedRecord{}
+	for _, i := range page.selectKeys(keys, order) {
+		recs = append(recs, visible[i])
+	}
+	return recs, int64(len(visible)), nil
+}
+
+func (s *memStore) SelectSharedTo(recs []*listedRecord) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, rec := range recs {
+		var users, groups []sharedTo
+		for _, sh := range s.shared {
+			if u := s.user(sh.To); sh.RecordId == rec.Id && u != nil {
+				users = append(users, sharedTo{Type: "user", Id: u.Id, Name: u.Name,
+					Permission: parsePermission(sh.Permission), Status: sh.Status})
+			}
+		}
+		for _, gs := range s.groupShares {
+			for _, g := range s.groups {
+				if gs.RecordId == rec.Id && g.Id == gs.GroupId {
+					groups = append(groups, sharedTo{Type: "group", Id: g.Id, Name: g.Name,
+						Permission: parsePermission(gs.Permission)})
+				}
+			}
+		}
+		sort.Slice(users, func(i, j int) bool { return users[i].Id < users[j].Id })
+		sort.Slice(groups, func(i, j int) bool { return groups[i].Id < groups[j].Id })
+		rec.SharedTo = append(append(rec.SharedTo, users...), groups...)
+	}
+	return nil
+}
+
+// Search config is ignored: text is always searched as with 'simple' config
+func (s *memStore) SearchRecords(userId int64, text, searchConfig string, page *pageRequest) ([]*searchResult, int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	query := parseTextQuery(text)
+	if query.empty() {
+		return []*searchResult{}, 0, nil
+	}
+	var matches []*searchResult
+	for _, rec := range s.records {
+		owner := s.user(rec.OwnerId)
+		if owner == nil || !s.recordVisibleTo(rec, userId) {
+			continue
+		}
+		res := &searchResult{recordInfo: rec.info(), OwnerName: owner.Name}
+		res.Permission = s.recordPermission(rec, userId)
+		if query.match(res, strings.Join(s.recordTagsOf(rec.Id), " ")) {
+			matches = append(matches, res)
+		}
+	}
+	results, total := pageSearchResults(matches, page)
+	return results, total, nil
+}
+
+func (s *memStore) SelectInlineContentRecords(afterId int64, limit int) ([]int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var ids []int64
+	for _, rec := range s.records {
+		if rec.Id > afterId && rec.StorageKey == nil && rec.Content != nil {
+			ids = append(ids, rec.Id)
+		}
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	if len(ids) > limit {
+		ids = ids[:limit]
+	}
+	return ids, nil
+}
+
+func (s *memStore) SelectInlineContent(recordId int64) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	rec := s.record(recordId)
+	if rec == nil || rec.StorageKey != nil || rec.Content == nil {
+		return nil, sql.ErrNoRows
+	}
+	return rec.inlineContent(), nil
+}
+
+func (s *memStore) UpdateRecordStorage(recordId int64, storageKey string, size int64, checksum string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	rec := s.record(recordId)
+	if rec == nil || rec.StorageKey != nil {
+		return false, nil
+	}
+	rec.StorageKey, rec.Size, rec.Checksum, rec.Content = stringPtr(storageKey), size, stringPtr(checksum), nil
+	return true, nil
+}
+
+func (s *memStore) UpsertSharing(recordId, toUserId, byUserId int64, perm permission, isOwner bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sh := s.sharing(recordId, toUserId)
+	switch {
+	case sh == nil:
+		u := s.user(toUserId)
+		if u == nil {
+			return errNoSuchUser
+		}
+		status := sharePending
+		if u.AutoAcceptShares {
+			status = shareAccepted
+		}
+		s.shared = append(s.shared, &memSharing{RecordId: recordId, To: toUserId, Permission: perm.String(),
+			SharedBy: &byUserId, Status: status})
+	case !isOwner && (sh.SharedBy == nil || *sh.SharedBy != byUserId):
+		return errNotSharer
+	default:
+		sh.Permission = perm.String()
+	}
+	return nil
+}
+
+func (s *memStore) DeleteSharing(recordId, userId, toUserId int64) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	rec, sh := s.record(recordId), s.sharing(recordId, toUserId)
+	if rec == nil || sh == nil || rec.OwnerId != userId && (sh.SharedBy == nil || *sh.SharedBy != userId) {
+		return false, nil
+	}
+	var rest []*memSharing
+	for _, other := range s.shared {
+		if other != sh {
+			rest = append(rest, other)
+		}
+	}
+	s.shared = rest
+	return true, nil
+}
+
+func (s *memStore) DeleteGroupSharing(recordId, userId, groupId int64) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	rec := s.record(recordId)
+	if rec == nil {
+		return false, nil
+	}
+	deleted := false
+	var rest []*memGroupSharing
+	for _, g := range s.groupShares {
+		if g.RecordId == recordId && g.GroupId == groupId && (rec.OwnerId == userId || g.SharedBy == userId) {
+			deleted = true
+			continue
+		}
+		rest = append(rest, g)
+	}
+	s.groupShares = rest
+	return deleted, nil
+}
+
+// Page of users with numbers of records given by sharings accepted to keep, grouped by user
+// returned by userOf
+func (s *memStore) listSharingUsers(page *pageRequest, keep func(sh *memSharing, rec *memRecord) bool,
+	userOf func(sh *memSharing, rec *memRecord) int64) ([]sharingUser, int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	records := make(map[int64]map[int64]bool)
+	for _, sh := range s.shared {
+		rec := s.record(sh.RecordId)
+		if rec == nil || !keep(sh, rec) {
+			continue
+		}
+		id := userOf(sh, rec)
+		if s.user(id) == nil {
+			continue
+		}
+		if records[id] == nil {
+			records[id] = make(map[int64]bool)
+		}
+		records[id][rec.Id] = true
+	}
+	var all []sharingUser
+	var keys [][]interface{}
+	for id, recs := range records {
+		all = append(all, sharingUser{Id: id, Name: s.user(id).Name, SharedRecords: int64(len(recs))})
+		keys = append(keys, []interface{}{id})
+	}
+	users := []sharingUser{}
+	for _, i := range page.selectKeys(keys, sharingUsersOrder) {
+		users = append(users, all[i])
+	}
+	return users, int64(len(all)), nil
+}
+
+// User who made sharing: owner or resharer of record
+func (sh *memSharing) sharer(rec *memRecord) int64 {
+	if sh.SharedBy != nil {
+		return *sh.SharedBy
+	}
+	return rec.OwnerId
+}
+
+func (s *memStore) ListSharers(userId int64, page *pageRequest) ([]sharingUser, int64, error) {
+	return s.listSharingUsers(page, func(sh *memSharing, rec *memRecord) bool {
+		return sh.To == userId && sh.Status == shareAccepted
+	}, func(sh *memSharing, rec *memRecord) int64 {
+		return sh.sharer(rec)
+	})
+}
+
+func (s *memStore) ListRecipients(userId int64, page *pageRequest) ([]sharingUser, int64, error) {
+	return s.listSharingUsers(page, func(sh *memSharing, rec *memRecord) bool {
+		return sh.sharer(rec) == userId && sh.Status == shareAccepted
+	}, func(sh *memSharing, rec *memRecord) int64 {
+		return sh.To
+	})
+}
+
+func (s *memStore) ListSharerRecords(sharerId, userId int64, page *pageRequest) ([]*recordInfo, int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var shared []*recordInfo
+	var keys [][]interface{}
+	for _, sh := range s.shared {
+		rec := s.record(sh.RecordId)
+		if rec == nil || sh.sharer(rec) != sharerId || sh.To != userId || sh.Status != shareAccepted {
+			continue
+		}
+		shared = append(shared, rec.info())
+		keys = append(keys, []interface{}{rec.CreatedAt, rec.Id})
+	}
+	recs := []*recordInfo{}
+	for _, i := range page.selectKeys(keys, sharerRecordsOrder) {
+		recs = append(recs, shared[i])
+	}
+	return recs, int64(len(shared)), nil
+}
+
+func (s *memStore) ListIncomingShares(userId int64, status string, page *pageRequest) ([]*incomingShare, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var all []*incomingShare
+	var keys [][]interface{}
+	for _, sh := range s.shared {
+		rec := s.record(sh.RecordId)
+		if sh.To != userId || sh.Status != status || rec == nil {
+			continue
+		}
+		owner := s.user(rec.OwnerId)
+		if owner == nil {
+			continue
+		}
+		in := &incomingShare{RecordId: rec.Id, RecordName: rec.Name, OwnerId: owner.Id, OwnerName: owner.Name,
+			SharedById: owner.Id, SharedByName: owner.Name, Permission: parsePermission(sh.Permission),
+			Status: sh.Status}
+		if sh.SharedBy != nil {
+			in.SharedById = *sh.SharedBy
+			if by := s.user(*sh.SharedBy); by != nil {
+				in.SharedByName = by.Name
+			}
+		}
+		all = append(all, in)
+		keys = append(keys, []interface{}{sh.RecordId})
+	}
+	shares := []*incomingShare{}
+	for _, i := range page.selectKeys(keys, incomingSharesOrder) {
+		shares = append(shares, all[i])
+	}
+	return shares, nil
+}
+
+func (s *memStore) UpdateShareStatus(recordId, userId int64, status string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sh := s.sharing(recordId, userId)
+	if sh == nil {
+		return false, nil
+	}
+	sh.Status = status
+	return true, nil
+}
+
+func (l *memShareLink) info() *shareLink {
+	info := &shareLink{
+		Id:         l.Id,
+		RecordId:   l.RecordId,
+		Permission: parsePermission(l.Permission),
+		CreatedBy:  l.CreatedBy,
+		CreatedAt:  l.CreatedAt,
+		MaxUses:    int(l.MaxUses),
+		Uses:       int(l.Uses),
+	}
+	if l.ExpiresAt != nil {
+		expiresAt := *l.ExpiresAt
+		info.ExpiresAt = &expiresAt
+	}
+	if l.RevokedAt != nil {
+		revokedAt := *l.RevokedAt
+		info.RevokedAt = &revokedAt
+	}
+	if l.PasswordHash != nil {
+		info.PasswordHash = *l.PasswordHash
+		info.PasswordRequired = true
+	}
+	return info
+}
+
+func (s *memStore) shareLink(linkId string) *memShareLink {
+	for _, l := range s.shareLinks {
+		if l.Id == linkId {
+			return l
+		}
+	}
+	return nil
+}
+
+func (s *memStore) InsertShareLink(l *shareLink) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.shareLink(l.Id) != nil {
+		return fmt.Errorf("duplicate key value violates unique constraint \"share_links_pkey\"")
+	}
+	l.CreatedAt = time.Now()
+	row := &memShareLink{Id: l.Id, RecordId: l.RecordId, Permission: l.Permission.String(), CreatedBy: l.CreatedBy,
+		CreatedAt: l.CreatedAt, MaxUses: int64(l.MaxUses)}
+	if l.ExpiresAt != nil {
+		expiresAt := *l.ExpiresAt
+		row.ExpiresAt = &expiresAt
+	}
+	if l.PasswordHash != "" {
+		row.PasswordHash = stringPtr(l.PasswordHash)
+	}
+	s.shareLinks = append(s.shareLinks, row)
+	return nil
+}
+
+func (s *memStore) SelectShareLinks(recordId int64) ([]*shareLink, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	links := []*shareLink{}
+	for _, l := range s.shareLinks {
+		if l.RecordId == recordId {
+			links = append(links, l.info())
+		}
+	}
+	sort.Slice(links, func(i, j int) bool {
+		if !links[i].CreatedAt.Equal(links[j].CreatedAt) {
+			return links[i].CreatedAt.After(links[j].CreatedAt)
+		}
+		return links[i].Id < links[j].Id
+	})
+	return links, nil
+}
+
+func (s *memStore) SelectShareLink(linkId string) (*shareLink, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	l := s.shareLink(linkId)
+	if l == nil {
+		return nil, sql.ErrNoRows
+	}
+	return l.info(), nil
+}
+
+func (s *memStore) UseShareLink(linkId string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	l := s.shareLink(linkId)
+	if l == nil || l.RevokedAt != nil || l.ExpiresAt != nil && !l.ExpiresAt.After(time.Now()) ||
+		l.MaxUses != 0 && l.Uses >= l.MaxUses {
+		return false, nil
+	}
+	l.Uses++
+	return true, nil
+}
+
+func (s *memStore) RevokeShareLink(recordId int64, linkId string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	l := s.shareLink(linkId)
+	if l == nil || l.RecordId != recordId || l.RevokedAt != nil {
+		return false, nil
+	}
+	now := time.Now()
+	l.RevokedAt = &now
+	return true, nil
+}
+
+func (s *memStore) UpsertInvitation(recordId int64, email string, perm permission, invitedBy int64,
+	ttl time.Duration) (string, error) {
+	token, err := randomToken(32)
+	if err != nil {
+		return "", fmt.Errorf("generate invitation token: %v", err)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var rest []*memInvitation
+	for _, inv := range s.invitations {
+		if inv.RecordId != recordId || !strings.EqualFold(inv.Email, email) {
+			rest = append(rest, inv)
+		}
+	}
+	now := time.Now()
+	s.invitations = append(rest, &memInvitation{RecordId: recordId, Email: email, Permission: perm.String(),
+		InvitedBy: invitedBy, TokenHash: hashRefreshToken(token), CreatedAt: now, ExpiresAt: now.Add(ttl)})
+	return token, nil
+}
+
+func (s *memStore) group(groupId int64) *memGroup {
+	for _, g := range s.groups {
+		if g.Id == groupId {
+			return g
+		}
+	}
+	return nil
+}
+
+func (s *memStore) InsertGroup(name string, ownerId int64) (*groupInfo, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	g := &groupInfo{Id: s.nextId("user_groups"), Name: name, CreatedAt: time.Now().UTC(), Role: groupRoleOwner,
+		Status: shareAccepted}
+	s.groups = append(s.groups, &memGroup{Id: g.Id, Name: name, CreatedBy: ownerId, CreatedAt: g.CreatedAt})
+	s.groupMembers = append(s.groupMembers, &memGroupMember{GroupId: g.Id, UserId: ownerId, Role: groupRoleOwner,
+		AddedAt: g.CreatedAt, Status: shareAccepted})
+	return g, nil
+}
+
+func (s *memStore) SelectGroup(groupId, userId int64) (*groupInfo, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	g, m := s.group(groupId), s.groupMember(groupId, userId)
+	if g == nil || m == nil || m.Status != shareAccepted {
+		return nil, sql.ErrNoRows
+	}
+	return &groupInfo{Id: g.Id, Name: g.Name, CreatedAt: g.CreatedAt, Role: m.Role, Status: m.Status}, nil
+}
+
+func (s *memStore) SelectGroups(userId int64) ([]*groupInfo, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	groups := []*groupInfo{}
+	for _, m := range s.groupMembers {
+		if g := s.group(m.GroupId); m.UserId == userId && g != nil {
+			groups = append(groups, &groupInfo{Id: g.Id, Name: g.Name, CreatedAt: g.CreatedAt, Role: m.Role,
+				Status: m.Status})
+		}
+	}
+	sort.Slice(groups, func(i, j int) bool {
+		if groups[i].Name != groups[j].Name {
+			return groups[i].Name < groups[j].Name
+		}
+		return groups[i].Id < groups[j].Id
+	})
+	return groups, nil
+}
+
+func (s *memStore) SelectGroupMembers(groupId int64) ([]groupMember, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	members := []groupMember{}
+	for _, m := range s.groupMembers {
+		if u := s.user(m.UserId); m.GroupId == groupId && u != nil {
+			members = append(members, groupMember{Id: u.Id, Login: u.Login, Name: u.Name, Role: m.Role,
+				Status: m.Status})
+		}
+	}
+	sort.Slice(members, func(i, j int) bool { return members[i].Id < members[j].Id })
+	return members, nil
+}
+
+func (s *memStore) RenameGroup(groupId int64, name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if g := s.group(groupId); g != nil {
+		g.Name = name
+	}
+	return nil
+}
+
+func (s *memStore) countOtherGroupOwners(groupId, userId int64) int {
+	owners := 0
+	for _, m := range s.groupMembers {
+		if m.GroupId == groupId && m.Role == groupRoleOwner && m.UserId != userId && m.Status == shareAccepted {
+			owners++
+		}
+	}
+	return owners
+}
+
+func (s *memStore) UpsertGroupMember(groupId, userId int64, role string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	m := s.groupMember(groupId, userId)
+	switch {
+	case m == nil:
+		u := s.user(userId)
+		if u == nil {
+			return errNoSuchUser
+		}
+		status := sharePending
+		if u.AutoAcceptShares {
+			status = shareAccepted
+		}
+		s.groupMembers = append(s.groupMembers, &memGroupMember{GroupId: groupId, UserId: userId, Role: role,
+			AddedAt: time.Now(), Status: status})
+	case m.Role == role:
+	case m.Role == groupRoleOwner && s.countOtherGroupOwners(groupId, userId) == 0:
+		return errLastGroupOwner
+	default:
+		m.Role = role
+	}
+	return nil
+}
+
+func (s *memStore) DeleteGroupMember(groupId, userId int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	m := s.groupMember(groupId, userId)
+	if m == nil {
+		return sql.ErrNoRows
+	}
+	if m.Role == groupRoleOwner && s.countOtherGroupOwners(groupId, userId) == 0 {
+		return errLastGroupOwner
+	}
+	var rest []*memGroupMember
+	for _, other := range s.groupMembers {
+		if other != m {
+			rest = append(rest, other)
+		}
+	}
+	s.groupMembers = rest
+	return nil
+}
+
+func (s *memStore) AcceptGroupMembership(groupId, userId int64) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	m := s.groupMember(groupId, userId)
+	if m == nil || m.Status != sharePending {
+		return false, nil
+	}
+	m.Status = shareAccepted
+	return true, nil
+}
+
+func (s *memStore) DeclineGroupMembership(groupId, userId int64) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	m := s.groupMember(groupId, userId)
+	if m == nil || m.Status != sharePending {
+		return false, nil
+	}
+	var rest []*memGroupMember
+	for _, other := range s.groupMembers {
+		if other != m {
+			rest = append(rest, other)
+		}
+	}
+	s.groupMembers = rest
+	return true, nil
+}
+
+func (s *memStore) DeleteGroup(groupId int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var shares []*memGroupSharing
+	for _, g := range s.groupShares {
+		if g.GroupId != groupId {
+			shares = append(shares, g)
+		}
+	}
+	s.groupShares = shares
+	var members []*memGroupMember
+	for _, m := range s.groupMembers {
+		if m.GroupId != groupId {
+			members = append(members, m)
+		}
+	}
+	s.groupMembers = members
+	var groups []*memGroup
+	for _, g := range s.groups {
+		if g.Id != groupId {
+			groups = append(groups, g)
+		}
+	}
+	s.groups = groups
+	return nil
+}
+
+func (s *memStore) UpsertGroupSharing(recordId, groupId, byUserId int64, perm permission, isOwner bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, g := range s.groupShares {
+		if g.RecordId != recordId || g.GroupId != groupId {
+			continue
+		}
+		if !isOwner && g.SharedBy != byUserId {
+			return errNotSharer
+		}
+		g.Permission = perm.String()
+		return nil
+	}
+	s.groupShares = append(s.groupShares, &memGroupSharing{RecordId: recordId, GroupId: groupId,
+		Permission: perm.String(), SharedBy: byUserId, CreatedAt: time.Now()})
+	return nil
+}
+
+func (s *memStore) upload(id string) *memUpload {
+	for _, u := range s.uploads {
+		if u.Id == id {
+			return u
+		}
+	}
+	return nil
+}
+
+func (s *memStore) InsertUpload(u *upload) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.upload(u.Id) != nil {
+		return fmt.Errorf("duplicate key value violates unique constraint \"uploads_pkey\"")
+	}
+	s.uploads = append(s.uploads, &memUpload{Id: u.Id, OwnerId: u.OwnerId, Length: u.Length, Metadata: u.Metadata,
+		ExpiresAt: u.ExpiresAt})
+	return nil
+}
+
+func (s *memStore) SelectUpload(id string, ownerId int64) (*upload, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	u := s.upload(id)
+	if u == nil || u.OwnerId != ownerId {
+		return nil, sql.ErrNoRows
+	}
+	res := &upload{Id: u.Id, OwnerId: u.OwnerId, Length: u.Length, Offset: u.Offset, Metadata: u.Metadata,
+		ExpiresAt: u.ExpiresAt}
+	if u.RecordId != nil {
+		res.RecordId = sql.NullInt64{Int64: *u.RecordId, Valid: true}
+	}
+	return res, nil
+}
+
+func (s *memStore) UpdateUploadOffset(id string, oldOffset, newOffset int64) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	u := s.upload(id)
+	if u == nil || u.Offset != oldOffset {
+		return false, nil
+	}
+	u.Offset = newOffset
+	return true, nil
+}
+
+func (s *memStore) DeleteUpload(id string, ownerId int64) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	u := s.upload(id)
+	if u == nil || u.OwnerId != ownerId {
+		return false, nil
+	}
+	var rest []*memUpload
+	for _, other := range s.uploads {
+		if other != u {
+			rest = append(rest, other)
+		}
+	}
+	s.uploads = rest
+	return true, nil
+}
+
+func (s *memStore) DeleteExpiredUploads(now time.Time) ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var ids []string
+	var rest []*memUpload
+	for _, u := range s.uploads {
+		if u.ExpiresAt.Before(now) {
+			ids = append(ids, u.Id)
+			continue
+		}
+		rest = append(rest, u)
+	}
+	s.uploads = rest
+	return ids, nil
+}
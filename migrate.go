@@ -0,0 +1,306 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"fmt"
+	"io/fs"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// Schema migrations: pairs of files NNNN_name.up.sql and NNNN_name.down.sql numbered one after
+// another from 0001. Applied versions are tracked in 'schema_migrations' table. SQLite has its own
+// migrations in 'sqlite' subdirectory, which must give the same schema except for search vectors.
+//
+//go:embed migrations/*.sql migrations/sqlite/*.sql
+var migrationsFS embed.FS
+
+// Key of advisory lock held while migrations are applied, so that instances started at the same
+// time do not apply them concurrently
+const migrationsLockKey = 0x617564796f73
+
+var migrationFileRe = regexp.MustCompile(`^(\d+)_(\w+)\.(up|down)\.sql$`)
+
+type migration struct {
+	version int64
+	name    string
+	up      string
+	down    string
+}
+
+func (m *migration) String() string {
+	return fmt.Sprintf("%04d_%s", m.version, m.name)
+}
+
+// Load migrations from directory sorted by version
+func loadMigrations(fsys fs.FS, dir string) ([]*migration, error) {
+	entries, err := fs.ReadDir(fsys, dir)
+	if err != nil {
+		return nil, err
+	}
+	byVersion := make(map[int64]*migration)
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		match := migrationFileRe.FindStringSubmatch(entry.Name())
+		if match == nil {
+			return nil, fmt.Errorf("unexpected migration file %q", entry.Name())
+		}
+		version, err := strconv.ParseInt(match[1], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("parse version of migration file %q: %v", entry.Name(), err)
+		}
+		content, err := fs.ReadFile(fsys, path.Join(dir, entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+		m, ok := byVersion[version]
+		if !ok {
+			m = &migration{version: version, name: match[2]}
+			byVersion[version] = m
+		}
+		if m.name != match[2] {
+			return nil, fmt.Errorf("migration %d is named both %q and %q", version, m.name, match[2])
+		}
+		if match[3] == "up" {
+			m.up = string(content)
+		} else {
+			m.down = string(content)
+		}
+	}
+	migrations := make([]*migration, 0, len(byVersion))
+	for _, m := range byVersion {
+		migrations = append(migrations, m)
+	}
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].version < migrations[j].version })
+	for i, m := range migrations {
+		if m.version != int64(i+1) {
+			return nil, fmt.Errorf("migration %d is missing", i+1)
+		}
+		if m.up == "" || m.down == "" {
+			return nil, fmt.Errorf("migration %s must have both up and down files", m)
+		}
+	}
+	return migrations, nil
+}
+
+type migrator struct {
+	db         *sqlDB
+	migrations []*migration
+}
+
+func newMigrator(db *sqlDB) (*migrator, error) {
+	dir := "migrations"
+	if db.database == databaseSQLite {
+		dir = "migrations/sqlite"
+	}
+	migrations, err := loadMigrations(migrationsFS, dir)
+	if err != nil {
+		return nil, fmt.Errorf("load migrations: %v", err)
+	}
+	return &migrator{db: db, migrations: migrations}, nil
+}
+
+// Run f on connection holding migrations lock, making sure 'schema_migrations' table exists.
+// Advisory locks belong to session, so all statements are run on the same connection. SQLite has
+// no advisory locks, but each migration is applied in transaction locking the whole database.
+func (m *migrator) withLock(ctx context.Context, f func(conn *sql.Conn) error) error {
+	conn, err := m.db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	timestampType := "TIMESTAMP"
+	if m.db.database != databaseSQLite {
+		timestampType = "TIMESTAMPTZ"
+		if _, err := conn.ExecContext(ctx, "SELECT pg_advisory_lock($1);", migrationsLockKey); err != nil {
+			return fmt.Errorf("lock migrations: %v", err)
+		}
+		defer func() {
+			if _, err := conn.ExecContext(context.Background(), "SELECT pg_advisory_unlock($1);",
+				migrationsLockKey); err != nil {
+				logE.Printf("unlock migrations: %v", err)
+			}
+		}()
+	}
+	_, err = conn.ExecContext(ctx, `
+CREATE TABLE IF NOT EXISTS schema_migrations (
+    version    BIGINT PRIMARY KEY,
+    name       TEXT NOT NULL,
+    applied_at `+timestampType+` NOT NULL
+);
+`)
+	if err != nil {
+		return fmt.Errorf("create schema_migrations table: %v", err)
+	}
+	return f(conn)
+}
+
+// Select times migrations were applied at keyed by version
+func selectAppliedMigrations(ctx context.Context, conn *sql.Conn) (map[int64]time.Time, error) {
+	rows, err := conn.QueryContext(ctx, "SELECT version, applied_at FROM schema_migrations;")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	applied := make(map[int64]time.Time)
+	for rows.Next() {
+		var version int64
+		var appliedAt time.Time
+		if err := rows.Scan(&version, &appliedAt); err != nil {
+			return nil, err
+		}
+		applied[version] = appliedAt
+	}
+	return applied, rows.Err()
+}
+
+// Run migration script and record the change of version in one transaction
+func runMigration(ctx context.Context, conn *sql.Conn, m *migration, up bool) error {
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	script := m.down
+	if up {
+		script = m.up
+	}
+	if _, err := tx.ExecContext(ctx, script); err != nil {
+		return err
+	}
+	if up {
+		_, err = tx.ExecContext(ctx, "INSERT INTO schema_migrations(version, name, applied_at) VALUES($1,$2,$3);",
+			m.version, m.name, time.Now())
+	} else {
+		_, err = tx.ExecContext(ctx, "DELETE FROM schema_migrations WHERE version=$1;", m.version)
+	}
+	if err != nil {
+		return fmt.Errorf("update schema_migrations: %v", err)
+	}
+	return tx.Commit()
+}
+
+// Apply all pending migrations, returning the applied ones
+func (m *migrator) up(ctx context.Context) ([]*migration, error) {
+	var done []*migration
+	err := m.withLock(ctx, func(conn *sql.Conn) error {
+		applied, err := selectAppliedMigrations(ctx, conn)
+		if err != nil {
+			return fmt.Errorf("select applied migrations: %v", err)
+		}
+		for _, mig := range m.migrations {
+			if _, ok := applied[mig.version]; ok {
+				continue
+			}
+			if err := runMigration(ctx, conn, mig, true); err != nil {
+				return fmt.Errorf("apply migration %s: %v", mig, err)
+			}
+			done = append(done, mig)
+		}
+		return nil
+	})
+	return done, err
+}
+
+// Revert given number of the latest applied migrations, returning the reverted ones
+func (m *migrator) down(ctx context.Context, steps int) ([]*migration, error) {
+	var done []*migration
+	err := m.withLock(ctx, func(conn *sql.Conn) error {
+		applied, err := selectAppliedMigrations(ctx, conn)
+		if err != nil {
+			return fmt.Errorf("select applied migrations: %v", err)
+		}
+		for i := len(m.migrations) - 1; i >= 0 && len(done) < steps; i-- {
+			mig := m.migrations[i]
+			if _, ok := applied[mig.version]; !ok {
+				continue
+			}
+			if err := runMigration(ctx, conn, mig, false); err != nil {
+				return fmt.Errorf("revert migration %s: %v", mig, err)
+			}
+			done = append(done, mig)
+		}
+		return nil
+	})
+	return done, err
+}
+
+type migrationStatus struct {
+	migration *migration
+	// Nil for pending migrations
+	appliedAt *time.Time
+}
+
+func (m *migrator) status(ctx context.Context) ([]migrationStatus, error) {
+	var statuses []migrationStatus
+	err := m.withLock(ctx, func(conn *sql.Conn) error {
+		applied, err := selectAppliedMigrations(ctx, conn)
+		if err != nil {
+			return fmt.Errorf("select applied migrations: %v", err)
+		}
+		for _, mig := range m.migrations {
+			s := migrationStatus{migration: mig}
+			if appliedAt, ok := applied[mig.version]; ok {
+				s.appliedAt = &appliedAt
+			}
+			statuses = append(statuses, s)
+		}
+		return nil
+	})
+	return statuses, err
+}
+
+// Run "migrate up", "migrate down [steps]" or "migrate status" command
+func runMigrateCommand(ctx context.Context, db *sqlDB, args []string) error {
+	m, err := newMigrator(db)
+	if err != nil {
+		return err
+	}
+	if len(args) == 0 {
+		return fmt.Errorf("expected up, down or status")
+	}
+	switch args[0] {
+	case "up":
+		applied, err := m.up(ctx)
+		for _, mig := range applied {
+			logI.Printf("applied migration %s", mig)
+		}
+		if err == nil && len(applied) == 0 {
+			logI.Print("schema is up to date")
+		}
+		return err
+	case "down":
+		steps := 1
+		if len(args) > 1 {
+			if steps, err = strconv.Atoi(args[1]); err != nil || steps < 1 {
+				return fmt.Errorf("invalid number of migrations to revert: %q", args[1])
+			}
+		}
+		reverted, err := m.down(ctx, steps)
+		for _, mig := range reverted {
+			logI.Printf("reverted migration %s", mig)
+		}
+		return err
+	case "status":
+		statuses, err := m.status(ctx)
+		if err != nil {
+			return err
+		}
+		for _, s := range statuses {
+			state := "pending"
+			if s.appliedAt != nil {
+				state = "applied at " + s.appliedAt.Format(time.RFC3339)
+			}
+			fmt.Printf("%s\t%s\n", s.migration, state)
+		}
+		return nil
+	}
+	return fmt.Errorf("unknown migrate command %q: expected up, down or status", args[0])
+}
@@ -0,0 +1,7 @@
+-- Tables of users, records and sharings may predate migrations and hold all the data, so they are
+-- never dropped by migrations
+DO $$
+BEGIN
+    RAISE EXCEPTION 'migration 0001 can not be reverted: tables users, records and shared would be dropped with all data';
+END
+$$;
@@ -0,0 +1,23 @@
+CREATE TABLE IF NOT EXISTS users (
+    id       BIGSERIAL PRIMARY KEY,
+    login    TEXT NOT NULL UNIQUE,
+    password TEXT NOT NULL,
+    name     TEXT NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS records (
+    id         BIGSERIAL PRIMARY KEY,
+    name       TEXT NOT NULL,
+    content    BYTEA,
+    owner_id   BIGINT NOT NULL,
+    size       BIGINT NOT NULL DEFAULT 0,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+CREATE INDEX IF NOT EXISTS records_owner_id_idx ON records(owner_id);
+
+CREATE TABLE IF NOT EXISTS shared (
+    record_id BIGINT NOT NULL,
+    "to"      BIGINT NOT NULL
+);
+CREATE UNIQUE INDEX IF NOT EXISTS shared_record_id_to_idx ON shared(record_id, "to");
+CREATE INDEX IF NOT EXISTS shared_to_idx ON shared("to");
@@ -0,0 +1,4 @@
+ALTER TABLE records DROP COLUMN IF EXISTS checksum;
+ALTER TABLE records DROP COLUMN IF EXISTS storage_key;
+ALTER TABLE records DROP COLUMN IF EXISTS content_type;
+ALTER TABLE records DROP COLUMN IF EXISTS description;
@@ -0,0 +1,4 @@
+ALTER TABLE records ADD COLUMN IF NOT EXISTS description TEXT NOT NULL DEFAULT '';
+ALTER TABLE records ADD COLUMN IF NOT EXISTS content_type TEXT NOT NULL DEFAULT 'application/octet-stream';
+ALTER TABLE records ADD COLUMN IF NOT EXISTS storage_key TEXT;
+ALTER TABLE records ADD COLUMN IF NOT EXISTS checksum TEXT;
@@ -0,0 +1,10 @@
+CREATE TABLE IF NOT EXISTS uploads (
+    id            TEXT PRIMARY KEY,
+    owner_id      BIGINT NOT NULL,
+    length        BIGINT NOT NULL,
+    upload_offset BIGINT NOT NULL DEFAULT 0,
+    metadata      TEXT NOT NULL DEFAULT '',
+    expires_at    TIMESTAMPTZ NOT NULL,
+    record_id     BIGINT
+);
+CREATE INDEX IF NOT EXISTS uploads_expires_at_idx ON uploads(expires_at);
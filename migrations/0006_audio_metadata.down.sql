@@ -0,0 +1,6 @@
+DROP INDEX IF EXISTS records_created_at_idx;
+ALTER TABLE records DROP COLUMN IF EXISTS bitrate;
+ALTER TABLE records DROP COLUMN IF EXISTS channels;
+ALTER TABLE records DROP COLUMN IF EXISTS sample_rate;
+ALTER TABLE records DROP COLUMN IF EXISTS codec;
+ALTER TABLE records DROP COLUMN IF EXISTS duration;
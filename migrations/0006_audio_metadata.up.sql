@@ -0,0 +1,9 @@
+ALTER TABLE records ADD COLUMN IF NOT EXISTS duration DOUBLE PRECISION NOT NULL DEFAULT 0;
+ALTER TABLE records ADD COLUMN IF NOT EXISTS codec TEXT NOT NULL DEFAULT '';
+ALTER TABLE records ADD COLUMN IF NOT EXISTS sample_rate INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE records ADD COLUMN IF NOT EXISTS channels INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE records ADD COLUMN IF NOT EXISTS bitrate INTEGER NOT NULL DEFAULT 0;
+-- Records tables created before migrations have no creation time, and 0001 does not add it to
+-- existing tables
+ALTER TABLE records ADD COLUMN IF NOT EXISTS created_at TIMESTAMPTZ NOT NULL DEFAULT now();
+CREATE INDEX IF NOT EXISTS records_created_at_idx ON records(created_at);
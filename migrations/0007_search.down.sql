@@ -0,0 +1,3 @@
+DROP INDEX IF EXISTS records_search_vector_idx;
+ALTER TABLE records DROP COLUMN IF EXISTS search_vector;
+DROP TABLE IF EXISTS record_tags;
@@ -0,0 +1,8 @@
+CREATE TABLE IF NOT EXISTS record_tags (
+    record_id BIGINT NOT NULL,
+    tag       TEXT NOT NULL
+);
+CREATE UNIQUE INDEX IF NOT EXISTS record_tags_record_id_tag_idx ON record_tags(record_id, tag);
+
+ALTER TABLE records ADD COLUMN IF NOT EXISTS search_vector TSVECTOR NOT NULL DEFAULT ''::tsvector;
+CREATE INDEX IF NOT EXISTS records_search_vector_idx ON records USING GIN (search_vector);
@@ -0,0 +1,2 @@
+ALTER TABLE shared DROP COLUMN IF EXISTS shared_by;
+ALTER TABLE shared DROP COLUMN IF EXISTS permission;
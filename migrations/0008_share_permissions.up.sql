@@ -0,0 +1,2 @@
+ALTER TABLE shared ADD COLUMN IF NOT EXISTS permission TEXT NOT NULL DEFAULT 'download';
+ALTER TABLE shared ADD COLUMN IF NOT EXISTS shared_by BIGINT;
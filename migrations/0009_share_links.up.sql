@@ -0,0 +1,13 @@
+CREATE TABLE IF NOT EXISTS share_links (
+    id            TEXT PRIMARY KEY,
+    record_id     BIGINT NOT NULL,
+    permission    TEXT NOT NULL,
+    created_by    BIGINT NOT NULL,
+    created_at    TIMESTAMPTZ NOT NULL DEFAULT now(),
+    expires_at    TIMESTAMPTZ,
+    max_uses      INTEGER NOT NULL DEFAULT 0,
+    uses          INTEGER NOT NULL DEFAULT 0,
+    revoked_at    TIMESTAMPTZ,
+    password_hash TEXT
+);
+CREATE INDEX IF NOT EXISTS share_links_record_id_idx ON share_links(record_id);
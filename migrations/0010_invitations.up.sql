@@ -0,0 +1,14 @@
+ALTER TABLE users ADD COLUMN IF NOT EXISTS email TEXT;
+CREATE UNIQUE INDEX IF NOT EXISTS users_email_idx ON users(LOWER(email));
+
+CREATE TABLE IF NOT EXISTS invitations (
+    record_id  BIGINT NOT NULL,
+    email      TEXT NOT NULL,
+    permission TEXT NOT NULL,
+    invited_by BIGINT NOT NULL,
+    token_hash TEXT NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL,
+    expires_at TIMESTAMPTZ NOT NULL
+);
+CREATE INDEX IF NOT EXISTS invitations_email_idx ON invitations(LOWER(email));
+CREATE INDEX IF NOT EXISTS invitations_record_id_idx ON invitations(record_id);
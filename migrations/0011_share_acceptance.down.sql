@@ -0,0 +1,3 @@
+DROP TABLE IF EXISTS blocked_users;
+ALTER TABLE shared DROP COLUMN IF EXISTS status;
+ALTER TABLE users DROP COLUMN IF EXISTS auto_accept_shares;
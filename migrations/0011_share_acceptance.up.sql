@@ -0,0 +1,9 @@
+ALTER TABLE users ADD COLUMN IF NOT EXISTS auto_accept_shares BOOLEAN NOT NULL DEFAULT true;
+ALTER TABLE shared ADD COLUMN IF NOT EXISTS status TEXT NOT NULL DEFAULT 'accepted';
+
+CREATE TABLE IF NOT EXISTS blocked_users (
+    user_id    BIGINT NOT NULL,
+    blocked_id BIGINT NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL
+);
+CREATE UNIQUE INDEX IF NOT EXISTS blocked_users_user_id_blocked_id_idx ON blocked_users(user_id, blocked_id);
@@ -0,0 +1,25 @@
+CREATE TABLE IF NOT EXISTS user_groups (
+    id         BIGSERIAL PRIMARY KEY,
+    name       TEXT NOT NULL,
+    created_by BIGINT NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS group_members (
+    group_id BIGINT NOT NULL,
+    user_id  BIGINT NOT NULL,
+    role     TEXT NOT NULL,
+    added_at TIMESTAMPTZ NOT NULL
+);
+CREATE UNIQUE INDEX IF NOT EXISTS group_members_group_id_user_id_idx ON group_members(group_id, user_id);
+CREATE INDEX IF NOT EXISTS group_members_user_id_idx ON group_members(user_id);
+
+CREATE TABLE IF NOT EXISTS group_shares (
+    record_id  BIGINT NOT NULL,
+    group_id   BIGINT NOT NULL,
+    permission TEXT NOT NULL,
+    shared_by  BIGINT NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL
+);
+CREATE UNIQUE INDEX IF NOT EXISTS group_shares_record_id_group_id_idx ON group_shares(record_id, group_id);
+CREATE INDEX IF NOT EXISTS group_shares_group_id_idx ON group_shares(group_id);
@@ -0,0 +1,3 @@
+ALTER TABLE users DROP COLUMN IF EXISTS email_token_expires_at;
+ALTER TABLE users DROP COLUMN IF EXISTS email_token_hash;
+ALTER TABLE users DROP COLUMN IF EXISTS email_verified;
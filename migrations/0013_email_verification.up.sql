@@ -0,0 +1,4 @@
+-- Emails are only used to find users once they are verified by invitation or confirmation mail
+ALTER TABLE users ADD COLUMN IF NOT EXISTS email_verified BOOLEAN NOT NULL DEFAULT FALSE;
+ALTER TABLE users ADD COLUMN IF NOT EXISTS email_token_hash TEXT;
+ALTER TABLE users ADD COLUMN IF NOT EXISTS email_token_expires_at TIMESTAMPTZ;
@@ -0,0 +1,2 @@
+-- Users who do not accept sharings automatically have to accept membership in group as well
+ALTER TABLE group_members ADD COLUMN IF NOT EXISTS status TEXT NOT NULL DEFAULT 'accepted';
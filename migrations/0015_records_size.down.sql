@@ -0,0 +1,2 @@
+-- Columns may have been created by 0001 and are needed by the service, so they are kept
+SELECT 1;
@@ -0,0 +1,6 @@
+-- Records tables created before migrations have neither size nor creation time, and 0001 does not
+-- add them to existing tables. Size of inline content is counted, so that sorting and filters by
+-- size work for old records.
+ALTER TABLE records ADD COLUMN IF NOT EXISTS size BIGINT NOT NULL DEFAULT 0;
+ALTER TABLE records ADD COLUMN IF NOT EXISTS created_at TIMESTAMPTZ NOT NULL DEFAULT now();
+UPDATE records SET size=octet_length(content) WHERE content IS NOT NULL AND size=0;
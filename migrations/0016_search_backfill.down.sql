@@ -0,0 +1,2 @@
+-- Built vectors are valid whatever the schema version is
+SELECT 1;
@@ -0,0 +1,10 @@
+-- Records existing before 0007 got empty search vectors and could not be found until edited.
+-- Vectors are built the same way as by the service with the default search config.
+UPDATE records R
+SET search_vector=setweight(to_tsvector('simple', R.name), 'A') ||
+                  setweight(to_tsvector('simple', COALESCE(
+                      (SELECT string_agg(T.tag, ' ') FROM record_tags T WHERE T.record_id=R.id), '')), 'B') ||
+                  setweight(to_tsvector('simple', R.description), 'C') ||
+                  setweight(to_tsvector('simple', U.name), 'D')
+FROM users U
+WHERE U.id=R.owner_id AND R.search_vector=''::tsvector;
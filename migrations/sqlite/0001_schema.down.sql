@@ -0,0 +1,14 @@
+DROP TABLE IF EXISTS group_shares;
+DROP TABLE IF EXISTS group_members;
+DROP TABLE IF EXISTS user_groups;
+DROP TABLE IF EXISTS blocked_users;
+DROP TABLE IF EXISTS invitations;
+DROP TABLE IF EXISTS share_links;
+DROP TABLE IF EXISTS record_tags;
+DROP TABLE IF EXISTS uploads;
+DROP TABLE IF EXISTS user_token_revocations;
+DROP TABLE IF EXISTS revoked_tokens;
+DROP TABLE IF EXISTS refresh_tokens;
+DROP TABLE IF EXISTS shared;
+DROP TABLE IF EXISTS records;
+DROP TABLE IF EXISTS users;
@@ -0,0 +1,142 @@
+-- Schema of Postgres migrations 0001-0012 without search vectors. Timestamps are stored as text
+-- in the format of sqliteTimeLayout, so that they compare as strings.
+
+CREATE TABLE IF NOT EXISTS users (
+    id                 INTEGER PRIMARY KEY AUTOINCREMENT,
+    login              TEXT NOT NULL UNIQUE,
+    password           TEXT NOT NULL,
+    name               TEXT NOT NULL,
+    email              TEXT,
+    auto_accept_shares BOOLEAN NOT NULL DEFAULT 1
+);
+CREATE UNIQUE INDEX IF NOT EXISTS users_email_idx ON users(LOWER(email));
+
+CREATE TABLE IF NOT EXISTS records (
+    id           INTEGER PRIMARY KEY AUTOINCREMENT,
+    name         TEXT NOT NULL,
+    content      BLOB,
+    owner_id     INTEGER NOT NULL,
+    size         INTEGER NOT NULL DEFAULT 0,
+    created_at   TIMESTAMP NOT NULL DEFAULT (strftime('%Y-%m-%d %H:%M:%f000000+00:00', 'now')),
+    description  TEXT NOT NULL DEFAULT '',
+    content_type TEXT NOT NULL DEFAULT 'application/octet-stream',
+    storage_key  TEXT,
+    checksum     TEXT,
+    duration     REAL NOT NULL DEFAULT 0,
+    codec        TEXT NOT NULL DEFAULT '',
+    sample_rate  INTEGER NOT NULL DEFAULT 0,
+    channels     INTEGER NOT NULL DEFAULT 0,
+    bitrate      INTEGER NOT NULL DEFAULT 0
+);
+CREATE INDEX IF NOT EXISTS records_owner_id_idx ON records(owner_id);
+CREATE INDEX IF NOT EXISTS records_created_at_idx ON records(created_at);
+
+CREATE TABLE IF NOT EXISTS shared (
+    record_id  INTEGER NOT NULL,
+    "to"       INTEGER NOT NULL,
+    permission TEXT NOT NULL DEFAULT 'download',
+    shared_by  INTEGER,
+    status     TEXT NOT NULL DEFAULT 'accepted'
+);
+CREATE UNIQUE INDEX IF NOT EXISTS shared_record_id_to_idx ON shared(record_id, "to");
+CREATE INDEX IF NOT EXISTS shared_to_idx ON shared("to");
+
+CREATE TABLE IF NOT EXISTS refresh_tokens (
+    id         INTEGER PRIMARY KEY AUTOINCREMENT,
+    user_id    INTEGER NOT NULL,
+    family_id  TEXT NOT NULL,
+    token_hash TEXT NOT NULL UNIQUE,
+    created_at TIMESTAMP NOT NULL,
+    expires_at TIMESTAMP NOT NULL,
+    used_at    TIMESTAMP,
+    revoked_at TIMESTAMP
+);
+CREATE INDEX IF NOT EXISTS refresh_tokens_family_id_idx ON refresh_tokens(family_id);
+CREATE INDEX IF NOT EXISTS refresh_tokens_user_id_idx ON refresh_tokens(user_id);
+
+CREATE TABLE IF NOT EXISTS revoked_tokens (
+    jti        TEXT PRIMARY KEY,
+    user_id    INTEGER NOT NULL,
+    expires_at TIMESTAMP NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS user_token_revocations (
+    user_id        INTEGER PRIMARY KEY,
+    revoked_before TIMESTAMP NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS uploads (
+    id            TEXT PRIMARY KEY,
+    owner_id      INTEGER NOT NULL,
+    length        INTEGER NOT NULL,
+    upload_offset INTEGER NOT NULL DEFAULT 0,
+    metadata      TEXT NOT NULL DEFAULT '',
+    expires_at    TIMESTAMP NOT NULL,
+    record_id     INTEGER
+);
+CREATE INDEX IF NOT EXISTS uploads_expires_at_idx ON uploads(expires_at);
+
+CREATE TABLE IF NOT EXISTS record_tags (
+    record_id INTEGER NOT NULL,
+    tag       TEXT NOT NULL
+);
+CREATE UNIQUE INDEX IF NOT EXISTS record_tags_record_id_tag_idx ON record_tags(record_id, tag);
+
+CREATE TABLE IF NOT EXISTS share_links (
+    id            TEXT PRIMARY KEY,
+    record_id     INTEGER NOT NULL,
+    permission    TEXT NOT NULL,
+    created_by    INTEGER NOT NULL,
+    created_at    TIMESTAMP NOT NULL DEFAULT (strftime('%Y-%m-%d %H:%M:%f000000+00:00', 'now')),
+    expires_at    TIMESTAMP,
+    max_uses      INTEGER NOT NULL DEFAULT 0,
+    uses          INTEGER NOT NULL DEFAULT 0,
+    revoked_at    TIMESTAMP,
+    password_hash TEXT
+);
+CREATE INDEX IF NOT EXISTS share_links_record_id_idx ON share_links(record_id);
+
+CREATE TABLE IF NOT EXISTS invitations (
+    record_id  INTEGER NOT NULL,
+    email      TEXT NOT NULL,
+    permission TEXT NOT NULL,
+    invited_by INTEGER NOT NULL,
+    token_hash TEXT NOT NULL,
+    created_at TIMESTAMP NOT NULL,
+    expires_at TIMESTAMP NOT NULL
+);
+CREATE INDEX IF NOT EXISTS invitations_email_idx ON invitations(LOWER(email));
+CREATE INDEX IF NOT EXISTS invitations_record_id_idx ON invitations(record_id);
+
+CREATE TABLE IF NOT EXISTS blocked_users (
+    user_id    INTEGER NOT NULL,
+    blocked_id INTEGER NOT NULL,
+    created_at TIMESTAMP NOT NULL
+);
+CREATE UNIQUE INDEX IF NOT EXISTS blocked_users_user_id_blocked_id_idx ON blocked_users(user_id, blocked_id);
+
+CREATE TABLE IF NOT EXISTS user_groups (
+    id         INTEGER PRIMARY KEY AUTOINCREMENT,
+    name       TEXT NOT NULL,
+    created_by INTEGER NOT NULL,
+    created_at TIMESTAMP NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS group_members (
+    group_id INTEGER NOT NULL,
+    user_id  INTEGER NOT NULL,
+    role     TEXT NOT NULL,
+    added_at TIMESTAMP NOT NULL
+);
+CREATE UNIQUE INDEX IF NOT EXISTS group_members_group_id_user_id_idx ON group_members(group_id, user_id);
+CREATE INDEX IF NOT EXISTS group_members_user_id_idx ON group_members(user_id);
+
+CREATE TABLE IF NOT EXISTS group_shares (
+    record_id  INTEGER NOT NULL,
+    group_id   INTEGER NOT NULL,
+    permission TEXT NOT NULL,
+    shared_by  INTEGER NOT NULL,
+    created_at TIMESTAMP NOT NULL
+);
+CREATE UNIQUE INDEX IF NOT EXISTS group_shares_record_id_group_id_idx ON group_shares(record_id, group_id);
+CREATE INDEX IF NOT EXISTS group_shares_group_id_idx ON group_shares(group_id);
@@ -0,0 +1,3 @@
+ALTER TABLE users DROP COLUMN email_token_expires_at;
+ALTER TABLE users DROP COLUMN email_token_hash;
+ALTER TABLE users DROP COLUMN email_verified;
@@ -0,0 +1,4 @@
+-- Postgres migration 0013
+ALTER TABLE users ADD COLUMN email_verified BOOLEAN NOT NULL DEFAULT 0;
+ALTER TABLE users ADD COLUMN email_token_hash TEXT;
+ALTER TABLE users ADD COLUMN email_token_expires_at TIMESTAMP;
@@ -0,0 +1,2 @@
+DELETE FROM group_members WHERE status<>'accepted';
+ALTER TABLE group_members DROP COLUMN status;
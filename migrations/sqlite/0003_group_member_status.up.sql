@@ -0,0 +1,2 @@
+-- Postgres migration 0014
+ALTER TABLE group_members ADD COLUMN status TEXT NOT NULL DEFAULT 'accepted';
@@ -0,0 +1,3 @@
+-- Postgres migration 0015: schema of SQLite always had size, so only size of inline content is
+-- counted
+UPDATE records SET size=length(CAST(content AS BLOB)) WHERE content IS NOT NULL AND size=0;
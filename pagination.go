@@ -0,0 +1,259 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Arguments of SQL query. Values are passed to database separately from query text, only their
+// placeholders are put into the text.
+type queryArgs struct {
+	args []interface{}
+}
+
+// Add argument returning its placeholder
+func (q *queryArgs) add(v interface{}) string {
+	q.args = append(q.args, v)
+	return "$" + strconv.Itoa(len(q.args))
+}
+
+// Order of list for keyset pagination. The last column must be unique, so that rows are ordered
+// the same way each time and page can be continued right after the last row of previous one.
+type keysetOrder struct {
+	// Included into cursor, so that cursor of list sorted one way is not applied to another
+	name    string
+	columns []string
+	desc    []bool
+	// Zero values of columns, cursor values are decoded into their types
+	sample []interface{}
+}
+
+func (o *keysetOrder) orderBy() string {
+	terms := make([]string, len(o.columns))
+	for i, column := range o.columns {
+		terms[i] = column
+		if o.desc[i] {
+			terms[i] += " DESC"
+		}
+	}
+	return strings.Join(terms, ", ")
+}
+
+// SQL condition matching rows following the row with given values of order columns
+func (o *keysetOrder) after(q *queryArgs, key []interface{}) string {
+	var alternatives []string
+	for i := range o.columns {
+		var terms []string
+		for j := 0; j < i; j++ {
+			terms = append(terms, o.columns[j]+"="+q.add(key[j]))
+		}
+		op := ">"
+		if o.desc[i] {
+			op = "<"
+		}
+		terms = append(terms, o.columns[i]+op+q.add(key[i]))
+		alternatives = append(alternatives, "("+strings.Join(terms, " AND ")+")")
+	}
+	return "(" + strings.Join(alternatives, " OR ") + ")"
+}
+
+type pageCursor struct {
+	Order string            `json:"o"`
+	Key   []json.RawMessage `json:"k"`
+}
+
+// Opaque cursor pointing right after the row with given values of order columns
+func (o *keysetOrder) cursor(key []interface{}) (string, error) {
+	c := pageCursor{Order: o.name}
+	for _, v := range key {
+		raw, err := json.Marshal(v)
+		if err != nil {
+			return "", err
+		}
+		c.Key = append(c.Key, raw)
+	}
+	data, err := json.Marshal(c)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(data), nil
+}
+
+func (o *keysetOrder) parseCursor(cursor string) ([]interface{}, error) {
+	data, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return nil, fmt.Errorf("invalid cursor")
+	}
+	var c pageCursor
+	if err := json.Unmarshal(data, &c); err != nil || len(c.Key) != len(o.columns) {
+		return nil, fmt.Errorf("invalid cursor")
+	}
+	if c.Order != o.name {
+		return nil, fmt.Errorf("cursor does not match list order")
+	}
+	key := make([]interface{}, len(c.Key))
+	for i, raw := range c.Key {
+		v := reflect.New(reflect.TypeOf(o.sample[i]))
+		if err := json.Unmarshal(raw, v.Interface()); err != nil {
+			return nil, fmt.Errorf("invalid cursor")
+		}
+		key[i] = v.Elem().Interface()
+	}
+	return key, nil
+}
+
+// Parse required limit and offset query params of list requests
+func parsePaging(r *http.Request) (limit int, offset int, err error) {
+	offset, err = strconv.Atoi(r.URL.Query().Get("offset"))
+	if err != nil || offset < 0 {
+		return 0, 0, fmt.Errorf("invalid offset param: %q", r.URL.Query().Get("offset"))
+	}
+	limit, err = strconv.Atoi(r.URL.Query().Get("limit"))
+	if err != nil || limit < 0 {
+		return 0, 0, fmt.Errorf("invalid limit param: %q", r.URL.Query().Get("limit"))
+	}
+	return limit, offset, nil
+}
+
+// Requested page: either offset or key of the last row of previous page is set
+type pageRequest struct {
+	limit  int
+	offset int
+	after  []interface{}
+}
+
+// Parse limit and either offset or cursor query params of list request
+func parsePageRequest(r *http.Request, order *keysetOrder) (*pageRequest, error) {
+	query := r.URL.Query()
+	cursor := query.Get("cursor")
+	if cursor == "" {
+		limit, offset, err := parsePaging(r)
+		if err != nil {
+			return nil, err
+		}
+		return &pageRequest{limit: limit, offset: offset}, nil
+	}
+	if query.Get("offset") != "" {
+		return nil, fmt.Errorf("offset and cursor params are mutually exclusive")
+	}
+	limit, err := strconv.Atoi(query.Get("limit"))
+	if err != nil || limit < 0 {
+		return nil, fmt.Errorf("invalid limit param: %q", query.Get("limit"))
+	}
+	after, err := order.parseCursor(cursor)
+	if err != nil {
+		return nil, err
+	}
+	return &pageRequest{limit: limit, after: after}, nil
+}
+
+// Add keyset condition, order and limits of requested page to query. One row more than requested
+// is selected to tell whether there is next page.
+func (p *pageRequest) apply(q *queryArgs, where []string, order *keysetOrder) string {
+	if p.after != nil {
+		where = append(where, order.after(q, p.after))
+	}
+	query := ""
+	if len(where) > 0 {
+		query += "WHERE " + strings.Join(where, " AND ") + "\n"
+	}
+	query += "ORDER BY " + order.orderBy() + "\n"
+	query += "LIMIT " + q.add(p.limit+1) + "\n"
+	query += "OFFSET " + q.add(p.offset)
+	return query
+}
+
+// Cursor of the next page given number of selected rows and key of the last requested one
+func (p *pageRequest) nextCursor(selected int, order *keysetOrder, lastKey func() []interface{}) (string, error) {
+	if selected <= p.limit || p.limit == 0 {
+		return "", nil
+	}
+	return order.cursor(lastKey())
+}
+
+// Compare values of the same order column: -1, 0 or 1
+func compareKeyValues(a, b interface{}) int {
+	switch a := a.(type) {
+	case bool:
+		b := b.(bool)
+		switch {
+		case a == b:
+			return 0
+		case b:
+			return -1
+		}
+		return 1
+	case string:
+		return strings.Compare(a, b.(string))
+	case time.Time:
+		b := b.(time.Time)
+		switch {
+		case a.Before(b):
+			return -1
+		case a.After(b):
+			return 1
+		}
+		return 0
+	case float64:
+		b := b.(float64)
+		switch {
+		case a < b:
+			return -1
+		case a > b:
+			return 1
+		}
+		return 0
+	case int64:
+		b := b.(int64)
+		switch {
+		case a < b:
+			return -1
+		case a > b:
+			return 1
+		}
+		return 0
+	}
+	panic(fmt.Sprintf("unexpected key value type %T", a))
+}
+
+// Compare keys by order: negative if a goes before b
+func compareKeys(order *keysetOrder, a, b []interface{}) int {
+	for i := range order.columns {
+		c := compareKeyValues(a[i], b[i])
+		if order.desc[i] {
+			c = -c
+		}
+		if c != 0 {
+			return c
+		}
+	}
+	return 0
+}
+
+// Select requested page of items given their keys, the same as apply does in SQL: items are
+// sorted by order, then ones following the 'after' key are taken, skipping offset. Indexes of
+// selected items are returned, one more than requested to tell whether there is next page.
+func (p *pageRequest) selectKeys(keys [][]interface{}, order *keysetOrder) []int {
+	var idx []int
+	for i, key := range keys {
+		if p.after == nil || compareKeys(order, key, p.after) > 0 {
+			idx = append(idx, i)
+		}
+	}
+	sort.Slice(idx, func(i, j int) bool { return compareKeys(order, keys[idx[i]], keys[idx[j]]) < 0 })
+	if p.offset >= len(idx) {
+		return nil
+	}
+	idx = idx[p.offset:]
+	if len(idx) > p.limit+1 {
+		idx = idx[:p.limit+1]
+	}
+	return idx
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+	"regexp"
+	"strings"
+)
+
+const (
+	hasherArgon2id = "argon2id"
+	hasherBcrypt   = "bcrypt"
+)
+
+// Longest password bcrypt can hash; the same limit holds for all hashers, so that passwords stay
+// valid whichever hasher is configured
+const maxPasswordLength = 72
+
+// Check password can be hashed
+func validatePassword(password string) error {
+	if len(password) > maxPasswordLength {
+		return fmt.Errorf("password must not be longer than %d bytes", maxPasswordLength)
+	}
+	return nil
+}
+
+// Password hasher produces self-describing encoded hashes: algorithm, parameters and salt are all
+// stored in the encoded string, so hashes stay verifiable after parameters change
+type passwordHasher interface {
+	// Hash password with a freshly generated salt
+	Hash(password string) (string, error)
+	// Check password against encoded hash produced by this hasher
+	Verify(encoded, password string) (bool, error)
+	// Report whether encoded string is a well-formed hash of this hasher's algorithm
+	Owns(encoded string) bool
+	// Report whether encoded hash was produced with parameters other than current ones
+	Outdated(encoded string) bool
+}
+
+// Set of known hashers; new hashes are always produced by the current one
+type passwords struct {
+	current passwordHasher
+	known   []passwordHasher
+}
+
+func newPasswords(conf *config) *passwords {
+	argon := newArgon2idHasher()
+	bcr := &bcryptHasher{cost: conf.BcryptCost}
+	if bcr.cost == 0 {
+		bcr.cost = bcrypt.DefaultCost
+	}
+	p := &passwords{known: []passwordHasher{argon, bcr}}
+	if conf.PasswordHasher == hasherBcrypt {
+		p.current = bcr
+	} else {
+		p.current = argon
+	}
+	return p
+}
+
+func (p *passwords) Hash(password string) (string, error) {
+	return p.current.Hash(password)
+}
+
+// Check password against value stored in 'users' table. Values that do not parse as hash of any
+// known hasher are legacy plaintext passwords: older versions stored passwords as they were, so
+// they may look like anything, hashes of other formats included. If needsRehash is set, stored
+// value should be replaced with a fresh hash of password.
+func (p *passwords) Verify(stored, password string) (ok bool, needsRehash bool, err error) {
+	for _, h := range p.known {
+		if !h.Owns(stored) {
+			continue
+		}
+		if ok, err = h.Verify(stored, password); err != nil || !ok {
+			return false, false, err
+		}
+		return true, h != p.current || h.Outdated(stored), nil
+	}
+	logI.Print("checking password stored in legacy plaintext")
+	ok = subtle.ConstantTimeCompare([]byte(stored), []byte(password)) == 1
+	return ok, ok, nil
+}
+
+// Bcrypt hash: version, two-digit cost, 22 characters of salt and 31 of hash in bcrypt's base64
+var bcryptHashRe = regexp.MustCompile(`^\$2[aby]\$\d\d\$[./A-Za-z0-9]{53}$`)
+
+type bcryptHasher struct {
+	cost int
+}
+
+func (h *bcryptHasher) Hash(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), h.cost)
+	if err != nil {
+		return "", fmt.Errorf("bcrypt: %v", err)
+	}
+	return string(hash), nil
+}
+
+func (h *bcryptHasher) Verify(encoded, password string) (bool, error) {
+	err := bcrypt.CompareHashAndPassword([]byte(encoded), []byte(password))
+	if err == bcrypt.ErrMismatchedHashAndPassword {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("bcrypt: %v", err)
+	}
+	return true, nil
+}
+
+func (h *bcryptHasher) Owns(encoded string) bool {
+	if !bcryptHashRe.MatchString(encoded) {
+		return false
+	}
+	cost, err := bcrypt.Cost([]byte(encoded))
+	return err == nil && cost >= bcrypt.MinCost && cost <= bcrypt.MaxCost
+}
+
+func (h *bcryptHasher) Outdated(encoded string) bool {
+	cost, err := bcrypt.Cost([]byte(encoded))
+	return err != nil || cost != h.cost
+}
+
+// Argon2id hasher encoding hashes in PHC string format: $argon2id$v=19$m=65536,t=1,p=4$<salt>$<hash>
+type argon2idHasher struct {
+	time    uint32
+	memory  uint32
+	threads uint8
+	saltLen int
+	keyLen  uint32
+}
+
+const argon2idPrefix = "$argon2id$"
+
+func newArgon2idHasher() *argon2idHasher {
+	return &argon2idHasher{
+		time:    1,
+		memory:  64 * 1024,
+		threads: 4,
+		saltLen: 16,
+		keyLen:  32,
+	}
+}
+
+func (h *argon2idHasher) Hash(password string) (string, error) {
+	salt := make([]byte, h.saltLen)
+	if _, err := rand.Read(salt); err != nil {
+		return "", fmt.Errorf("generate salt: %v", err)
+	}
+	key := argon2.IDKey([]byte(password), salt, h.time, h.memory, h.threads, h.keyLen)
+	return fmt.Sprintf("%sv=%d$m=%d,t=%d,p=%d$%s$%s", argon2idPrefix, argon2.Version, h.memory, h.time, h.threads,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key)), nil
+}
+
+func (h *argon2idHasher) Verify(encoded, password string) (bool, error) {
+	params, salt, key, err := h.decode(encoded)
+	if err != nil {
+		return false, err
+	}
+	actual := argon2.IDKey([]byte(password), salt, params.time, params.memory, params.threads, uint32(len(key)))
+	return subtle.ConstantTimeCompare(actual, key) == 1, nil
+}
+
+func (h *argon2idHasher) Owns(encoded string) bool {
+	_, _, _, err := h.decode(encoded)
+	return err == nil
+}
+
+func (h *argon2idHasher) Outdated(encoded string) bool {
+	params, salt, key, err := h.decode(encoded)
+	if err != nil {
+		return true
+	}
+	return params.time != h.time || params.memory != h.memory || params.threads != h.threads ||
+		len(salt) != h.saltLen || uint32(len(key)) != h.keyLen
+}
+
+func (h *argon2idHasher) decode(encoded string) (params *argon2idHasher, salt []byte, key []byte, err error) {
+	parts := strings.Split(encoded, "$")
+	if !strings.HasPrefix(encoded, argon2idPrefix) || len(parts) != 6 {
+		return nil, nil, nil, fmt.Errorf("argon2id: invalid hash format")
+	}
+	if parts[2] != fmt.Sprintf("v=%d", argon2.Version) {
+		return nil, nil, nil, fmt.Errorf("argon2id: unsupported version %q", parts[2])
+	}
+	params = &argon2idHasher{}
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &params.memory, &params.time, &params.threads); err != nil {
+		return nil, nil, nil, fmt.Errorf("argon2id: parse params: %v", err)
+	}
+	// Params must be written exactly as they are produced, so that nothing is left unparsed
+	if parts[3] != fmt.Sprintf("m=%d,t=%d,p=%d", params.memory, params.time, params.threads) ||
+		params.memory == 0 || params.time == 0 || params.threads == 0 {
+		return nil, nil, nil, fmt.Errorf("argon2id: invalid params %q", parts[3])
+	}
+	if salt, err = base64.RawStdEncoding.DecodeString(parts[4]); err != nil {
+		return nil, nil, nil, fmt.Errorf("argon2id: decode salt: %v", err)
+	}
+	if key, err = base64.RawStdEncoding.DecodeString(parts[5]); err != nil {
+		return nil, nil, nil, fmt.Errorf("argon2id: decode key: %v", err)
+	}
+	if len(key) == 0 {
+		return nil, nil, nil, fmt.Errorf("argon2id: empty key")
+	}
+	return params, salt, key, nil
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Level of access to record. Each level includes all lower ones.
+type permission int
+
+const (
+	permNone permission = iota
+	// Stream content for playback
+	permListen
+	// Download original content as attachment
+	permDownload
+	// Share record to other users with permission not higher than own one
+	permReshare
+	// Change name, description and tags of record
+	permEdit
+	// Delete record and manage all its sharings
+	permOwner
+)
+
+const defaultSharePermission = permDownload
+
+var (
+	errNotSharer  = errors.New("sharing was made by another user")
+	errNoSuchUser = errors.New("no such user")
+)
+
+var permissionNames = map[permission]string{
+	permListen:   "listen",
+	permDownload: "download",
+	permReshare:  "reshare",
+	permEdit:     "edit",
+	permOwner:    "owner",
+}
+
+func (p permission) String() string {
+	if name, ok := permissionNames[p]; ok {
+		return name
+	}
+	return "none"
+}
+
+func (p permission) MarshalText() ([]byte, error) {
+	return []byte(p.String()), nil
+}
+
+// Parse permission a record can be shared with; empty string means default one
+func parseSharePermission(s string) (permission, error) {
+	if s == "" {
+		return defaultSharePermission, nil
+	}
+	for p, name := range permissionNames {
+		if name == s && p != permOwner {
+			return p, nil
+		}
+	}
+	return permNone, fmt.Errorf("invalid permission %q: expected listen, download, reshare or edit", s)
+}
+
+func (p *permission) UnmarshalText(text []byte) error {
+	for perm, name := range permissionNames {
+		if name == string(text) {
+			*p = perm
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown permission %q", text)
+}
+
+// Scan permission stored in 'shared' table by name or level returned by recordPermission expression
+func (p *permission) Scan(src interface{}) error {
+	switch v := src.(type) {
+	case nil:
+		*p = permNone
+		return nil
+	case int64:
+		if v < int64(permNone) || v > int64(permOwner) {
+			return fmt.Errorf("unknown permission level %d", v)
+		}
+		*p = permission(v)
+		return nil
+	case string:
+		return p.UnmarshalText([]byte(v))
+	case []byte:
+		return p.UnmarshalText(v)
+	}
+	return fmt.Errorf("unexpected permission type %T", src)
+}
@@ -0,0 +1,294 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultMaxUploadSize   = 100 << 20
+	defaultRecordMediaType = "application/octet-stream"
+	// Room for multipart boundaries, headers and small form fields on top of the file itself
+	maxMultipartOverhead = 1 << 20
+)
+
+var errContentTooLarge = errors.New("content is too large")
+
+type recordInfo struct {
+	Id          int64     `json:"id"`
+	Name        string    `json:"name"`
+	Description string    `json:"description"`
+	OwnerId     int64     `json:"owner_id"`
+	ContentType string    `json:"content_type"`
+	Size        int64     `json:"size"`
+	Checksum    string    `json:"checksum"`
+	CreatedAt   time.Time `json:"created_at"`
+	StorageKey  string    `json:"-"`
+	// Upload the record is made of, linked to the record when it is inserted
+	UploadId string `json:"-"`
+	// Properties of audio stream; duration is in seconds and bitrate in bits per second. Zero values
+	// mean they are not known.
+	Duration   float64  `json:"duration"`
+	Codec      string   `json:"codec"`
+	SampleRate int      `json:"sample_rate"`
+	Channels   int      `json:"channels"`
+	Bitrate    int      `json:"bitrate"`
+	Tags       []string `json:"tags"`
+	// Permission of user the record is selected for
+	Permission permission `json:"permission,omitempty"`
+}
+
+// User or group record is shared to
+type sharedTo struct {
+	// Either user or group
+	Type       string     `json:"type"`
+	Id         int64      `json:"id"`
+	Name       string     `json:"name"`
+	Permission permission `json:"permission"`
+	// Whether user has accepted the sharing: pending, accepted or declined; not set for groups
+	Status string `json:"status,omitempty"`
+}
+
+// Item of records list
+type listedRecord struct {
+	Id         int64      `json:"id"`
+	Name       string     `json:"name"`
+	IsOwner    bool       `json:"is_owner"`
+	OwnerId    int64      `json:"owner_id"`
+	OwnerName  string     `json:"owner_name"`
+	Size       int64      `json:"size"`
+	Duration   float64    `json:"duration"`
+	Codec      string     `json:"codec"`
+	SampleRate int        `json:"sample_rate"`
+	Channels   int        `json:"channels"`
+	Bitrate    int        `json:"bitrate"`
+	CreatedAt  time.Time  `json:"created_at"`
+	SharedTo   []sharedTo `json:"shared_to"`
+}
+
+// Columns of 'visible' table records list can be sorted by, keyed by sort_by param
+var recordsSortColumns = map[string]struct {
+	column string
+	sample interface{}
+}{
+	"record":     {"V.name", ""},
+	"owner":      {"V.owner_name", ""},
+	"created_at": {"V.created_at", time.Time{}},
+	"duration":   {"V.duration", float64(0)},
+	"size":       {"V.size", int64(0)},
+}
+
+// Order of records list by sort_by and order params. When sorted by record or owner name own
+// records go first.
+func newRecordsOrder(sortBy, direction string) (*keysetOrder, error) {
+	sortColumn, ok := recordsSortColumns[sortBy]
+	if !ok {
+		return nil, fmt.Errorf("invalid sort_by param")
+	}
+	if direction == "" {
+		direction = "asc"
+	}
+	if direction != "asc" && direction != "desc" {
+		return nil, fmt.Errorf("invalid order param")
+	}
+	desc := direction == "desc"
+	order := &keysetOrder{name: sortBy + ":" + direction}
+	if sortBy == "record" || sortBy == "owner" {
+		order.columns = []string{"V.is_owner"}
+		order.desc = []bool{true}
+		order.sample = []interface{}{false}
+	}
+	order.columns = append(order.columns, sortColumn.column, "V.id")
+	order.desc = append(order.desc, desc, desc)
+	order.sample = append(order.sample, sortColumn.sample, int64(0))
+	return order, nil
+}
+
+// Values of order columns for record
+func (rec *listedRecord) key(sortBy string) []interface{} {
+	switch sortBy {
+	case "record":
+		return []interface{}{rec.IsOwner, rec.Name, rec.Id}
+	case "owner":
+		return []interface{}{rec.IsOwner, rec.OwnerName, rec.Id}
+	case "created_at":
+		return []interface{}{rec.CreatedAt, rec.Id}
+	case "duration":
+		return []interface{}{rec.Duration, rec.Id}
+	default:
+		return []interface{}{rec.Size, rec.Id}
+	}
+}
+
+// Conditions on records R listed to user
+type recordsFilter struct {
+	// all (default), mine or shared
+	scope       string
+	ownerId     int64
+	createdFrom time.Time
+	createdTo   time.Time
+	durationMin float64
+	durationMax float64
+	// Substring of record name, matched case-insensitively
+	search string
+}
+
+func parseRecordsFilter(query url.Values) (*recordsFilter, error) {
+	f := &recordsFilter{scope: query.Get("scope"), search: query.Get("q")}
+	switch f.scope {
+	case "", "all", "mine", "shared":
+	default:
+		return nil, fmt.Errorf("invalid scope param")
+	}
+	var err error
+	if v := query.Get("owner_id"); v != "" {
+		if f.ownerId, err = strconv.ParseInt(v, 10, 64); err != nil {
+			return nil, fmt.Errorf("invalid owner_id param: %q", v)
+		}
+	}
+	for param, dst := range map[string]*time.Time{"created_from": &f.createdFrom, "created_to": &f.createdTo} {
+		if v := query.Get(param); v != "" {
+			if *dst, err = time.Parse(time.RFC3339, v); err != nil {
+				return nil, fmt.Errorf("invalid %s param: %q", param, v)
+			}
+		}
+	}
+	for param, dst := range map[string]*float64{"duration_min": &f.durationMin, "duration_max": &f.durationMax} {
+		if v := query.Get(param); v != "" {
+			if *dst, err = strconv.ParseFloat(v, 64); err != nil || !(*dst >= 0) {
+				return nil, fmt.Errorf("invalid %s param: %q", param, v)
+			}
+		}
+	}
+	return f, nil
+}
+
+// Parse path of single record resource: /v1/records/{id} or /v1/records/{id}/{subresource}
+func parseRecordPath(path string) (recordId int64, subresource string, err error) {
+	parts := strings.SplitN(strings.TrimPrefix(path, "/v1/records/"), "/", 2)
+	if recordId, err = strconv.ParseInt(parts[0], 10, 64); err != nil || recordId <= 0 {
+		return 0, "", fmt.Errorf("invalid record id %q", parts[0])
+	}
+	if len(parts) == 2 {
+		subresource = parts[1]
+	}
+	return recordId, subresource, nil
+}
+
+// Put content into blob store and create record referencing it. Content longer than
+// max_upload_size is rejected with errContentTooLarge. Content type is sniffed if rec does not
+// have a specific one. Audio properties are read from content headers; duration set by caller is
+// kept if it can not be determined.
+func (a *Api) createRecord(ctx context.Context, rec *recordInfo, content io.Reader) error {
+	buffered := bufio.NewReaderSize(content, 512)
+	head, _ := buffered.Peek(512)
+	rec.ContentType = recordMediaType(rec.ContentType, head)
+	key, err := newBlobKey()
+	if err != nil {
+		return err
+	}
+	limited := &limitedReader{r: buffered, remaining: a.config().maxUploadSize()}
+	size, checksum, err := a.blobs.Put(ctx, key, limited)
+	if err == errContentTooLarge {
+		return &contentReadError{err}
+	}
+	if limited.readErr != nil {
+		return &contentReadError{limited.readErr}
+	}
+	if err != nil {
+		return fmt.Errorf("put content into blob store: %v", err)
+	}
+	rec.StorageKey, rec.Size, rec.Checksum = key, size, checksum
+	a.probeRecordContent(ctx, rec)
+	if rec.Tags == nil {
+		rec.Tags = []string{}
+	}
+	if err := a.store.InsertRecord(rec, a.config().searchConfig()); err != nil {
+		if delErr := a.blobs.Delete(ctx, key); delErr != nil {
+			logE.Printf("delete blob %q of not created record: %v", key, delErr)
+		}
+		return fmt.Errorf("insert record: %v", err)
+	}
+	return nil
+}
+
+// Fill in audio properties of record from its content. Content that is not recognized is still
+// stored, so failures are only logged.
+func (a *Api) probeRecordContent(ctx context.Context, rec *recordInfo) {
+	blob, err := a.blobs.Open(ctx, rec.StorageKey)
+	if err != nil {
+		logE.Printf("open blob %q for probing: %v", rec.StorageKey, err)
+		return
+	}
+	defer blob.Close()
+	info, err := probeAudio(blob, rec.Size)
+	if err != nil {
+		logI.Printf("probe audio of record %q: %v", rec.Name, err)
+		return
+	}
+	rec.Codec, rec.SampleRate, rec.Channels, rec.Bitrate = info.Codec, info.SampleRate, info.Channels, info.Bitrate
+	if info.Duration > 0 {
+		rec.Duration = info.Duration
+	}
+	if mediaType, ok := codecMediaTypes[info.Codec]; ok && rec.ContentType == defaultRecordMediaType {
+		rec.ContentType = mediaType
+	}
+}
+
+// Error caused by content supplied by client rather than by storage
+type contentReadError struct {
+	err error
+}
+
+func (e *contentReadError) Error() string {
+	return fmt.Sprintf("read content: %v", e.err)
+}
+
+// Reply with error from createRecord
+func replyWithCreateRecordError(w http.ResponseWriter, err error) {
+	readErr, ok := err.(*contentReadError)
+	switch {
+	case ok && readErr.err == errContentTooLarge:
+		replyWithError(w, http.StatusRequestEntityTooLarge, readErr.err)
+	case ok:
+		logI.Print(err)
+		replyWithError(w, http.StatusBadRequest, err)
+	default:
+		err = fmt.Errorf("create record: %v", err)
+		logE.Print(err)
+		replyWithError(w, http.StatusInternalServerError, err)
+	}
+}
+
+// Read whole content failing with errContentTooLarge as soon as it exceeds limit
+func readContent(r io.Reader, limit int64) ([]byte, error) {
+	return ioutil.ReadAll(&limitedReader{r: r, remaining: limit})
+}
+
+func isAudioMediaType(mediaType string) bool {
+	return strings.HasPrefix(mediaType, "audio/") || mediaType == "application/ogg"
+}
+
+// Resolve media type of uploaded content, sniffing it if client did not declare audio one. Other
+// declared types are not trusted, since content is served inline from api origin and e.g. text/html
+// would run scripts there.
+func recordMediaType(declared string, content []byte) string {
+	if mediaType, _, err := mime.ParseMediaType(declared); err == nil && isAudioMediaType(mediaType) {
+		return mediaType
+	}
+	sniffed, _, _ := mime.ParseMediaType(http.DetectContentType(content))
+	if isAudioMediaType(sniffed) {
+		return sniffed
+	}
+	return defaultRecordMediaType
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"reflect"
+	"sync"
+	"sync/atomic"
+)
+
+// Config along with keys, password hashers and mailer built from it. Reload replaces the whole
+// state at once, so that nothing built from old config is used with new one.
+type configState struct {
+	conf      *config
+	keys      *keyring
+	passwords *passwords
+	mailer    Mailer
+}
+
+func newConfigState(conf *config) (*configState, error) {
+	keys, err := newKeyring(conf)
+	if err != nil {
+		return nil, fmt.Errorf("init jwt keys: %v", err)
+	}
+	return &configState{conf, keys, newPasswords(conf), newMailer(conf)}, nil
+}
+
+// Config state shared by Api and its handlers and swapped atomically on reload
+type liveConfig struct {
+	state atomic.Value
+	// Serializes reloads
+	mu sync.Mutex
+}
+
+func (l *liveConfig) load() *configState {
+	return l.state.Load().(*configState)
+}
+
+func (l *liveConfig) store(state *configState) {
+	l.state.Store(state)
+}
+
+// Keys read once at startup: listener, database, blob store and token revocations retention are
+// not rebuilt on reload, so changes of these keys take effect only after restart. Search config
+// must match the one search vectors of records were built with, so it is not changed on the fly.
+var restartOnlyKeys = []string{"listen", "database", "db_host", "db_port", "db_user", "db_passwd", "db_passwd_file",
+	"db_name", "db_sslmode", "db_dsn", "db_dsn_file", "db_max_open_conns", "db_max_idle_conns",
+	"db_conn_max_lifetime", "sqlite_path", "auto_migrate", "storage", "storage_dir", "s3_endpoint", "s3_region",
+	"s3_bucket", "s3_access_key", "s3_secret_key", "s3_secret_key_file", "s3_path_style", "uploads_dir",
+	"access_token_ttl", "search_config"}
+
+// Keys whose values are not shown in effective config
+var secretKeys = map[string]bool{"db_passwd": true, "db_dsn": true, "jwt_sign_key": true, "link_sign_key": true,
+	"s3_access_key": true, "s3_secret_key": true, "smtp_password": true}
+
+const redactedValue = "[redacted]"
+
+// Fields of config keyed by toml keys
+func (c *config) fields() map[string]reflect.Value {
+	v := reflect.ValueOf(c).Elem()
+	fields := make(map[string]reflect.Value, v.NumField())
+	for i := 0; i < v.NumField(); i++ {
+		fields[v.Type().Field(i).Tag.Get("toml")] = v.Field(i)
+	}
+	return fields
+}
+
+// Config keyed as in toml file with values of secrets replaced by redactedValue
+func (c *config) redacted() map[string]interface{} {
+	res := make(map[string]interface{})
+	for key, field := range c.fields() {
+		if secretKeys[key] && !field.IsZero() {
+			res[key] = redactedValue
+		} else {
+			res[key] = field.Interface()
+		}
+	}
+	return res
+}
+
+// Swap config for the new one. Restart-only keys keep their current values, so that config shows
+// what is in effect; keys whose changes were ignored are returned.
+func (a *Api) applyConfig(next *config) ([]string, error) {
+	a.live.mu.Lock()
+	defer a.live.mu.Unlock()
+	current, nextFields := a.live.load().conf.fields(), next.fields()
+	var ignored []string
+	for _, key := range restartOnlyKeys {
+		if !reflect.DeepEqual(current[key].Interface(), nextFields[key].Interface()) {
+			ignored = append(ignored, key)
+			nextFields[key].Set(current[key])
+		}
+	}
+	state, err := newConfigState(next)
+	if err != nil {
+		return nil, err
+	}
+	a.live.store(state)
+	setLogLevel(next.LogLevel)
+	return ignored, nil
+}
+
+// Re-read config file; current config stays in effect if the new one is invalid
+func (a *Api) reloadConfig(path string) error {
+	next, err := readConfig(path)
+	if err != nil {
+		return err
+	}
+	ignored, err := a.applyConfig(next)
+	if err != nil {
+		return err
+	}
+	for _, key := range ignored {
+		logI.Printf("change of config key %s is ignored until restart", key)
+	}
+	logI.Printf("reloaded config from %s", path)
+	return nil
+}
+
+// Reload config on each signal from channel subscribed to SIGHUP
+func (a *Api) reloadConfigOnHangup(hangup <-chan os.Signal, path string) {
+	for range hangup {
+		if err := a.reloadConfig(path); err != nil {
+			logE.Printf("reload config: %v", err)
+		}
+	}
+}
+
+// Effective config with secrets redacted, for users listed in admins
+// Note: needs auth
+func (a *Api) HandleAdminConfig(w http.ResponseWriter, r *http.Request, userId int64) {
+	if r.Method != http.MethodGet {
+		replyWithError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s is not allowed", r.Method))
+		return
+	}
+	conf := a.config()
+	if claims := claimsFromRequest(r); claims == nil || !conf.isAdmin(claims.Login) {
+		err := fmt.Errorf("user %d is not admin", userId)
+		logI.Print(err)
+		replyWithError(w, http.StatusForbidden, err)
+		return
+	}
+	res, err := json.Marshal(conf.redacted())
+	if err != nil {
+		err = fmt.Errorf("encode config: %v", err)
+		logE.Print(err)
+		replyWithError(w, http.StatusInternalServerError, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	fmt.Fprint(w, string(res))
+}
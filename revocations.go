@@ -0,0 +1,104 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Revoked access tokens kept in memory for fast lookups by auth middleware. Every revocation is
+// written to store first, so it survives restarts and reaches other instances on their next sync.
+type revocationStore struct {
+	store Store
+
+	mu sync.RWMutex
+	// jti -> expiration of revoked token
+	tokens map[string]time.Time
+	// user id -> all tokens of the user issued at or before this moment are revoked; it has
+	// microsecond precision like issue time of tokens does
+	revokedBefore map[int64]time.Time
+}
+
+func newRevocationStore(store Store) *revocationStore {
+	return &revocationStore{
+		store:         store,
+		tokens:        make(map[string]time.Time),
+		revokedBefore: make(map[int64]time.Time),
+	}
+}
+
+func (s *revocationStore) isRevoked(claims *tokenClaims) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if claims.Jti != "" {
+		if _, ok := s.tokens[claims.Jti]; ok {
+			return true
+		}
+	}
+	if before, ok := s.revokedBefore[claims.UserId]; ok && !claims.issuedAt().After(before) {
+		return true
+	}
+	return false
+}
+
+func (s *revocationStore) revokeToken(claims *tokenClaims) error {
+	expiresAt := time.Unix(claims.Exp, 0)
+	if err := s.store.InsertRevokedToken(claims.Jti, claims.UserId, expiresAt); err != nil {
+		return fmt.Errorf("insert revoked token: %v", err)
+	}
+	s.mu.Lock()
+	s.tokens[claims.Jti] = expiresAt
+	s.mu.Unlock()
+	return nil
+}
+
+// Revoke all access tokens of user issued so far. Moment of revocation is rounded up to microseconds
+// stored by database, so that it is not rounded down below tokens issued before it.
+func (s *revocationStore) revokeUserTokens(userId int64) error {
+	now := time.Now().Truncate(time.Microsecond).Add(time.Microsecond)
+	if err := s.store.UpsertUserTokenRevocation(userId, now); err != nil {
+		return fmt.Errorf("insert user token revocation: %v", err)
+	}
+	s.mu.Lock()
+	s.revokedBefore[userId] = now
+	s.mu.Unlock()
+	return nil
+}
+
+// Drop revocations of tokens that have expired anyway and reload the rest from store, picking up
+// revocations made by other instances
+func (s *revocationStore) sync(maxTokenAge time.Duration) error {
+	now := time.Now()
+	if err := s.store.DeleteOutdatedRevocations(now, now.Add(-maxTokenAge)); err != nil {
+		return err
+	}
+	tokens, revokedBefore, err := s.store.SelectRevocations()
+	if err != nil {
+		return err
+	}
+
+	// Keep revocations made locally while store was being read
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for jti, expiresAt := range s.tokens {
+		if _, ok := tokens[jti]; !ok && expiresAt.After(now) {
+			tokens[jti] = expiresAt
+		}
+	}
+	for userId, before := range s.revokedBefore {
+		if before.After(revokedBefore[userId]) && before.After(now.Add(-maxTokenAge)) {
+			revokedBefore[userId] = before
+		}
+	}
+	s.tokens = tokens
+	s.revokedBefore = revokedBefore
+	return nil
+}
+
+func (s *revocationStore) syncPeriodically(interval time.Duration, maxTokenAge time.Duration) {
+	for range time.Tick(interval) {
+		if err := s.sync(maxTokenAge); err != nil {
+			logE.Printf("sync token revocations: %v", err)
+		}
+	}
+}
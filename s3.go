@@ -0,0 +1,290 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// sha256 of empty payload
+const emptyPayloadHash = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+// Blobs stored in S3-compatible object storage (AWS S3, MinIO, Ceph RGW, ...). Requests are signed
+// with AWS Signature Version 4.
+type s3BlobStore struct {
+	endpoint  *url.URL
+	region    string
+	bucket    string
+	accessKey string
+	secretKey string
+	pathStyle bool
+	client    *http.Client
+}
+
+func newS3BlobStore(conf *config) (*s3BlobStore, error) {
+	endpoint, err := url.Parse(conf.S3Endpoint)
+	if err != nil || endpoint.Host == "" {
+		return nil, fmt.Errorf("invalid s3_endpoint %q", conf.S3Endpoint)
+	}
+	region := conf.S3Region
+	if region == "" {
+		region = "us-east-1"
+	}
+	return &s3BlobStore{
+		endpoint:  endpoint,
+		region:    region,
+		bucket:    conf.S3Bucket,
+		accessKey: conf.S3AccessKey,
+		secretKey: conf.S3SecretKey,
+		pathStyle: conf.S3PathStyle,
+		client:    &http.Client{},
+	}, nil
+}
+
+func (s *s3BlobStore) objectUrl(key string) *url.URL {
+	u := *s.endpoint
+	var segments []string
+	if s.pathStyle {
+		segments = append(segments, s.bucket)
+	} else {
+		u.Host = s.bucket + "." + u.Host
+	}
+	segments = append(segments, strings.Split(key, "/")...)
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/" + strings.Join(segments, "/")
+	for i := range segments {
+		segments[i] = s3Escape(segments[i])
+	}
+	u.RawPath = strings.TrimSuffix(s.endpoint.EscapedPath(), "/") + "/" + strings.Join(segments, "/")
+	return &u
+}
+
+func (s *s3BlobStore) do(ctx context.Context, method, key string, body io.Reader, size int64, payloadHash string,
+	header http.Header) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, s.objectUrl(key).String(), body)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	if body != nil {
+		req.ContentLength = size
+	}
+	signS3Request(req, payloadHash, s.accessKey, s.secretKey, s.region, time.Now())
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 300 {
+		defer resp.Body.Close()
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		return nil, fmt.Errorf("s3 %s %s: %s: %s", method, key, resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return resp, nil
+}
+
+// Content is spooled to temporary file first: payload hash and length have to be known before
+// request is signed
+func (s *s3BlobStore) Put(ctx context.Context, key string, r io.Reader) (int64, string, error) {
+	tmp, err := ioutil.TempFile("", "audyos-upload-")
+	if err != nil {
+		return 0, "", fmt.Errorf("create temp file: %v", err)
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+	hash := sha256.New()
+	size, err := io.Copy(io.MultiWriter(tmp, hash), r)
+	if err != nil {
+		return 0, "", err
+	}
+	if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+		return 0, "", fmt.Errorf("rewind temp file: %v", err)
+	}
+	checksum := hex.EncodeToString(hash.Sum(nil))
+	resp, err := s.do(ctx, http.MethodPut, key, ioutil.NopCloser(tmp), size, checksum, nil)
+	if err != nil {
+		return 0, "", err
+	}
+	resp.Body.Close()
+	return size, checksum, nil
+}
+
+func (s *s3BlobStore) Open(ctx context.Context, key string) (BlobReader, error) {
+	resp, err := s.do(ctx, http.MethodHead, key, nil, 0, emptyPayloadHash, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	return &s3Reader{ctx: ctx, store: s, key: key, size: resp.ContentLength}, nil
+}
+
+func (s *s3BlobStore) Delete(ctx context.Context, key string) error {
+	resp, err := s.do(ctx, http.MethodDelete, key, nil, 0, emptyPayloadHash, nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// Seekable reader of S3 object. Object is requested lazily starting from current offset, so
+// seeking before reading costs nothing and ranged reads fetch only the requested bytes.
+type s3Reader struct {
+	ctx    context.Context
+	store  *s3BlobStore
+	key    string
+	size   int64
+	offset int64
+	body   io.ReadCloser
+}
+
+func (r *s3Reader) Read(p []byte) (int, error) {
+	if r.offset >= r.size {
+		return 0, io.EOF
+	}
+	if r.body == nil {
+		header := http.Header{}
+		header.Set("Range", "bytes="+strconv.FormatInt(r.offset, 10)+"-")
+		resp, err := r.store.do(r.ctx, http.MethodGet, r.key, nil, 0, emptyPayloadHash, header)
+		if err != nil {
+			return 0, err
+		}
+		r.body = resp.Body
+	}
+	n, err := r.body.Read(p)
+	r.offset += int64(n)
+	if err == io.EOF && r.offset < r.size {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+func (r *s3Reader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += r.offset
+	case io.SeekEnd:
+		offset += r.size
+	default:
+		return 0, fmt.Errorf("invalid whence %d", whence)
+	}
+	if offset < 0 {
+		return 0, fmt.Errorf("negative offset")
+	}
+	if offset != r.offset && r.body != nil {
+		r.body.Close()
+		r.body = nil
+	}
+	r.offset = offset
+	return offset, nil
+}
+
+func (r *s3Reader) Close() error {
+	if r.body != nil {
+		return r.body.Close()
+	}
+	return nil
+}
+
+// Escape path segment as required by SigV4: everything except unreserved characters
+func s3Escape(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' || c == '-' || c == '_' || c == '.' || c == '~' {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+func hmacSha256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// Sign request with AWS Signature Version 4 (single chunk payload)
+func signS3Request(req *http.Request, payloadHash, accessKey, secretKey, region string, now time.Time) {
+	amzDate := now.UTC().Format("20060102T150405Z")
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	credential, signedHeaders, signature := s3Signature(req, accessKey, secretKey, region)
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s, SignedHeaders=%s, Signature=%s",
+		credential, signedHeaders, signature))
+}
+
+// Compute signature of request already carrying X-Amz-Date and X-Amz-Content-Sha256 headers.
+// Host, Range and all X-Amz-* headers are signed.
+func s3Signature(req *http.Request, accessKey, secretKey, region string) (credential, signedHeaders, signature string) {
+	amzDate := req.Header.Get("X-Amz-Date")
+	date := amzDate
+	if len(date) > 8 {
+		date = date[:8]
+	}
+	host := req.Host
+	if host == "" {
+		host = req.URL.Host
+	}
+	headers := map[string]string{"host": host}
+	for name, values := range req.Header {
+		name = strings.ToLower(name)
+		if name == "range" || strings.HasPrefix(name, "x-amz-") {
+			headers[name] = strings.Join(values, ",")
+		}
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + strings.TrimSpace(headers[name]) + "\n")
+	}
+	signedHeaders = strings.Join(names, ";")
+
+	query := req.URL.Query()
+	queryKeys := make([]string, 0, len(query))
+	for k := range query {
+		queryKeys = append(queryKeys, k)
+	}
+	sort.Strings(queryKeys)
+	var canonicalQuery []string
+	for _, k := range queryKeys {
+		for _, v := range query[k] {
+			canonicalQuery = append(canonicalQuery, s3Escape(k)+"="+s3Escape(v))
+		}
+	}
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		strings.Join(canonicalQuery, "&"),
+		canonicalHeaders.String(),
+		signedHeaders,
+		req.Header.Get("X-Amz-Content-Sha256"),
+	}, "\n")
+	scope := date + "/" + region + "/s3/aws4_request"
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(requestHash[:])
+	key := hmacSha256([]byte("AWS4"+secretKey), date)
+	key = hmacSha256(key, region)
+	key = hmacSha256(key, "s3")
+	key = hmacSha256(key, "aws4_request")
+	return accessKey + "/" + scope, signedHeaders, hex.EncodeToString(hmacSha256(key, stringToSign))
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"html"
+	"net/http"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+const (
+	defaultSearchConfig = "simple"
+	maxRecordTags       = 32
+	maxTagLength        = 64
+	// Markers of matches in ts_headline output, replaced with <mark> tags after text is escaped
+	headlineStart = "\x02"
+	headlineStop  = "\x03"
+	// Options of ts_headline: number of fragments and their bounds in words
+	headlineMaxFragments = 2
+	headlineMaxWords     = 15
+	headlineMinWords     = 5
+)
+
+// Normalize tags of record: trimmed, lower case, sorted, without duplicates
+func normalizeTags(tags []string) ([]string, error) {
+	if len(tags) > maxRecordTags {
+		return nil, fmt.Errorf("record can not have more than %d tags", maxRecordTags)
+	}
+	res := []string{}
+	seen := make(map[string]bool)
+	for _, tag := range tags {
+		tag = strings.ToLower(strings.TrimSpace(tag))
+		if tag == "" || utf8.RuneCountInString(tag) > maxTagLength {
+			return nil, fmt.Errorf("tag must be from 1 to %d characters long", maxTagLength)
+		}
+		if !seen[tag] {
+			seen[tag] = true
+			res = append(res, tag)
+		}
+	}
+	sort.Strings(res)
+	return res, nil
+}
+
+// Escape ts_headline output for html, turning match markers into <mark> tags
+func highlight(headline string) string {
+	escaped := html.EscapeString(headline)
+	return strings.NewReplacer(headlineStart, "<mark>", headlineStop, "</mark>").Replace(escaped)
+}
+
+type searchResult struct {
+	*recordInfo
+	OwnerName string  `json:"owner_name"`
+	Rank      float64 `json:"rank"`
+	// Fragments of name and description with matches wrapped into <mark> tags, html-escaped
+	Highlights struct {
+		Name        string `json:"name"`
+		Description string `json:"description"`
+	} `json:"highlights"`
+}
+
+var searchOrder = &keysetOrder{
+	name:    "rank",
+	columns: []string{"M.rank", "M.id"},
+	desc:    []bool{true, false},
+	sample:  []interface{}{float64(0), int64(0)},
+}
+
+// Full-text search over names, tags, descriptions and owner names of records available to user.
+// Query is in web search syntax: quoted phrases, "or" and "-" for negation are supported.
+// Note: needs auth
+func (a *Api) HandleSearch(w http.ResponseWriter, r *http.Request, userId int64) {
+	text := strings.TrimSpace(r.URL.Query().Get("q"))
+	if text == "" {
+		replyWithError(w, http.StatusBadRequest, fmt.Errorf("q param is not set"))
+		return
+	}
+	page, err := parsePageRequest(r, searchOrder)
+	if err != nil {
+		replyWithError(w, http.StatusBadRequest, err)
+		return
+	}
+	results, total, err := a.store.SearchRecords(userId, text, a.config().searchConfig(), page)
+	if err != nil {
+		err = fmt.Errorf("search records for user %d: %v", userId, err)
+		logE.Print(err)
+		replyWithError(w, http.StatusInternalServerError, err)
+		return
+	}
+	resBody := struct {
+		TotalCount int64           `json:"total_count"`
+		Results    []*searchResult `json:"results"`
+		NextCursor string          `json:"next_cursor,omitempty"`
+	}{TotalCount: total, Results: results}
+	selected := len(resBody.Results)
+	if selected > page.limit {
+		resBody.Results = resBody.Results[:page.limit]
+	}
+	if resBody.NextCursor, err = page.nextCursor(selected, searchOrder, func() []interface{} {
+		last := resBody.Results[len(resBody.Results)-1]
+		return []interface{}{last.Rank, last.Id}
+	}); err != nil {
+		err = fmt.Errorf("encode cursor: %v", err)
+		logE.Print(err)
+		replyWithError(w, http.StatusInternalServerError, err)
+		return
+	}
+	for _, res := range resBody.Results {
+		res.Highlights.Name = highlight(res.Highlights.Name)
+		res.Highlights.Description = highlight(res.Highlights.Description)
+		if res.Tags, err = a.store.SelectRecordTags(res.Id); err != nil {
+			err = fmt.Errorf("select tags of record %d: %v", res.Id, err)
+			logE.Print(err)
+			replyWithError(w, http.StatusInternalServerError, err)
+			return
+		}
+	}
+	res, err := json.Marshal(resBody)
+	if err != nil {
+		err = fmt.Errorf("encode search results: %v", err)
+		logE.Print(err)
+		replyWithError(w, http.StatusInternalServerError, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	fmt.Fprint(w, string(res))
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+)
+
+// Statuses of sharing: records shared to user are visible to user only once sharing is accepted
+const (
+	sharePending  = "pending"
+	shareAccepted = "accepted"
+	shareDeclined = "declined"
+)
+
+// Incoming sharing waiting for decision of user or already decided
+type incomingShare struct {
+	RecordId     int64      `json:"record_id"`
+	RecordName   string     `json:"record_name"`
+	OwnerId      int64      `json:"owner_id"`
+	OwnerName    string     `json:"owner_name"`
+	SharedById   int64      `json:"shared_by_id"`
+	SharedByName string     `json:"shared_by_name"`
+	Permission   permission `json:"permission"`
+	Status       string     `json:"status"`
+}
+
+var incomingSharesOrder = &keysetOrder{
+	name:    "record",
+	columns: []string{"S.record_id"},
+	desc:    []bool{true},
+	sample:  []interface{}{int64(0)},
+}
+
+// List sharings of records to user with given status: pending (default), accepted or declined
+// Note: needs auth
+func (a *Api) HandleIncomingShares(w http.ResponseWriter, r *http.Request, userId int64) {
+	status := r.URL.Query().Get("status")
+	switch status {
+	case "":
+		status = sharePending
+	case sharePending, shareAccepted, shareDeclined:
+	default:
+		replyWithError(w, http.StatusBadRequest, fmt.Errorf("invalid status param: %q", status))
+		return
+	}
+	page, err := parsePageRequest(r, incomingSharesOrder)
+	if err != nil {
+		replyWithError(w, http.StatusBadRequest, err)
+		return
+	}
+	shares, err := a.store.ListIncomingShares(userId, status, page)
+	if err != nil {
+		err = fmt.Errorf("select incoming sharings of user %d: %v", userId, err)
+		logE.Print(err)
+		replyWithError(w, http.StatusInternalServerError, err)
+		return
+	}
+	resBody := struct {
+		Shares     []*incomingShare `json:"shares"`
+		NextCursor string           `json:"next_cursor,omitempty"`
+	}{Shares: shares}
+	selected := len(resBody.Shares)
+	if selected > page.limit {
+		resBody.Shares = resBody.Shares[:page.limit]
+	}
+	if resBody.NextCursor, err = page.nextCursor(selected, incomingSharesOrder, func() []interface{} {
+		return []interface{}{resBody.Shares[len(resBody.Shares)-1].RecordId}
+	}); err != nil {
+		err = fmt.Errorf("encode cursor: %v", err)
+		logE.Print(err)
+		replyWithError(w, http.StatusInternalServerError, err)
+		return
+	}
+	res, err := json.Marshal(resBody)
+	if err != nil {
+		err = fmt.Errorf("encode incoming sharings of user %d: %v", userId, err)
+		logE.Print(err)
+		replyWithError(w, http.StatusInternalServerError, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	fmt.Fprint(w, string(res))
+}
+
+// Accept record shared to user, so that it appears in user's records
+// Note: needs auth
+func (a *Api) HandleAcceptShare(w http.ResponseWriter, r *http.Request, userId int64) {
+	a.decideShare(w, r, userId, shareAccepted)
+}
+
+// Decline record shared to user; declined sharing is not offered again
+// Note: needs auth
+func (a *Api) HandleDeclineShare(w http.ResponseWriter, r *http.Request, userId int64) {
+	a.decideShare(w, r, userId, shareDeclined)
+}
+
+func (a *Api) decideShare(w http.ResponseWriter, r *http.Request, userId int64, status string) {
+	defer r.Body.Close()
+	var reqBody struct {
+		RecordId int64 `json:"record_id"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&reqBody); err != nil {
+		err = fmt.Errorf("decode request body: %v", err)
+		logI.Print(err)
+		replyWithError(w, http.StatusBadRequest, err)
+		return
+	}
+	updated, err := a.store.UpdateShareStatus(reqBody.RecordId, userId, status)
+	if err != nil {
+		err = fmt.Errorf("set status of sharing record %d to user %d: %v", reqBody.RecordId, userId, err)
+		logE.Print(err)
+		replyWithError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if !updated {
+		replyWithError(w, http.StatusNotFound, fmt.Errorf("record %d is not shared to user %d", reqBody.RecordId, userId))
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Block records from another user: new sharings from the user are rejected and pending ones are
+// declined. Records already accepted stay available.
+// Note: needs auth
+func (a *Api) HandleBlockUser(w http.ResponseWriter, r *http.Request, userId int64) {
+	blockedId, ok := decodeUserIdBody(w, r)
+	if !ok {
+		return
+	}
+	if blockedId == userId {
+		replyWithError(w, http.StatusBadRequest, fmt.Errorf("user can not block themselves"))
+		return
+	}
+	if err := a.store.BlockUser(userId, blockedId); err != nil {
+		err = fmt.Errorf("block user %d for user %d: %v", blockedId, userId, err)
+		logE.Print(err)
+		replyWithError(w, http.StatusInternalServerError, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Note: needs auth
+func (a *Api) HandleUnblockUser(w http.ResponseWriter, r *http.Request, userId int64) {
+	blockedId, ok := decodeUserIdBody(w, r)
+	if !ok {
+		return
+	}
+	if err := a.store.UnblockUser(userId, blockedId); err != nil {
+		err = fmt.Errorf("unblock user %d for user %d: %v", blockedId, userId, err)
+		logE.Print(err)
+		replyWithError(w, http.StatusInternalServerError, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func decodeUserIdBody(w http.ResponseWriter, r *http.Request) (int64, bool) {
+	defer r.Body.Close()
+	var reqBody struct {
+		UserId int64 `json:"user_id"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&reqBody); err != nil {
+		err = fmt.Errorf("decode request body: %v", err)
+		logI.Print(err)
+		replyWithError(w, http.StatusBadRequest, err)
+		return 0, false
+	}
+	return reqBody.UserId, true
+}
+
+// List users whose records user has blocked
+// Note: needs auth
+func (a *Api) HandleBlockedUsers(w http.ResponseWriter, r *http.Request, userId int64) {
+	users, err := a.store.SelectBlockedUsers(userId)
+	if err != nil {
+		err = fmt.Errorf("select users blocked by user %d: %v", userId, err)
+		logE.Print(err)
+		replyWithError(w, http.StatusInternalServerError, err)
+		return
+	}
+	res, err := json.Marshal(struct {
+		Users []*userInfo `json:"users"`
+	}{users})
+	if err != nil {
+		err = fmt.Errorf("encode users blocked by user %d: %v", userId, err)
+		logE.Print(err)
+		replyWithError(w, http.StatusInternalServerError, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	fmt.Fprint(w, string(res))
+}
+
+type userSettings struct {
+	// Make records shared to user available right away instead of waiting for acceptance
+	AutoAcceptShares bool `json:"auto_accept_shares"`
+}
+
+// Get settings of user or change them with PATCH; fields that are not passed are left as they are
+// Note: needs auth
+func (a *Api) HandleUserSettings(w http.ResponseWriter, r *http.Request, userId int64) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPatch:
+		defer r.Body.Close()
+		var reqBody struct {
+			AutoAcceptShares *bool `json:"auto_accept_shares"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&reqBody); err != nil {
+			err = fmt.Errorf("decode request body: %v", err)
+			logI.Print(err)
+			replyWithError(w, http.StatusBadRequest, err)
+			return
+		}
+		if err := a.store.UpdateUserSettings(userId, reqBody.AutoAcceptShares); err != nil {
+			err = fmt.Errorf("update settings of user %d: %v", userId, err)
+			logE.Print(err)
+			replyWithError(w, http.StatusInternalServerError, err)
+			return
+		}
+	default:
+		replyWithError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s is not allowed", r.Method))
+		return
+	}
+	settings, err := a.store.SelectUserSettings(userId)
+	if err != nil {
+		err = fmt.Errorf("select settings of user %d: %v", userId, err)
+		logE.Print(err)
+		replyWithError(w, http.StatusInternalServerError, err)
+		return
+	}
+	res, err := json.Marshal(settings)
+	if err != nil {
+		err = fmt.Errorf("encode settings of user %d: %v", userId, err)
+		logE.Print(err)
+		replyWithError(w, http.StatusInternalServerError, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	fmt.Fprint(w, string(res))
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"database/sql"
+	"github.com/pkg/errors"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Timestamps are stored in SQLite as text in UTC with fixed number of fraction digits, so that
+// comparing them as strings gives the same result as comparing times. Column defaults of
+// migrations produce the same format.
+const sqliteTimeLayout = "2006-01-02 15:04:05.000000000+00:00"
+
+var (
+	postgresParamRe = regexp.MustCompile(`\$(\d+)`)
+	rowLockRe       = regexp.MustCompile(`\s+FOR UPDATE( OF \w+)?`)
+)
+
+// Open SQLite database at path; ":memory:" opens a new database in memory. The only connection
+// is used, since SQLite locks the whole database for writes anyway, and in-memory database lives
+// as long as its connection does.
+func openSQLite(path string) (*sql.DB, error) {
+	db, err := sql.Open("sqlite3", path+"?_busy_timeout=5000&_txlock=immediate&_loc=UTC")
+	if err != nil {
+		return nil, errors.Wrap(err, "validate sqlite params")
+	}
+	db.SetMaxOpenConns(1)
+	if err := db.Ping(); err != nil {
+		return nil, errors.Wrap(err, "open "+path)
+	}
+	return db, nil
+}
+
+// Translate query written for Postgres: numbered params become ?NNN ones, since SQLite numbers
+// $-params in order of appearance, GREATEST becomes scalar MAX and row locks are dropped, since
+// transaction locks the whole database. Times are passed in sqliteTimeLayout.
+func rebindSQLite(query string, args []interface{}) (string, []interface{}) {
+	query = postgresParamRe.ReplaceAllString(query, "?$1")
+	query = strings.ReplaceAll(query, "GREATEST(", "MAX(")
+	query = rowLockRe.ReplaceAllString(query, "")
+	converted := make([]interface{}, len(args))
+	for i, arg := range args {
+		switch v := arg.(type) {
+		case time.Time:
+			arg = v.UTC().Format(sqliteTimeLayout)
+		case *time.Time:
+			if v != nil {
+				arg = v.UTC().Format(sqliteTimeLayout)
+			}
+		}
+		converted[i] = arg
+	}
+	return query, converted
+}
+
+// SQLite has no full-text search compatible with Postgres one, so records visible to user are
+// matched by emulated search
+func (s *sqlStore) searchRecordsEmulated(userId int64, text string, page *pageRequest) ([]*searchResult, int64, error) {
+	query := parseTextQuery(text)
+	if query.empty() {
+		return []*searchResult{}, 0, nil
+	}
+	q := &queryArgs{}
+	user := q.add(userId)
+	rows, err := s.db.Query(`
+SELECT `+recordColumns+`,
+       `+recordPermission(user)+`,
+       U.name,
+       COALESCE((SELECT group_concat(T.tag, ' ') FROM record_tags T WHERE T.record_id=R.id), '')
+FROM records R
+JOIN users U ON U.id=R.owner_id
+WHERE `+recordVisibleTo(user)+`;`, q.args...)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+	var matches []*searchResult
+	for rows.Next() {
+		res := &searchResult{}
+		var perm permission
+		var tags string
+		if res.recordInfo, err = scanRecord(rows, &perm, &res.OwnerName, &tags); err != nil {
+			return nil, 0, err
+		}
+		res.Permission = perm
+		if query.match(res, tags) {
+			matches = append(matches, res)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, 0, err
+	}
+	results, total := pageSearchResults(matches, page)
+	return results, total, nil
+}
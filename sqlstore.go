@@ -0,0 +1,1502 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// SQL database along with its kind: postgres or sqlite. Queries are written for Postgres and
+// translated by rebind for other databases; differences that can not be translated are handled
+// where they matter by checking the kind.
+type sqlDB struct {
+	*sql.DB
+	database string
+}
+
+func (db *sqlDB) rebind(query string, args []interface{}) (string, []interface{}) {
+	if db.database == databaseSQLite {
+		return rebindSQLite(query, args)
+	}
+	return query, args
+}
+
+func (db *sqlDB) Exec(query string, args ...interface{}) (sql.Result, error) {
+	query, args = db.rebind(query, args)
+	return db.DB.Exec(query, args...)
+}
+
+func (db *sqlDB) Query(query string, args ...interface{}) (*sql.Rows, error) {
+	query, args = db.rebind(query, args)
+	return db.DB.Query(query, args...)
+}
+
+func (db *sqlDB) QueryRow(query string, args ...interface{}) *sql.Row {
+	query, args = db.rebind(query, args)
+	return db.DB.QueryRow(query, args...)
+}
+
+func (db *sqlDB) Begin() (*sqlTx, error) {
+	tx, err := db.DB.Begin()
+	if err != nil {
+		return nil, err
+	}
+	return &sqlTx{tx, db}, nil
+}
+
+// Transaction translating queries the same way as its database does
+type sqlTx struct {
+	*sql.Tx
+	db *sqlDB
+}
+
+func (tx *sqlTx) Exec(query string, args ...interface{}) (sql.Result, error) {
+	query, args = tx.db.rebind(query, args)
+	return tx.Tx.Exec(query, args...)
+}
+
+func (tx *sqlTx) QueryRow(query string, args ...interface{}) *sql.Row {
+	query, args = tx.db.rebind(query, args)
+	return tx.Tx.QueryRow(query, args...)
+}
+
+// Store on top of Postgres or SQLite database with schema created by migrations
+type sqlStore struct {
+	db *sqlDB
+}
+
+func newSqlStore(db *sql.DB, database string) *sqlStore {
+	return &sqlStore{db: &sqlDB{db, database}}
+}
+
+func (s *sqlStore) Close() error {
+	return s.db.Close()
+}
+
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+type execer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+}
+
+// Number of rows affected by statement is exactly one
+func affectedOne(res sql.Result, err error) (bool, error) {
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n == 1, err
+}
+
+// Insert new user; with invitation token records shared to user's email before registration are
+// shared to the user. Emails are only trusted along with invitation token sent to them, otherwise
+// anyone could claim records shared to someone else's email. Email verified by invitation is taken
+// from user who has not verified it.
+func (s *sqlStore) RegisterUser(login, passwordHash, name, email, invitation string) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	now := time.Now()
+	if invitation != "" {
+		var invited int
+		err := tx.QueryRow(`
+SELECT COUNT(*) FROM invitations
+WHERE token_hash=$1 AND LOWER(email)=LOWER($2) AND expires_at>$3;
+`, hashRefreshToken(invitation), email, now).Scan(&invited)
+		if err != nil {
+			return err
+		}
+		if invited == 0 {
+			return errInvitationInvalid
+		}
+		_, err = tx.Exec(`
+UPDATE users SET email=NULL, email_token_hash=NULL, email_token_expires_at=NULL
+WHERE LOWER(email)=LOWER($1) AND NOT email_verified;
+`, email)
+		if err != nil {
+			return fmt.Errorf("release unverified email: %v", err)
+		}
+	}
+	var nullableEmail sql.NullString
+	if email != "" {
+		var taken bool
+		err := tx.QueryRow("SELECT EXISTS (SELECT 1 FROM users WHERE LOWER(email)=LOWER($1));", email).Scan(&taken)
+		if err != nil {
+			return err
+		}
+		if taken {
+			return errEmailTaken
+		}
+		nullableEmail = sql.NullString{String: email, Valid: true}
+	}
+	var userId int64
+	err = tx.QueryRow(`
+INSERT INTO users(login, password, name, email, email_verified) VALUES($1,$2,$3,$4,$5) RETURNING id;
+`, login, passwordHash, name, nullableEmail, invitation != "").Scan(&userId)
+	if err != nil {
+		return err
+	}
+	if invitation != "" {
+		_, err = tx.Exec(`
+INSERT INTO shared(record_id, "to", permission, shared_by)
+SELECT I.record_id, $1, I.permission, I.invited_by
+FROM invitations I
+JOIN records R ON R.id=I.record_id
+WHERE LOWER(I.email)=LOWER($2) AND I.expires_at>$3;
+`, userId, email, now)
+		if err != nil {
+			return fmt.Errorf("share records from invitations: %v", err)
+		}
+		if _, err := tx.Exec("DELETE FROM invitations WHERE LOWER(email)=LOWER($1);", email); err != nil {
+			return fmt.Errorf("delete invitations: %v", err)
+		}
+	}
+	return tx.Commit()
+}
+
+func (s *sqlStore) InsertEmailConfirmation(userId int64, ttl time.Duration) (email, token string, err error) {
+	if token, err = randomToken(32); err != nil {
+		return "", "", fmt.Errorf("generate confirmation token: %v", err)
+	}
+	err = s.db.QueryRow(`
+UPDATE users SET email_token_hash=$1, email_token_expires_at=$2
+WHERE id=$3 AND email IS NOT NULL AND NOT email_verified
+RETURNING email;
+`, hashRefreshToken(token), time.Now().Add(ttl), userId).Scan(&email)
+	if err == sql.ErrNoRows {
+		return "", "", errNoEmailToConfirm
+	}
+	return email, token, err
+}
+
+// Verify email of user the token was sent to. Records from invitations to the email are shared to
+// the user, the same way as on registration with invitation, unless user has blocked inviter.
+func (s *sqlStore) ConfirmEmail(token string) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	now := time.Now()
+	var userId int64
+	var email string
+	err = tx.QueryRow(`
+UPDATE users SET email_verified=TRUE, email_token_hash=NULL, email_token_expires_at=NULL
+WHERE email_token_hash=$1 AND email_token_expires_at>$2 AND email IS NOT NULL
+RETURNING id, email;
+`, hashRefreshToken(token), now).Scan(&userId, &email)
+	if err == sql.ErrNoRows {
+		return errConfirmationInvalid
+	}
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(`
+INSERT INTO shared(record_id, "to", permission, shared_by, status)
+SELECT I.record_id, U.id, I.permission, I.invited_by, CASE WHEN U.auto_accept_shares THEN 'accepted' ELSE 'pending' END
+FROM invitations I
+JOIN records R ON R.id=I.record_id
+JOIN users U ON U.id=$1
+WHERE LOWER(I.email)=LOWER($2) AND I.expires_at>$3 AND R.owner_id<>U.id
+  AND NOT EXISTS (SELECT 1 FROM shared S WHERE S.record_id=I.record_id AND S."to"=U.id)
+  AND NOT EXISTS (SELECT 1 FROM blocked_users B WHERE B.user_id=U.id AND B.blocked_id=I.invited_by);
+`, userId, email, now)
+	if err != nil {
+		return fmt.Errorf("share records from invitations: %v", err)
+	}
+	if _, err := tx.Exec("DELETE FROM invitations WHERE LOWER(email)=LOWER($1);", email); err != nil {
+		return fmt.Errorf("delete invitations: %v", err)
+	}
+	return tx.Commit()
+}
+
+func (s *sqlStore) SelectUserCredentials(login string) (userId int64, passwordHash string, err error) {
+	err = s.db.QueryRow("SELECT id, password FROM users WHERE login=$1;", login).Scan(&userId, &passwordHash)
+	return userId, passwordHash, err
+}
+
+func (s *sqlStore) UpdateUserPassword(userId int64, passwordHash string) error {
+	_, err := s.db.Exec("UPDATE users SET password=$1 WHERE id=$2;", passwordHash, userId)
+	return err
+}
+
+func (s *sqlStore) SelectUserName(userId int64) (string, error) {
+	var name string
+	err := s.db.QueryRow("SELECT name FROM users WHERE id=$1;", userId).Scan(&name)
+	return name, err
+}
+
+// Select user with given verified email or, failing that, with given login; emails are compared
+// case-insensitively
+func (s *sqlStore) SelectUserByLoginOrEmail(loginOrEmail string) (*userInfo, error) {
+	u := &userInfo{}
+	err := s.db.QueryRow("SELECT id, login, name FROM users WHERE LOWER(email)=LOWER($1) AND email_verified;",
+		loginOrEmail).Scan(&u.Id, &u.Login, &u.Name)
+	if err == sql.ErrNoRows {
+		err = s.db.QueryRow("SELECT id, login, name FROM users WHERE login=$1;", loginOrEmail).Scan(&u.Id, &u.Login, &u.Name)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return u, nil
+}
+
+func (s *sqlStore) SelectUserSettings(userId int64) (*userSettings, error) {
+	settings := &userSettings{}
+	err := s.db.QueryRow("SELECT auto_accept_shares FROM users WHERE id=$1;", userId).Scan(&settings.AutoAcceptShares)
+	if err != nil {
+		return nil, err
+	}
+	return settings, nil
+}
+
+func (s *sqlStore) UpdateUserSettings(userId int64, autoAcceptShares *bool) error {
+	_, err := s.db.Exec("UPDATE users SET auto_accept_shares=COALESCE($1, auto_accept_shares) WHERE id=$2;",
+		autoAcceptShares, userId)
+	return err
+}
+
+func (s *sqlStore) IsBlocked(userId, blockedId int64) (bool, error) {
+	var blocked bool
+	err := s.db.QueryRow("SELECT EXISTS (SELECT 1 FROM blocked_users WHERE user_id=$1 AND blocked_id=$2);",
+		userId, blockedId).Scan(&blocked)
+	return blocked, err
+}
+
+func (s *sqlStore) BlockUser(userId, blockedId int64) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	_, err = tx.Exec(`
+INSERT INTO blocked_users(user_id, blocked_id, created_at) VALUES($1,$2,$3)
+ON CONFLICT (user_id, blocked_id) DO NOTHING;
+`, userId, blockedId, time.Now())
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(`UPDATE shared SET status=$1 WHERE "to"=$2 AND shared_by=$3 AND status=$4;`,
+		shareDeclined, userId, blockedId, sharePending)
+	if err != nil {
+		return fmt.Errorf("decline pending sharings: %v", err)
+	}
+	return tx.Commit()
+}
+
+func (s *sqlStore) UnblockUser(userId, blockedId int64) error {
+	_, err := s.db.Exec("DELETE FROM blocked_users WHERE user_id=$1 AND blocked_id=$2;", userId, blockedId)
+	return err
+}
+
+func (s *sqlStore) SelectBlockedUsers(userId int64) ([]*userInfo, error) {
+	rows, err := s.db.Query(`
+SELECT U.id, U.login, U.name
+FROM blocked_users B
+JOIN users U ON U.id=B.blocked_id
+WHERE B.user_id=$1
+ORDER BY U.id;
+`, userId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	users := []*userInfo{}
+	for rows.Next() {
+		u := &userInfo{}
+		if err := rows.Scan(&u.Id, &u.Login, &u.Name); err != nil {
+			return nil, err
+		}
+		users = append(users, u)
+	}
+	return users, rows.Err()
+}
+
+// Generate refresh token and persist it as member of token family. Every token obtained by
+// rotation of the token issued at login belongs to the same family.
+func insertRefreshToken(db execer, userId int64, familyId string, ttl time.Duration) (string, error) {
+	token, err := randomToken(32)
+	if err != nil {
+		return "", fmt.Errorf("generate refresh token: %v", err)
+	}
+	now := time.Now()
+	_, err = db.Exec(`
+INSERT INTO refresh_tokens(user_id, family_id, token_hash, created_at, expires_at)
+VALUES($1,$2,$3,$4,$5);
+`, userId, familyId, hashRefreshToken(token), now, now.Add(ttl))
+	if err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// Start new token family for user who has just logged in
+func (s *sqlStore) NewRefreshTokenFamily(userId int64, ttl time.Duration) (string, error) {
+	familyId, err := randomToken(16)
+	if err != nil {
+		return "", fmt.Errorf("generate token family id: %v", err)
+	}
+	return insertRefreshToken(s.db, userId, familyId, ttl)
+}
+
+// Exchange refresh token for a new one from the same family. Presenting a token that was already
+// rotated means it has been stolen (either by the caller or from the caller), so the whole family
+// gets revoked and errRefreshTokenReused is returned.
+func (s *sqlStore) RotateRefreshToken(token string, ttl time.Duration) (userId int64, login string, newToken string, err error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return 0, "", "", fmt.Errorf("begin tx: %v", err)
+	}
+	defer tx.Rollback()
+	var (
+		id        int64
+		familyId  string
+		expiresAt time.Time
+		usedAt    sql.NullTime
+		revokedAt sql.NullTime
+	)
+	err = tx.QueryRow(`
+SELECT R.id, R.user_id, R.family_id, R.expires_at, R.used_at, R.revoked_at, U.login
+FROM refresh_tokens R
+JOIN users U ON R.user_id=U.id
+WHERE R.token_hash=$1
+FOR UPDATE OF R;
+`, hashRefreshToken(token)).Scan(&id, &userId, &familyId, &expiresAt, &usedAt, &revokedAt, &login)
+	if err == sql.ErrNoRows {
+		return 0, "", "", errRefreshTokenInvalid
+	}
+	if err != nil {
+		return 0, "", "", fmt.Errorf("select refresh token: %v", err)
+	}
+	if revokedAt.Valid {
+		return 0, "", "", errRefreshTokenInvalid
+	}
+	now := time.Now()
+	if usedAt.Valid {
+		if _, err := tx.Exec("UPDATE refresh_tokens SET revoked_at=$1 WHERE family_id=$2 AND revoked_at IS NULL;",
+			now, familyId); err != nil {
+			return 0, "", "", fmt.Errorf("revoke token family: %v", err)
+		}
+		if err := tx.Commit(); err != nil {
+			return 0, "", "", fmt.Errorf("commit tx: %v", err)
+		}
+		return 0, "", "", errRefreshTokenReused
+	}
+	if !now.Before(expiresAt) {
+		return 0, "", "", errRefreshTokenInvalid
+	}
+	if _, err := tx.Exec("UPDATE refresh_tokens SET used_at=$1 WHERE id=$2;", now, id); err != nil {
+		return 0, "", "", fmt.Errorf("mark refresh token as used: %v", err)
+	}
+	if newToken, err = insertRefreshToken(tx, userId, familyId, ttl); err != nil {
+		return 0, "", "", fmt.Errorf("insert refresh token: %v", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, "", "", fmt.Errorf("commit tx: %v", err)
+	}
+	return userId, login, newToken, nil
+}
+
+// Revoke family of the given refresh token if it belongs to user
+func (s *sqlStore) RevokeRefreshTokenFamily(userId int64, token string) error {
+	_, err := s.db.Exec(`
+UPDATE refresh_tokens SET revoked_at=$1
+WHERE revoked_at IS NULL AND user_id=$2 AND family_id IN (
+    SELECT family_id FROM refresh_tokens WHERE token_hash=$3
+);
+`, time.Now(), userId, hashRefreshToken(token))
+	return err
+}
+
+func (s *sqlStore) RevokeUserRefreshTokens(userId int64) error {
+	_, err := s.db.Exec("UPDATE refresh_tokens SET revoked_at=$1 WHERE user_id=$2 AND revoked_at IS NULL;",
+		time.Now(), userId)
+	return err
+}
+
+func (s *sqlStore) InsertRevokedToken(jti string, userId int64, expiresAt time.Time) error {
+	_, err := s.db.Exec(`
+INSERT INTO revoked_tokens(jti, user_id, expires_at) VALUES($1,$2,$3)
+ON CONFLICT (jti) DO NOTHING;
+`, jti, userId, expiresAt)
+	return err
+}
+
+func (s *sqlStore) UpsertUserTokenRevocation(userId int64, revokedBefore time.Time) error {
+	_, err := s.db.Exec(`
+INSERT INTO user_token_revocations(user_id, revoked_before) VALUES($1,$2)
+ON CONFLICT (user_id) DO UPDATE SET revoked_before=EXCLUDED.revoked_before;
+`, userId, revokedBefore)
+	return err
+}
+
+func (s *sqlStore) DeleteOutdatedRevocations(now, revokedBefore time.Time) error {
+	if _, err := s.db.Exec("DELETE FROM revoked_tokens WHERE expires_at < $1;", now); err != nil {
+		return fmt.Errorf("delete expired revoked tokens: %v", err)
+	}
+	if _, err := s.db.Exec("DELETE FROM user_token_revocations WHERE revoked_before < $1;", revokedBefore); err != nil {
+		return fmt.Errorf("delete outdated user token revocations: %v", err)
+	}
+	return nil
+}
+
+func (s *sqlStore) SelectRevocations() (map[string]time.Time, map[int64]time.Time, error) {
+	tokens := make(map[string]time.Time)
+	rows, err := s.db.Query("SELECT jti, expires_at FROM revoked_tokens;")
+	if err != nil {
+		return nil, nil, fmt.Errorf("select revoked tokens: %v", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var jti string
+		var expiresAt time.Time
+		if err := rows.Scan(&jti, &expiresAt); err != nil {
+			return nil, nil, fmt.Errorf("scan revoked token: %v", err)
+		}
+		tokens[jti] = expiresAt
+	}
+	if err := rows.Err(); err != nil {
+		return nil, nil, fmt.Errorf("select revoked tokens: %v", err)
+	}
+
+	revokedBefore := make(map[int64]time.Time)
+	userRows, err := s.db.Query("SELECT user_id, revoked_before FROM user_token_revocations;")
+	if err != nil {
+		return nil, nil, fmt.Errorf("select user token revocations: %v", err)
+	}
+	defer userRows.Close()
+	for userRows.Next() {
+		var userId int64
+		var before time.Time
+		if err := userRows.Scan(&userId, &before); err != nil {
+			return nil, nil, fmt.Errorf("scan user token revocation: %v", err)
+		}
+		revokedBefore[userId] = before
+	}
+	if err := userRows.Err(); err != nil {
+		return nil, nil, fmt.Errorf("select user token revocations: %v", err)
+	}
+	return tokens, revokedBefore, nil
+}
+
+// SQL condition matching records R visible to user passed as param: own records, records shared
+// to user that user has accepted and records shared to groups user is member of. Group membership
+// is checked on each query, so changes take effect right away.
+func recordVisibleTo(userParam string) string {
+	return `(R.owner_id=` + userParam + ` OR EXISTS (
+    SELECT 1 FROM shared S WHERE S.record_id=R.id AND S."to"=` + userParam + ` AND S.status='accepted'
+) OR EXISTS (
+    SELECT 1 ` + groupSharesTo(userParam) + `
+))`
+}
+
+// SQL expression converting permission name stored in column to its level, so that permissions
+// can be compared
+func permissionLevel(column string) string {
+	expr := "CASE " + column
+	for p := permListen; p <= permOwner; p++ {
+		expr += fmt.Sprintf(" WHEN '%s' THEN %d", p, int(p))
+	}
+	return expr + " ELSE 0 END"
+}
+
+// SQL expression with level of permission of user passed as param to record R: owner for own
+// records, the highest of levels of accepted sharing to user and sharings to user's groups for
+// records shared to user and 0 otherwise
+func recordPermission(userParam string) string {
+	return fmt.Sprintf(`CASE WHEN R.owner_id=%s THEN %d ELSE GREATEST(
+    COALESCE((SELECT %s FROM shared S WHERE S.record_id=R.id AND S."to"=%s AND S.status='accepted'), 0),
+    COALESCE((SELECT MAX(%s) %s), 0)
+) END`, userParam, int(permOwner), permissionLevel("S.permission"), userParam, permissionLevel("G.permission"),
+		groupSharesTo(userParam))
+}
+
+// SQL FROM clause selecting sharings G of record R to groups user passed as param has accepted
+// membership in. Sharings made by users the user has blocked are skipped.
+func groupSharesTo(userParam string) string {
+	return `FROM group_shares G
+    JOIN group_members M ON M.group_id=G.group_id
+    WHERE G.record_id=R.id AND M.user_id=` + userParam + ` AND M.status='accepted'
+      AND NOT EXISTS (SELECT 1 FROM blocked_users B WHERE B.user_id=` + userParam + ` AND B.blocked_id=G.shared_by)`
+}
+
+// Columns of records R scanned by scanRecord
+const recordColumns = `R.id, R.name, R.description, R.owner_id, R.content_type, R.size, R.created_at, R.storage_key,
+       R.checksum, R.duration, R.codec, R.sample_rate, R.channels, R.bitrate`
+
+// Scan recordColumns followed by extra columns
+func scanRecord(row rowScanner, extra ...interface{}) (*recordInfo, error) {
+	rec := &recordInfo{}
+	var storageKey, checksum sql.NullString
+	dest := append([]interface{}{&rec.Id, &rec.Name, &rec.Description, &rec.OwnerId, &rec.ContentType, &rec.Size,
+		&rec.CreatedAt, &storageKey, &checksum, &rec.Duration, &rec.Codec, &rec.SampleRate, &rec.Channels,
+		&rec.Bitrate}, extra...)
+	if err := row.Scan(dest...); err != nil {
+		return nil, err
+	}
+	rec.StorageKey = storageKey.String
+	rec.Checksum = checksum.String
+	return rec, nil
+}
+
+// Insert record with content already put into blob store along with its tags and search vector,
+// filling in its id and creation time
+func (s *sqlStore) InsertRecord(rec *recordInfo, searchConfig string) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	rec.CreatedAt = time.Now()
+	err = tx.QueryRow(`
+INSERT INTO records(name, description, owner_id, content_type, size, checksum, storage_key,
+                    duration, codec, sample_rate, channels, bitrate, created_at)
+VALUES($1,$2,$3,$4,$5,$6,$7,$8,$9,$10,$11,$12,$13)
+RETURNING id;
+`, rec.Name, rec.Description, rec.OwnerId, rec.ContentType, rec.Size, rec.Checksum, rec.StorageKey,
+		rec.Duration, rec.Codec, rec.SampleRate, rec.Channels, rec.Bitrate, rec.CreatedAt).Scan(&rec.Id)
+	if err != nil {
+		return err
+	}
+	if rec.UploadId != "" {
+		// Record is made of upload only once, even if previous attempt failed after insertion
+		ok, err := affectedOne(tx.Exec("UPDATE uploads SET record_id=$1 WHERE id=$2 AND record_id IS NULL;",
+			rec.Id, rec.UploadId))
+		if err != nil {
+			return fmt.Errorf("link upload: %v", err)
+		}
+		if !ok {
+			return fmt.Errorf("upload %s already has record", rec.UploadId)
+		}
+	}
+	if err := replaceRecordTags(tx, rec.Id, rec.Tags); err != nil {
+		return fmt.Errorf("insert tags: %v", err)
+	}
+	if err := updateRecordSearchVector(tx, rec.Id, searchConfig); err != nil {
+		return fmt.Errorf("update search vector: %v", err)
+	}
+	return tx.Commit()
+}
+
+func (s *sqlStore) SelectRecord(recordId int64, userId int64) (*recordInfo, error) {
+	var perm permission
+	rec, err := scanRecord(s.db.QueryRow(`
+SELECT `+recordColumns+`,
+       `+recordPermission("$2")+`
+FROM records R
+WHERE R.id=$1 AND `+recordVisibleTo("$2")+`;
+`, recordId, userId), &perm)
+	if err != nil {
+		return nil, err
+	}
+	rec.Permission = perm
+	return rec, nil
+}
+
+// Content of records created before blob store was introduced is returned if it has not been
+// moved to blob store yet
+func (s *sqlStore) SelectRecordContent(recordId int64, userId int64) (*recordInfo, []byte, error) {
+	var content []byte
+	var perm permission
+	rec, err := scanRecord(s.db.QueryRow(`
+SELECT `+recordColumns+`,
+       `+recordPermission("$2")+`,
+       CASE WHEN R.storage_key IS NULL THEN R.content END
+FROM records R
+WHERE R.id=$1 AND `+recordVisibleTo("$2")+`;
+`, recordId, userId), &perm, &content)
+	if err != nil {
+		return nil, nil, err
+	}
+	rec.Permission = perm
+	return rec, content, nil
+}
+
+// Select record a public link is made to along with its content if it is not in blob store yet
+func (s *sqlStore) SelectLinkedRecordContent(recordId int64) (*recordInfo, []byte, error) {
+	var content []byte
+	rec, err := scanRecord(s.db.QueryRow(`
+SELECT `+recordColumns+`,
+       CASE WHEN R.storage_key IS NULL THEN R.content END
+FROM records R
+WHERE R.id=$1;
+`, recordId), &content)
+	if err != nil {
+		return nil, nil, err
+	}
+	return rec, content, nil
+}
+
+func (s *sqlStore) SelectRecordTags(recordId int64) ([]string, error) {
+	rows, err := s.db.Query("SELECT tag FROM record_tags WHERE record_id=$1 ORDER BY tag;", recordId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	tags := []string{}
+	for rows.Next() {
+		var tag string
+		if err := rows.Scan(&tag); err != nil {
+			return nil, err
+		}
+		tags = append(tags, tag)
+	}
+	return tags, rows.Err()
+}
+
+func replaceRecordTags(tx *sqlTx, recordId int64, tags []string) error {
+	if _, err := tx.Exec("DELETE FROM record_tags WHERE record_id=$1;", recordId); err != nil {
+		return err
+	}
+	for _, tag := range tags {
+		if _, err := tx.Exec("INSERT INTO record_tags(record_id, tag) VALUES($1,$2);", recordId, tag); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Rebuild search vector of record from its name, tags, description and owner name, weighted in
+// this order. SQLite has no search vectors, records are matched by emulated search there.
+func updateRecordSearchVector(tx *sqlTx, recordId int64, searchConfig string) error {
+	if tx.db.database == databaseSQLite {
+		return nil
+	}
+	_, err := tx.Exec(`
+UPDATE records R
+SET search_vector=setweight(to_tsvector($1::regconfig, R.name), 'A') ||
+                  setweight(to_tsvector($1::regconfig, COALESCE(
+                      (SELECT string_agg(T.tag, ' ') FROM record_tags T WHERE T.record_id=R.id), '')), 'B') ||
+                  setweight(to_tsvector($1::regconfig, R.description), 'C') ||
+                  setweight(to_tsvector($1::regconfig, U.name), 'D')
+FROM users U
+WHERE U.id=R.owner_id AND R.id=$2;
+`, searchConfig, recordId)
+	return err
+}
+
+func (s *sqlStore) UpdateRecord(recordId int64, name, description *string, tags []string, searchConfig string) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	_, err = tx.Exec(`
+UPDATE records SET name=COALESCE($1, name), description=COALESCE($2, description)
+WHERE id=$3;
+`, name, description, recordId)
+	if err != nil {
+		return err
+	}
+	if tags != nil {
+		if err := replaceRecordTags(tx, recordId, tags); err != nil {
+			return fmt.Errorf("replace tags: %v", err)
+		}
+	}
+	if err := updateRecordSearchVector(tx, recordId, searchConfig); err != nil {
+		return fmt.Errorf("update search vector: %v", err)
+	}
+	return tx.Commit()
+}
+
+func (s *sqlStore) DeleteRecord(recordId int64) (storageKey string, err error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec("DELETE FROM shared WHERE record_id=$1;", recordId); err != nil {
+		return "", fmt.Errorf("delete sharings: %v", err)
+	}
+	if _, err := tx.Exec("DELETE FROM group_shares WHERE record_id=$1;", recordId); err != nil {
+		return "", fmt.Errorf("delete group sharings: %v", err)
+	}
+	if _, err := tx.Exec("DELETE FROM record_tags WHERE record_id=$1;", recordId); err != nil {
+		return "", fmt.Errorf("delete tags: %v", err)
+	}
+	if _, err := tx.Exec("DELETE FROM share_links WHERE record_id=$1;", recordId); err != nil {
+		return "", fmt.Errorf("delete links: %v", err)
+	}
+	if _, err := tx.Exec("DELETE FROM invitations WHERE record_id=$1;", recordId); err != nil {
+		return "", fmt.Errorf("delete invitations: %v", err)
+	}
+	var key sql.NullString
+	err = tx.QueryRow("DELETE FROM records WHERE id=$1 RETURNING storage_key;", recordId).Scan(&key)
+	if err != nil {
+		return "", err
+	}
+	return key.String, tx.Commit()
+}
+
+// SQL conditions on records R; user is placeholder of id of user records are listed to
+func (f *recordsFilter) where(q *queryArgs, user string) []string {
+	var where []string
+	switch f.scope {
+	case "mine":
+		where = append(where, "R.owner_id="+user)
+	case "shared":
+		where = append(where, "R.owner_id<>"+user)
+	}
+	if f.ownerId != 0 {
+		where = append(where, "R.owner_id="+q.add(f.ownerId))
+	}
+	if !f.createdFrom.IsZero() {
+		where = append(where, "R.created_at>="+q.add(f.createdFrom))
+	}
+	if !f.createdTo.IsZero() {
+		where = append(where, "R.created_at<="+q.add(f.createdTo))
+	}
+	if f.durationMin > 0 {
+		where = append(where, "R.duration>="+q.add(f.durationMin))
+	}
+	if f.durationMax > 0 {
+		where = append(where, "R.duration<="+q.add(f.durationMax))
+	}
+	if f.search != "" {
+		where = append(where, `LOWER(R.name) LIKE `+q.add("%"+escapeLike(strings.ToLower(f.search))+"%")+` ESCAPE '\'`)
+	}
+	return where
+}
+
+// Escape wildcards of LIKE pattern
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(s)
+}
+
+// Records are selected into 'visible' table V, which order columns refer to
+func (s *sqlStore) ListRecords(userId int64, filter *recordsFilter, sortBy string, order *keysetOrder,
+	page *pageRequest) ([]*listedRecord, int64, error) {
+	q := &queryArgs{}
+	user := q.add(userId)
+	where := append([]string{recordVisibleTo(user)}, filter.where(q, user)...)
+	rows, err := s.db.Query(`
+WITH visible AS (
+    SELECT R.id,
+           R.name,
+           R.owner_id=`+user+` AS is_owner,
+           R.owner_id,
+           U.name AS owner_name,
+           R.size,
+           R.duration,
+           R.codec,
+           R.sample_rate,
+           R.channels,
+           R.bitrate,
+           R.created_at
+    FROM records R
+    JOIN users U ON R.owner_id=U.id
+    WHERE `+strings.Join(where, "\n      AND ")+`
+)
+SELECT V.id, V.name, V.is_owner, V.owner_id, V.owner_name, V.size, V.duration, V.codec, V.sample_rate,
+       V.channels, V.bitrate, V.created_at, (SELECT COUNT(*) FROM visible)
+FROM visible V
+`+page.apply(q, nil, order)+";", q.args...)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+	var total int64
+	recs := []*listedRecord{}
+	for rows.Next() {
+		rec := &listedRecord{SharedTo: []sharedTo{}}
+		if err := rows.Scan(&rec.Id, &rec.Name, &rec.IsOwner, &rec.OwnerId, &rec.OwnerName, &rec.Size, &rec.Duration,
+			&rec.Codec, &rec.SampleRate, &rec.Channels, &rec.Bitrate, &rec.CreatedAt, &total); err != nil {
+			return nil, 0, err
+		}
+		recs = append(recs, rec)
+	}
+	return recs, total, rows.Err()
+}
+
+func (s *sqlStore) SelectSharedTo(recs []*listedRecord) error {
+	if len(recs) == 0 {
+		return nil
+	}
+	q := &queryArgs{}
+	byId := make(map[int64]*listedRecord, len(recs))
+	placeholders := make([]string, len(recs))
+	for i, rec := range recs {
+		byId[rec.Id] = rec
+		placeholders[i] = q.add(rec.Id)
+	}
+	recordIds := strings.Join(placeholders, ",")
+	rows, err := s.db.Query(`
+SELECT S.record_id, 'user' AS type, U.id, U.name, S.permission, S.status
+FROM shared S
+JOIN users U ON S."to"=U.id
+WHERE S.record_id IN (`+recordIds+`)
+UNION ALL
+SELECT G.record_id, 'group' AS type, UG.id, UG.name, G.permission, ''
+FROM group_shares G
+JOIN user_groups UG ON G.group_id=UG.id
+WHERE G.record_id IN (`+recordIds+`)
+ORDER BY type DESC, id;
+`, q.args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var recordId int64
+		var to sharedTo
+		if err := rows.Scan(&recordId, &to.Type, &to.Id, &to.Name, &to.Permission, &to.Status); err != nil {
+			return err
+		}
+		byId[recordId].SharedTo = append(byId[recordId].SharedTo, to)
+	}
+	return rows.Err()
+}
+
+// Matches are selected into 'matches' table M, which search order refers to. Query is parsed by
+// websearch_to_tsquery and fragments are picked by ts_headline.
+func (s *sqlStore) SearchRecords(userId int64, text, searchConfig string, page *pageRequest) ([]*searchResult, int64, error) {
+	if s.db.database == databaseSQLite {
+		return s.searchRecordsEmulated(userId, text, page)
+	}
+	// Control characters are used as match markers, so they must not come from stored text
+	stripMarkers := func(column string) string {
+		return "translate(" + column + `, E'\x02\x03', '')`
+	}
+	q := &queryArgs{}
+	config, query, user := q.add(searchConfig), q.add(text), q.add(userId)
+	headlineOptions := q.add("StartSel=" + headlineStart + ", StopSel=" + headlineStop +
+		fmt.Sprintf(", MaxFragments=%d, MaxWords=%d, MinWords=%d", headlineMaxFragments, headlineMaxWords,
+			headlineMinWords))
+	rows, err := s.db.Query(`
+WITH matches AS (
+    SELECT R.id,
+           ts_rank(R.search_vector, Q.query) AS rank,
+           Q.query
+    FROM records R,
+         websearch_to_tsquery(`+config+`::regconfig, `+query+`) Q(query)
+    WHERE R.search_vector @@ Q.query AND `+recordVisibleTo(user)+`
+)
+SELECT `+recordColumns+`,
+       `+recordPermission(user)+`,
+       U.name,
+       M.rank,
+       ts_headline(`+config+`::regconfig, `+stripMarkers("R.name")+`, M.query, `+headlineOptions+`),
+       ts_headline(`+config+`::regconfig, `+stripMarkers("R.description")+`, M.query, `+headlineOptions+`),
+       (SELECT COUNT(*) FROM matches)
+FROM matches M
+JOIN records R ON R.id=M.id
+JOIN users U ON U.id=R.owner_id
+`+page.apply(q, nil, searchOrder)+";", q.args...)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+	var total int64
+	results := []*searchResult{}
+	for rows.Next() {
+		res := &searchResult{}
+		var perm permission
+		if res.recordInfo, err = scanRecord(rows, &perm, &res.OwnerName, &res.Rank, &res.Highlights.Name,
+			&res.Highlights.Description, &total); err != nil {
+			return nil, 0, err
+		}
+		res.Permission = perm
+		results = append(results, res)
+	}
+	return results, total, rows.Err()
+}
+
+func (s *sqlStore) SelectInlineContentRecords(afterId int64, limit int) ([]int64, error) {
+	rows, err := s.db.Query(`
+SELECT id FROM records
+WHERE id>$1 AND storage_key IS NULL AND content IS NOT NULL
+ORDER BY id
+LIMIT $2;
+`, afterId, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var ids []int64
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+func (s *sqlStore) SelectInlineContent(recordId int64) ([]byte, error) {
+	var content []byte
+	err := s.db.QueryRow("SELECT content FROM records WHERE id=$1 AND storage_key IS NULL AND content IS NOT NULL;",
+		recordId).Scan(&content)
+	return content, err
+}
+
+func (s *sqlStore) UpdateRecordStorage(recordId int64, storageKey string, size int64, checksum string) (bool, error) {
+	return affectedOne(s.db.Exec(`
+UPDATE records SET storage_key=$1, size=$2, checksum=$3, content=NULL
+WHERE id=$4 AND storage_key IS NULL;
+`, storageKey, size, checksum, recordId))
+}
+
+// Sharing waits for acceptance unless user accepts all sharings automatically. Status of existing
+// sharing is kept, so declined sharing is not offered again.
+func (s *sqlStore) UpsertSharing(recordId, toUserId, byUserId int64, perm permission, isOwner bool) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	var sharedBy sql.NullInt64
+	err = tx.QueryRow(`SELECT shared_by FROM shared WHERE record_id=$1 AND "to"=$2;`,
+		recordId, toUserId).Scan(&sharedBy)
+	switch {
+	case err == sql.ErrNoRows:
+		var res sql.Result
+		res, err = tx.Exec(`
+INSERT INTO shared(record_id, "to", permission, shared_by, status)
+SELECT $1, U.id, $3, $4, CASE WHEN U.auto_accept_shares THEN 'accepted' ELSE 'pending' END
+FROM users U
+WHERE U.id=$2;
+`, recordId, toUserId, perm.String(), byUserId)
+		if err == nil {
+			if n, _ := res.RowsAffected(); n == 0 {
+				return errNoSuchUser
+			}
+		}
+	case err != nil:
+		return err
+	case !isOwner && sharedBy.Int64 != byUserId:
+		return errNotSharer
+	default:
+		_, err = tx.Exec(`UPDATE shared SET permission=$1 WHERE record_id=$2 AND "to"=$3;`,
+			perm.String(), recordId, toUserId)
+	}
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// Record is checked by subquery rather than joined with DELETE ... USING, which SQLite lacks
+func (s *sqlStore) DeleteSharing(recordId, userId, toUserId int64) (bool, error) {
+	return affectedOne(s.db.Exec(`
+DELETE FROM shared
+WHERE record_id=$1 AND "to"=$3 AND EXISTS (
+    SELECT 1 FROM records R WHERE R.id=$1 AND (R.owner_id=$2 OR shared.shared_by=$2)
+);
+`, recordId, userId, toUserId))
+}
+
+func (s *sqlStore) DeleteGroupSharing(recordId, userId, groupId int64) (bool, error) {
+	return affectedOne(s.db.Exec(`
+DELETE FROM group_shares
+WHERE record_id=$1 AND group_id=$3 AND EXISTS (
+    SELECT 1 FROM records R WHERE R.id=$1 AND (R.owner_id=$2 OR group_shares.shared_by=$2)
+);
+`, recordId, userId, groupId))
+}
+
+// Select page of users from 'sharing' table of (id, name, shared_records) defined by query using
+// user id passed as $1
+func (s *sqlStore) listSharingUsers(userId int64, page *pageRequest, query string) ([]sharingUser, int64, error) {
+	q := &queryArgs{}
+	q.add(userId)
+	rows, err := s.db.Query(query+`
+SELECT id, name, shared_records, (SELECT COUNT(*) FROM sharing)
+FROM sharing
+`+page.apply(q, nil, sharingUsersOrder)+";", q.args...)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+	var total int64
+	users := []sharingUser{}
+	for rows.Next() {
+		var u sharingUser
+		if err := rows.Scan(&u.Id, &u.Name, &u.SharedRecords, &total); err != nil {
+			return nil, 0, err
+		}
+		users = append(users, u)
+	}
+	return users, total, rows.Err()
+}
+
+// Sharing users are the ones who made sharings: owner or resharer of record
+func (s *sqlStore) ListSharers(userId int64, page *pageRequest) ([]sharingUser, int64, error) {
+	return s.listSharingUsers(userId, page, `
+WITH sharing AS (
+    SELECT COALESCE(S.shared_by, R.owner_id) AS id,
+           U.name,
+           COUNT(DISTINCT R.id) AS shared_records
+    FROM shared S
+    JOIN records R ON S.record_id=R.id
+    JOIN users U ON COALESCE(S.shared_by, R.owner_id)=U.id
+    WHERE S."to"=$1 AND S.status='accepted'
+    GROUP BY COALESCE(S.shared_by, R.owner_id),
+             U.name
+)`)
+}
+
+func (s *sqlStore) ListRecipients(userId int64, page *pageRequest) ([]sharingUser, int64, error) {
+	return s.listSharingUsers(userId, page, `
+WITH sharing AS (
+    SELECT S."to" AS id,
+           U.name,
+           COUNT(DISTINCT R.id) AS shared_records
+    FROM shared S
+    JOIN records R ON S.record_id=R.id
+    JOIN users U ON S."to"=U.id
+    WHERE COALESCE(S.shared_by, R.owner_id)=$1 AND S.status='accepted'
+    GROUP BY S."to",
+             U.name
+)`)
+}
+
+func (s *sqlStore) ListSharerRecords(sharerId, userId int64, page *pageRequest) ([]*recordInfo, int64, error) {
+	q := &queryArgs{}
+	sharer, user := q.add(sharerId), q.add(userId)
+	rows, err := s.db.Query(`
+WITH shared_by AS (
+    SELECT S.record_id
+    FROM shared S
+    JOIN records R ON S.record_id=R.id
+    WHERE COALESCE(S.shared_by, R.owner_id)=`+sharer+` AND S."to"=`+user+` AND S.status='accepted'
+)
+SELECT `+recordColumns+`,
+       (SELECT COUNT(*) FROM shared_by)
+FROM records R
+JOIN shared_by ON shared_by.record_id=R.id
+`+page.apply(q, nil, sharerRecordsOrder)+";", q.args...)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+	var total int64
+	recs := []*recordInfo{}
+	for rows.Next() {
+		rec, err := scanRecord(rows, &total)
+		if err != nil {
+			return nil, 0, err
+		}
+		recs = append(recs, rec)
+	}
+	return recs, total, rows.Err()
+}
+
+func (s *sqlStore) ListIncomingShares(userId int64, status string, page *pageRequest) ([]*incomingShare, error) {
+	q := &queryArgs{}
+	where := []string{`S."to"=` + q.add(userId), "S.status=" + q.add(status)}
+	rows, err := s.db.Query(`
+SELECT S.record_id, R.name, R.owner_id, O.name, COALESCE(S.shared_by, R.owner_id), COALESCE(B.name, O.name),
+       S.permission, S.status
+FROM shared S
+JOIN records R ON R.id=S.record_id
+JOIN users O ON O.id=R.owner_id
+LEFT JOIN users B ON B.id=S.shared_by
+`+page.apply(q, where, incomingSharesOrder)+";", q.args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	shares := []*incomingShare{}
+	for rows.Next() {
+		sh := &incomingShare{}
+		if err := rows.Scan(&sh.RecordId, &sh.RecordName, &sh.OwnerId, &sh.OwnerName, &sh.SharedById,
+			&sh.SharedByName, &sh.Permission, &sh.Status); err != nil {
+			return nil, err
+		}
+		shares = append(shares, sh)
+	}
+	return shares, rows.Err()
+}
+
+func (s *sqlStore) UpdateShareStatus(recordId, userId int64, status string) (bool, error) {
+	return affectedOne(s.db.Exec(`UPDATE shared SET status=$1 WHERE record_id=$2 AND "to"=$3;`,
+		status, recordId, userId))
+}
+
+const shareLinkColumns = `L.id, L.record_id, L.permission, L.created_by, L.created_at, L.expires_at, L.max_uses,
+       L.uses, L.revoked_at, L.password_hash`
+
+func scanShareLink(row rowScanner) (*shareLink, error) {
+	l := &shareLink{}
+	var expiresAt, revokedAt sql.NullTime
+	var passwordHash sql.NullString
+	if err := row.Scan(&l.Id, &l.RecordId, &l.Permission, &l.CreatedBy, &l.CreatedAt, &expiresAt, &l.MaxUses,
+		&l.Uses, &revokedAt, &passwordHash); err != nil {
+		return nil, err
+	}
+	if expiresAt.Valid {
+		l.ExpiresAt = &expiresAt.Time
+	}
+	if revokedAt.Valid {
+		l.RevokedAt = &revokedAt.Time
+	}
+	l.PasswordHash = passwordHash.String
+	l.PasswordRequired = passwordHash.Valid
+	return l, nil
+}
+
+func (s *sqlStore) InsertShareLink(l *shareLink) error {
+	var passwordHash sql.NullString
+	if l.PasswordHash != "" {
+		passwordHash = sql.NullString{String: l.PasswordHash, Valid: true}
+	}
+	l.CreatedAt = time.Now()
+	_, err := s.db.Exec(`
+INSERT INTO share_links(id, record_id, permission, created_by, created_at, expires_at, max_uses, password_hash)
+VALUES($1,$2,$3,$4,$5,$6,$7,$8);
+`, l.Id, l.RecordId, l.Permission.String(), l.CreatedBy, l.CreatedAt, l.ExpiresAt, l.MaxUses, passwordHash)
+	return err
+}
+
+func (s *sqlStore) SelectShareLinks(recordId int64) ([]*shareLink, error) {
+	rows, err := s.db.Query(`
+SELECT `+shareLinkColumns+`
+FROM share_links L
+WHERE L.record_id=$1
+ORDER BY L.created_at DESC, L.id;
+`, recordId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	links := []*shareLink{}
+	for rows.Next() {
+		l, err := scanShareLink(rows)
+		if err != nil {
+			return nil, err
+		}
+		links = append(links, l)
+	}
+	return links, rows.Err()
+}
+
+func (s *sqlStore) SelectShareLink(linkId string) (*shareLink, error) {
+	return scanShareLink(s.db.QueryRow(`
+SELECT `+shareLinkColumns+`
+FROM share_links L
+WHERE L.id=$1;
+`, linkId))
+}
+
+func (s *sqlStore) UseShareLink(linkId string) (bool, error) {
+	return affectedOne(s.db.Exec(`
+UPDATE share_links SET uses=uses+1
+WHERE id=$1 AND revoked_at IS NULL AND (expires_at IS NULL OR expires_at>$2) AND (max_uses=0 OR uses<max_uses);
+`, linkId, time.Now()))
+}
+
+func (s *sqlStore) RevokeShareLink(recordId int64, linkId string) (bool, error) {
+	return affectedOne(s.db.Exec(`
+UPDATE share_links SET revoked_at=$1
+WHERE id=$2 AND record_id=$3 AND revoked_at IS NULL;
+`, time.Now(), linkId, recordId))
+}
+
+// Repeated invitation to the same record changes permission
+func (s *sqlStore) UpsertInvitation(recordId int64, email string, perm permission, invitedBy int64,
+	ttl time.Duration) (string, error) {
+	token, err := randomToken(32)
+	if err != nil {
+		return "", fmt.Errorf("generate invitation token: %v", err)
+	}
+	tx, err := s.db.Begin()
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+	_, err = tx.Exec("DELETE FROM invitations WHERE record_id=$1 AND LOWER(email)=LOWER($2);", recordId, email)
+	if err != nil {
+		return "", err
+	}
+	now := time.Now()
+	_, err = tx.Exec(`
+INSERT INTO invitations(record_id, email, permission, invited_by, token_hash, created_at, expires_at)
+VALUES($1,$2,$3,$4,$5,$6,$7);
+`, recordId, email, perm.String(), invitedBy, hashRefreshToken(token), now, now.Add(ttl))
+	if err != nil {
+		return "", err
+	}
+	return token, tx.Commit()
+}
+
+// Insert group with user as its only owner
+func (s *sqlStore) InsertGroup(name string, ownerId int64) (*groupInfo, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	g := &groupInfo{Name: name, CreatedAt: time.Now().UTC(), Role: groupRoleOwner, Status: shareAccepted}
+	err = tx.QueryRow("INSERT INTO user_groups(name, created_by, created_at) VALUES($1,$2,$3) RETURNING id;",
+		name, ownerId, g.CreatedAt).Scan(&g.Id)
+	if err != nil {
+		return nil, err
+	}
+	_, err = tx.Exec("INSERT INTO group_members(group_id, user_id, role, added_at) VALUES($1,$2,$3,$4);",
+		g.Id, ownerId, groupRoleOwner, g.CreatedAt)
+	if err != nil {
+		return nil, fmt.Errorf("insert owner: %v", err)
+	}
+	return g, tx.Commit()
+}
+
+func (s *sqlStore) SelectGroup(groupId, userId int64) (*groupInfo, error) {
+	g := &groupInfo{}
+	err := s.db.QueryRow(`
+SELECT G.id, G.name, G.created_at, M.role, M.status
+FROM user_groups G
+JOIN group_members M ON M.group_id=G.id
+WHERE G.id=$1 AND M.user_id=$2 AND M.status='accepted';
+`, groupId, userId).Scan(&g.Id, &g.Name, &g.CreatedAt, &g.Role, &g.Status)
+	if err != nil {
+		return nil, err
+	}
+	return g, nil
+}
+
+func (s *sqlStore) SelectGroups(userId int64) ([]*groupInfo, error) {
+	rows, err := s.db.Query(`
+SELECT G.id, G.name, G.created_at, M.role, M.status
+FROM user_groups G
+JOIN group_members M ON M.group_id=G.id
+WHERE M.user_id=$1
+ORDER BY G.name, G.id;
+`, userId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	groups := []*groupInfo{}
+	for rows.Next() {
+		g := &groupInfo{}
+		if err := rows.Scan(&g.Id, &g.Name, &g.CreatedAt, &g.Role, &g.Status); err != nil {
+			return nil, err
+		}
+		groups = append(groups, g)
+	}
+	return groups, rows.Err()
+}
+
+func (s *sqlStore) SelectGroupMembers(groupId int64) ([]groupMember, error) {
+	rows, err := s.db.Query(`
+SELECT U.id, U.login, U.name, M.role, M.status
+FROM group_members M
+JOIN users U ON U.id=M.user_id
+WHERE M.group_id=$1
+ORDER BY U.id;
+`, groupId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	members := []groupMember{}
+	for rows.Next() {
+		var m groupMember
+		if err := rows.Scan(&m.Id, &m.Login, &m.Name, &m.Role, &m.Status); err != nil {
+			return nil, err
+		}
+		members = append(members, m)
+	}
+	return members, rows.Err()
+}
+
+func (s *sqlStore) RenameGroup(groupId int64, name string) error {
+	_, err := s.db.Exec("UPDATE user_groups SET name=$1 WHERE id=$2;", name, groupId)
+	return err
+}
+
+// Count owners of group other than given user within transaction, so that the last owner is not
+// removed or demoted. Owners who have not accepted membership are not counted.
+func countOtherGroupOwners(tx *sqlTx, groupId, userId int64) (int, error) {
+	var owners int
+	err := tx.QueryRow(`
+SELECT COUNT(*) FROM group_members WHERE group_id=$1 AND role=$2 AND user_id<>$3 AND status='accepted';
+`, groupId, groupRoleOwner, userId).Scan(&owners)
+	return owners, err
+}
+
+// New member has to accept membership unless they accept all sharings automatically
+func (s *sqlStore) UpsertGroupMember(groupId, userId int64, role string) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	var current string
+	err = tx.QueryRow("SELECT role FROM group_members WHERE group_id=$1 AND user_id=$2;", groupId, userId).
+		Scan(&current)
+	switch {
+	case err == sql.ErrNoRows:
+		var res sql.Result
+		res, err = tx.Exec(`
+INSERT INTO group_members(group_id, user_id, role, added_at, status)
+SELECT $1, U.id, $3, $4, CASE WHEN U.auto_accept_shares THEN 'accepted' ELSE 'pending' END
+FROM users U
+WHERE U.id=$2;
+`, groupId, userId, role, time.Now())
+		if err == nil {
+			if n, _ := res.RowsAffected(); n == 0 {
+				return errNoSuchUser
+			}
+		}
+	case err != nil:
+		return err
+	case current == role:
+		return nil
+	default:
+		if current == groupRoleOwner {
+			owners, err := countOtherGroupOwners(tx, groupId, userId)
+			if err != nil {
+				return err
+			}
+			if owners == 0 {
+				return errLastGroupOwner
+			}
+		}
+		_, err = tx.Exec("UPDATE group_members SET role=$1 WHERE group_id=$2 AND user_id=$3;", role, groupId, userId)
+	}
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// sql.ErrNoRows is returned if user is not a member
+func (s *sqlStore) DeleteGroupMember(groupId, userId int64) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	var role string
+	err = tx.QueryRow("SELECT role FROM group_members WHERE group_id=$1 AND user_id=$2;", groupId, userId).
+		Scan(&role)
+	if err != nil {
+		return err
+	}
+	if role == groupRoleOwner {
+		owners, err := countOtherGroupOwners(tx, groupId, userId)
+		if err != nil {
+			return err
+		}
+		if owners == 0 {
+			return errLastGroupOwner
+		}
+	}
+	if _, err := tx.Exec("DELETE FROM group_members WHERE group_id=$1 AND user_id=$2;", groupId, userId); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *sqlStore) AcceptGroupMembership(groupId, userId int64) (bool, error) {
+	return affectedOne(s.db.Exec(`
+UPDATE group_members SET status='accepted' WHERE group_id=$1 AND user_id=$2 AND status='pending';
+`, groupId, userId))
+}
+
+func (s *sqlStore) DeclineGroupMembership(groupId, userId int64) (bool, error) {
+	return affectedOne(s.db.Exec("DELETE FROM group_members WHERE group_id=$1 AND user_id=$2 AND status='pending';",
+		groupId, userId))
+}
+
+// Delete group along with its members and sharings of records to it
+func (s *sqlStore) DeleteGroup(groupId int64) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec("DELETE FROM group_shares WHERE group_id=$1;", groupId); err != nil {
+		return fmt.Errorf("delete sharings: %v", err)
+	}
+	if _, err := tx.Exec("DELETE FROM group_members WHERE group_id=$1;", groupId); err != nil {
+		return fmt.Errorf("delete members: %v", err)
+	}
+	if _, err := tx.Exec("DELETE FROM user_groups WHERE id=$1;", groupId); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *sqlStore) UpsertGroupSharing(recordId, groupId, byUserId int64, perm permission, isOwner bool) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	var sharedBy int64
+	err = tx.QueryRow("SELECT shared_by FROM group_shares WHERE record_id=$1 AND group_id=$2;",
+		recordId, groupId).Scan(&sharedBy)
+	switch {
+	case err == sql.ErrNoRows:
+		_, err = tx.Exec(`
+INSERT INTO group_shares(record_id, group_id, permission, shared_by, created_at)
+VALUES($1,$2,$3,$4,$5);
+`, recordId, groupId, perm.String(), byUserId, time.Now())
+	case err != nil:
+		return err
+	case !isOwner && sharedBy != byUserId:
+		return errNotSharer
+	default:
+		_, err = tx.Exec("UPDATE group_shares SET permission=$1 WHERE record_id=$2 AND group_id=$3;",
+			perm.String(), recordId, groupId)
+	}
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *sqlStore) InsertUpload(u *upload) error {
+	_, err := s.db.Exec(`
+INSERT INTO uploads(id, owner_id, length, upload_offset, metadata, expires_at)
+VALUES($1,$2,$3,0,$4,$5);
+`, u.Id, u.OwnerId, u.Length, u.Metadata, u.ExpiresAt)
+	return err
+}
+
+func (s *sqlStore) SelectUpload(id string, ownerId int64) (*upload, error) {
+	u := &upload{}
+	err := s.db.QueryRow(`
+SELECT id, owner_id, length, upload_offset, metadata, expires_at, record_id
+FROM uploads
+WHERE id=$1 AND owner_id=$2;
+`, id, ownerId).Scan(&u.Id, &u.OwnerId, &u.Length, &u.Offset, &u.Metadata, &u.ExpiresAt, &u.RecordId)
+	if err != nil {
+		return nil, err
+	}
+	return u, nil
+}
+
+func (s *sqlStore) UpdateUploadOffset(id string, oldOffset, newOffset int64) (bool, error) {
+	return affectedOne(s.db.Exec("UPDATE uploads SET upload_offset=$1 WHERE id=$2 AND upload_offset=$3;",
+		newOffset, id, oldOffset))
+}
+
+func (s *sqlStore) DeleteUpload(id string, ownerId int64) (bool, error) {
+	return affectedOne(s.db.Exec("DELETE FROM uploads WHERE id=$1 AND owner_id=$2;", id, ownerId))
+}
+
+func (s *sqlStore) DeleteExpiredUploads(now time.Time) ([]string, error) {
+	rows, err := s.db.Query("DELETE FROM uploads WHERE expires_at<$1 RETURNING id;", now)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+const (
+	databasePostgres = "postgres"
+	databaseSQLite   = "sqlite"
+	databaseMemory   = "memory"
+)
+
+// Persistent state of the service: users, records, sharings and everything around them. Lookups of
+// single rows return sql.ErrNoRows when nothing is found, whatever the implementation is. Lists
+// are paged by keyset orders, selecting one item more than requested along with the total count.
+type Store interface {
+	// Insert user, sharing records from invitation if its token is passed; errInvitationInvalid
+	// is returned for unknown or expired token and errEmailTaken if email belongs to another user.
+	// Email is verified by valid invitation.
+	RegisterUser(login, passwordHash, name, email, invitation string) error
+	// Save token confirming email of user, returning the email to send the token to;
+	// errNoEmailToConfirm is returned if user has no email or it is verified already
+	InsertEmailConfirmation(userId int64, ttl time.Duration) (email, token string, err error)
+	// Verify email by confirmation token; errConfirmationInvalid is returned for unknown or expired token
+	ConfirmEmail(token string) error
+	SelectUserCredentials(login string) (userId int64, passwordHash string, err error)
+	UpdateUserPassword(userId int64, passwordHash string) error
+	SelectUserName(userId int64) (string, error)
+	// Select user by verified email or by login; emails that are not verified are not looked up
+	SelectUserByLoginOrEmail(loginOrEmail string) (*userInfo, error)
+	SelectUserSettings(userId int64) (*userSettings, error)
+	// Change settings that are not nil
+	UpdateUserSettings(userId int64, autoAcceptShares *bool) error
+	IsBlocked(userId, blockedId int64) (bool, error)
+	// Block user, declining pending sharings from them
+	BlockUser(userId, blockedId int64) error
+	UnblockUser(userId, blockedId int64) error
+	SelectBlockedUsers(userId int64) ([]*userInfo, error)
+
+	NewRefreshTokenFamily(userId int64, ttl time.Duration) (string, error)
+	// Exchange refresh token for a new one; errRefreshTokenInvalid and errRefreshTokenReused are
+	// returned for tokens that can not be exchanged
+	RotateRefreshToken(token string, ttl time.Duration) (userId int64, login string, newToken string, err error)
+	RevokeRefreshTokenFamily(userId int64, token string) error
+	RevokeUserRefreshTokens(userId int64) error
+
+	InsertRevokedToken(jti string, userId int64, expiresAt time.Time) error
+	UpsertUserTokenRevocation(userId int64, revokedBefore time.Time) error
+	// Delete revoked tokens expired by now and user revocations made before revokedBefore
+	DeleteOutdatedRevocations(now, revokedBefore time.Time) error
+	SelectRevocations() (tokens map[string]time.Time, revokedBefore map[int64]time.Time, err error)
+
+	// Insert record along with its tags, filling in its id and creation time. Upload of record is
+	// linked to it in the same step; error is returned if the upload already has record.
+	InsertRecord(rec *recordInfo, searchConfig string) error
+	// Select record along with permission of user to it if it is visible to user
+	SelectRecord(recordId, userId int64) (*recordInfo, error)
+	// Same as SelectRecord, also returning content if it is still stored inline
+	SelectRecordContent(recordId, userId int64) (*recordInfo, []byte, error)
+	SelectLinkedRecordContent(recordId int64) (*recordInfo, []byte, error)
+	SelectRecordTags(recordId int64) ([]string, error)
+	// Update editable fields of record; nil values are left as they are
+	UpdateRecord(recordId int64, name, description *string, tags []string, searchConfig string) error
+	// Delete record along with everything referencing it, returning key of its content in blob store
+	DeleteRecord(recordId int64) (storageKey string, err error)
+	ListRecords(userId int64, filter *recordsFilter, sortBy string, order *keysetOrder,
+		page *pageRequest) ([]*listedRecord, int64, error)
+	// Fill in users and groups the records are shared to; users go first
+	SelectSharedTo(recs []*listedRecord) error
+	// Full-text search over records visible to user; highlights are returned with match markers
+	SearchRecords(userId int64, text, searchConfig string, page *pageRequest) ([]*searchResult, int64, error)
+	// Ids of records with content stored inline following given id
+	SelectInlineContentRecords(afterId int64, limit int) ([]int64, error)
+	SelectInlineContent(recordId int64) ([]byte, error)
+	// Reference content moved to blob store unless it has been moved already
+	UpdateRecordStorage(recordId int64, storageKey string, size int64, checksum string) (bool, error)
+
+	// Share record to user or change permission of existing sharing; errNoSuchUser and
+	// errNotSharer are returned when sharing can not be made
+	UpsertSharing(recordId, toUserId, byUserId int64, perm permission, isOwner bool) error
+	// Delete sharing made by user or of user's record
+	DeleteSharing(recordId, userId, toUserId int64) (bool, error)
+	DeleteGroupSharing(recordId, userId, groupId int64) (bool, error)
+	ListSharers(userId int64, page *pageRequest) ([]sharingUser, int64, error)
+	ListRecipients(userId int64, page *pageRequest) ([]sharingUser, int64, error)
+	ListSharerRecords(sharerId, userId int64, page *pageRequest) ([]*recordInfo, int64, error)
+	ListIncomingShares(userId int64, status string, page *pageRequest) ([]*incomingShare, error)
+	UpdateShareStatus(recordId, userId int64, status string) (bool, error)
+
+	// Insert link filling in its creation time
+	InsertShareLink(l *shareLink) error
+	SelectShareLinks(recordId int64) ([]*shareLink, error)
+	SelectShareLink(linkId string) (*shareLink, error)
+	// Count use of link unless it is exhausted, expired or revoked
+	UseShareLink(linkId string) (bool, error)
+	RevokeShareLink(recordId int64, linkId string) (bool, error)
+
+	// Invite person with email to record, returning token to be sent to the person
+	UpsertInvitation(recordId int64, email string, perm permission, invitedBy int64, ttl time.Duration) (string, error)
+
+	InsertGroup(name string, ownerId int64) (*groupInfo, error)
+	// Select group user has accepted membership in
+	SelectGroup(groupId, userId int64) (*groupInfo, error)
+	// Select groups of user including ones user has not accepted membership in yet
+	SelectGroups(userId int64) ([]*groupInfo, error)
+	SelectGroupMembers(groupId int64) ([]groupMember, error)
+	RenameGroup(groupId int64, name string) error
+	// Add member or change role; errNoSuchUser and errLastGroupOwner are returned when it can not be done
+	UpsertGroupMember(groupId, userId int64, role string) error
+	// Remove member; errLastGroupOwner is returned for the only owner
+	DeleteGroupMember(groupId, userId int64) error
+	// Accept or decline pending membership of user; declined membership is removed
+	AcceptGroupMembership(groupId, userId int64) (bool, error)
+	DeclineGroupMembership(groupId, userId int64) (bool, error)
+	DeleteGroup(groupId int64) error
+	// Share record to group; errNotSharer is returned like for sharings to users
+	UpsertGroupSharing(recordId, groupId, byUserId int64, perm permission, isOwner bool) error
+
+	InsertUpload(u *upload) error
+	SelectUpload(id string, ownerId int64) (*upload, error)
+	// Move offset forward if nobody has moved it since it was read
+	UpdateUploadOffset(id string, oldOffset, newOffset int64) (bool, error)
+	DeleteUpload(id string, ownerId int64) (bool, error)
+	// Delete uploads expired by now, returning their ids
+	DeleteExpiredUploads(now time.Time) ([]string, error)
+
+	Close() error
+}
+
+func newStore(conf *config) (Store, error) {
+	switch conf.Database {
+	case "", databasePostgres:
+		db, err := initDB(conf)
+		if err != nil {
+			return nil, err
+		}
+		return newSqlStore(db, databasePostgres), nil
+	case databaseSQLite:
+		db, err := openSQLite(conf.SQLitePath)
+		if err != nil {
+			return nil, err
+		}
+		return newSqlStore(db, databaseSQLite), nil
+	case databaseMemory:
+		return newMemStore(), nil
+	default:
+		return nil, fmt.Errorf("unknown database %q", conf.Database)
+	}
+}
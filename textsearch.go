@@ -0,0 +1,299 @@
+package main
+
+import (
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// Full-text search for stores without text search of their own. It follows Postgres with 'simple'
+// configuration closely enough to give the same results in common cases: words are lower-cased
+// runs of letters and digits, queries are parsed like websearch_to_tsquery does, ranks are computed
+// like ts_rank does for OR queries and fragments are picked like ts_headline does.
+
+// Weights of document fields A, B, C and D, the same as default weights of ts_rank
+var textWeights = [...]float64{1.0, 0.4, 0.2, 0.1}
+
+type textWord struct {
+	lexeme string
+	// Byte offsets of the word in text
+	start, end int
+}
+
+func splitWords(text string) []textWord {
+	var words []textWord
+	start := -1
+	for i, r := range text {
+		isWordRune := unicode.IsLetter(r) || unicode.IsDigit(r)
+		if isWordRune && start < 0 {
+			start = i
+		}
+		if !isWordRune && start >= 0 {
+			words = append(words, textWord{strings.ToLower(text[start:i]), start, i})
+			start = -1
+		}
+	}
+	if start >= 0 {
+		words = append(words, textWord{strings.ToLower(text[start:]), start, len(text)})
+	}
+	return words
+}
+
+type textPosition struct {
+	pos    int
+	weight float64
+}
+
+// Positions of lexemes in document made of fields weighted A, B, C and D in this order. Positions
+// continue from one field to the next one like when tsvectors are concatenated.
+type textDocument map[string][]textPosition
+
+func newTextDocument(fields ...string) textDocument {
+	doc := make(textDocument)
+	pos := 0
+	for i, field := range fields {
+		for _, w := range splitWords(field) {
+			pos++
+			doc[w.lexeme] = append(doc[w.lexeme], textPosition{pos, textWeights[i]})
+		}
+	}
+	return doc
+}
+
+type textTerm struct {
+	// Lexemes that must follow each other; a single one for plain words
+	phrase  []string
+	negated bool
+}
+
+// Parsed query: alternatives joined by OR, each of terms joined by AND
+type textQuery struct {
+	alternatives [][]textTerm
+}
+
+// Parse query in web search syntax: words, quoted phrases, "or" and "-" for negation
+func parseTextQuery(text string) *textQuery {
+	q := &textQuery{}
+	var terms []textTerm
+	for len(text) > 0 {
+		text = strings.TrimLeftFunc(text, unicode.IsSpace)
+		if text == "" {
+			break
+		}
+		negated := false
+		if text[0] == '-' {
+			negated = true
+			text = text[1:]
+		}
+		var chunk string
+		if strings.HasPrefix(text, `"`) {
+			end := strings.IndexByte(text[1:], '"')
+			if end < 0 {
+				chunk, text = text[1:], ""
+			} else {
+				chunk, text = text[1:end+1], text[end+2:]
+			}
+		} else {
+			end := strings.IndexFunc(text, unicode.IsSpace)
+			if end < 0 {
+				end = len(text)
+			}
+			chunk, text = text[:end], text[end:]
+			if !negated && strings.EqualFold(chunk, "or") {
+				if len(terms) > 0 {
+					q.alternatives = append(q.alternatives, terms)
+					terms = nil
+				}
+				continue
+			}
+		}
+		term := textTerm{negated: negated}
+		for _, w := range splitWords(chunk) {
+			term.phrase = append(term.phrase, w.lexeme)
+		}
+		if len(term.phrase) > 0 {
+			terms = append(terms, term)
+		}
+	}
+	if len(terms) > 0 {
+		q.alternatives = append(q.alternatives, terms)
+	}
+	return q
+}
+
+// Query has nothing to search for, e.g. it consists of punctuation only
+func (q *textQuery) empty() bool {
+	return len(q.alternatives) == 0
+}
+
+func (t *textTerm) matches(doc textDocument) bool {
+	for _, first := range doc[t.phrase[0]] {
+		found := true
+		for i, lexeme := range t.phrase[1:] {
+			found = false
+			for _, p := range doc[lexeme] {
+				if p.pos == first.pos+i+1 {
+					found = true
+					break
+				}
+			}
+			if !found {
+				break
+			}
+		}
+		if found {
+			return true
+		}
+	}
+	return false
+}
+
+func (q *textQuery) matches(doc textDocument) bool {
+	for _, terms := range q.alternatives {
+		matched := true
+		for _, t := range terms {
+			if t.matches(doc) == t.negated {
+				matched = false
+				break
+			}
+		}
+		if matched {
+			return true
+		}
+	}
+	return false
+}
+
+// Lexemes of terms that are not negated
+func (q *textQuery) lexemes() []string {
+	var lexemes []string
+	seen := make(map[string]bool)
+	for _, terms := range q.alternatives {
+		for _, t := range terms {
+			for _, lexeme := range t.phrase {
+				if !t.negated && !seen[lexeme] {
+					seen[lexeme] = true
+					lexemes = append(lexemes, lexeme)
+				}
+			}
+		}
+	}
+	return lexemes
+}
+
+// Rank of document the way ts_rank computes it for OR queries: occurrences of each lexeme add up
+// with diminishing weights, the heaviest one counted in full
+func (q *textQuery) rank(doc textDocument) float64 {
+	lexemes := q.lexemes()
+	if len(lexemes) == 0 {
+		return 0
+	}
+	res := 0.0
+	for _, lexeme := range lexemes {
+		positions := doc[lexeme]
+		if len(positions) == 0 {
+			continue
+		}
+		sort.Slice(positions, func(i, j int) bool { return positions[i].pos < positions[j].pos })
+		resj, wjm, jm := 0.0, -1.0, 0
+		for j, p := range positions {
+			resj += p.weight / float64((j+1)*(j+1))
+			if p.weight > wjm {
+				wjm, jm = p.weight, j
+			}
+		}
+		// Limit of sum of 1/i^2 is pi^2/6
+		res += (wjm + resj - wjm/float64((jm+1)*(jm+1))) / 1.64493406685
+	}
+	return res / float64(len(lexemes))
+}
+
+// Fragments of text around matches with matched words wrapped into headlineStart and headlineStop
+// markers, the way ts_headline picks them with headlineMaxFragments, headlineMaxWords and
+// headlineMinWords options. Text without matches is cut to its first headlineMinWords words.
+func (q *textQuery) headline(text string) string {
+	words := splitWords(text)
+	if len(words) == 0 {
+		return text
+	}
+	matched := make(map[string]bool)
+	for _, lexeme := range q.lexemes() {
+		matched[lexeme] = true
+	}
+	type fragment struct{ start, end int }
+	var fragments []fragment
+	for i, w := range words {
+		if len(fragments) == headlineMaxFragments {
+			break
+		}
+		if !matched[w.lexeme] {
+			continue
+		}
+		prevEnd := 0
+		if len(fragments) > 0 {
+			prevEnd = fragments[len(fragments)-1].end
+			if i < prevEnd {
+				continue
+			}
+		}
+		start := i - (headlineMaxWords-1)/2
+		if start < prevEnd {
+			start = prevEnd
+		}
+		end := start + headlineMaxWords
+		if end > len(words) {
+			end = len(words)
+		}
+		fragments = append(fragments, fragment{start, end})
+	}
+	if len(fragments) == 0 {
+		end := headlineMinWords
+		if end > len(words) {
+			end = len(words)
+		}
+		fragments = append(fragments, fragment{0, end})
+	}
+	parts := make([]string, len(fragments))
+	for i, f := range fragments {
+		var b strings.Builder
+		for j := f.start; j < f.end; j++ {
+			if j > f.start {
+				b.WriteString(text[words[j-1].end:words[j].start])
+			}
+			w := text[words[j].start:words[j].end]
+			if matched[words[j].lexeme] {
+				w = headlineStart + w + headlineStop
+			}
+			b.WriteString(w)
+		}
+		parts[i] = b.String()
+	}
+	return strings.Join(parts, " ... ")
+}
+
+// Match result against query filling in its rank and highlights. Document is made of record name,
+// tags joined by spaces, description and owner name, the same way search vector is.
+func (q *textQuery) match(res *searchResult, tags string) bool {
+	doc := newTextDocument(res.Name, tags, res.Description, res.OwnerName)
+	if !q.matches(doc) {
+		return false
+	}
+	stripMarkers := strings.NewReplacer(headlineStart, "", headlineStop, "")
+	res.Rank = q.rank(doc)
+	res.Highlights.Name = q.headline(stripMarkers.Replace(res.Name))
+	res.Highlights.Description = q.headline(stripMarkers.Replace(res.Description))
+	return true
+}
+
+// Requested page of matched results in search order along with total number of matches
+func pageSearchResults(matches []*searchResult, page *pageRequest) ([]*searchResult, int64) {
+	keys := make([][]interface{}, len(matches))
+	for i, res := range matches {
+		keys[i] = []interface{}{res.Rank, res.Id}
+	}
+	results := []*searchResult{}
+	for _, i := range page.selectKeys(keys, searchOrder) {
+		results = append(results, matches[i])
+	}
+	return results, int64(len(matches))
+}
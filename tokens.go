@@ -0,0 +1,100 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/dgrijalva/jwt-go"
+	"github.com/mitchellh/mapstructure"
+	"net/http"
+	"time"
+)
+
+var (
+	errRefreshTokenInvalid = fmt.Errorf("invalid refresh token")
+	errRefreshTokenReused  = fmt.Errorf("refresh token reuse detected")
+)
+
+type tokenPair struct {
+	AccessToken  string `json:"access_token"`
+	RefreshToken string `json:"refresh_token"`
+	ExpiresIn    int64  `json:"expires_in"`
+}
+
+func (a *Api) signAccessToken(userId int64, login string) (string, error) {
+	jti, err := randomToken(16)
+	if err != nil {
+		return "", fmt.Errorf("generate token id: %v", err)
+	}
+	now := time.Now()
+	claimsMap := make(map[string]interface{})
+	if err := mapstructure.Decode(&tokenClaims{
+		Login:  login,
+		UserId: userId,
+		Exp:    now.Add(a.config().accessTokenTTL()).Unix(),
+		Iat:    float64(now.UnixMicro()) / 1e6,
+		Jti:    jti,
+	}, &claimsMap); err != nil {
+		return "", fmt.Errorf("encode token claims: %v", err)
+	}
+	tokenString, err := a.keys().sign(jwt.MapClaims(claimsMap))
+	if err != nil {
+		return "", fmt.Errorf("error signing token for user %d: %v", userId, err)
+	}
+	return tokenString, nil
+}
+
+// Reply with new access token accompanied by already persisted refresh token
+func (a *Api) replyWithTokens(w http.ResponseWriter, userId int64, login string, refreshToken string) {
+	accessToken, err := a.signAccessToken(userId, login)
+	if err != nil {
+		logE.Print(err)
+		replyWithError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if a.config().AuthCookie {
+		http.SetCookie(w, a.accessTokenCookie(accessToken, int(a.config().accessTokenTTL()/time.Second)))
+	}
+	resBody, err := json.Marshal(&tokenPair{
+		AccessToken:  accessToken,
+		RefreshToken: refreshToken,
+		ExpiresIn:    int64(a.config().accessTokenTTL() / time.Second),
+	})
+	if err != nil {
+		err = fmt.Errorf("marshall tokens for user with id %d: %v", userId, err)
+		replyWithError(w, http.StatusInternalServerError, err)
+		return
+	}
+	fmt.Fprint(w, string(resBody))
+}
+
+// Cookie carrying access token; negative maxAge makes browser delete the cookie
+func (a *Api) accessTokenCookie(value string, maxAge int) *http.Cookie {
+	return &http.Cookie{
+		Name:     accessTokenCookie,
+		Value:    value,
+		Path:     "/",
+		Domain:   a.config().CookieDomain,
+		MaxAge:   maxAge,
+		HttpOnly: true,
+		Secure:   !a.config().CookieInsecure,
+		SameSite: a.config().cookieSameSite(),
+	}
+}
+
+func randomToken(size int) (string, error) {
+	b := make([]byte, size)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// Only hashes of refresh tokens are stored, so leaked table contents can not be used to refresh
+func hashRefreshToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,460 @@
+package main
+
+import (
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Resumable uploads implementing tus protocol 1.0.0 (https://tus.io/protocols/resumable-upload)
+// with creation, expiration, checksum and termination extensions. Chunks are appended to a file in
+// uploads_dir; finished upload is moved to blob store and becomes a record of its owner.
+
+const (
+	tusVersion            = "1.0.0"
+	tusExtensions         = "creation,expiration,checksum,termination"
+	tusChecksumAlgorithms = "md5,sha1,sha256"
+	tusOffsetContentType  = "application/offset+octet-stream"
+	// Status code defined by checksum extension
+	statusChecksumMismatch = 460
+
+	defaultUploadExpiration = 24 * time.Hour
+)
+
+type upload struct {
+	Id        string
+	OwnerId   int64
+	Length    int64
+	Offset    int64
+	Metadata  string
+	ExpiresAt time.Time
+	RecordId  sql.NullInt64
+}
+
+// Serialize chunks of the same upload within process; offset is additionally checked on update,
+// so concurrent writes from different instances sharing uploads_dir can not both succeed
+var uploadLocks = struct {
+	sync.Mutex
+	locked map[string]bool
+}{locked: make(map[string]bool)}
+
+func lockUpload(id string) bool {
+	uploadLocks.Lock()
+	defer uploadLocks.Unlock()
+	if uploadLocks.locked[id] {
+		return false
+	}
+	uploadLocks.locked[id] = true
+	return true
+}
+
+func unlockUpload(id string) {
+	uploadLocks.Lock()
+	defer uploadLocks.Unlock()
+	delete(uploadLocks.locked, id)
+}
+
+func (a *Api) uploadPath(id string) string {
+	return filepath.Join(a.config().uploadsDir(), id)
+}
+
+// Remove expired uploads along with received chunks
+func (a *Api) purgeExpiredUploads() error {
+	ids, err := a.store.DeleteExpiredUploads(time.Now())
+	if err != nil {
+		return fmt.Errorf("delete expired uploads: %v", err)
+	}
+	for _, id := range ids {
+		if err := os.Remove(a.uploadPath(id)); err != nil && !os.IsNotExist(err) {
+			logE.Printf("remove expired upload %s: %v", id, err)
+		}
+	}
+	return nil
+}
+
+func (a *Api) purgeExpiredUploadsPeriodically(interval time.Duration) {
+	for range time.Tick(interval) {
+		if err := a.purgeExpiredUploads(); err != nil {
+			logE.Print(err)
+		}
+	}
+}
+
+// Parse Upload-Metadata header: comma separated pairs of key and base64 encoded value
+func parseUploadMetadata(header string) (map[string]string, error) {
+	meta := make(map[string]string)
+	if strings.TrimSpace(header) == "" {
+		return meta, nil
+	}
+	for _, pair := range strings.Split(header, ",") {
+		fields := strings.Fields(pair)
+		if len(fields) == 0 || len(fields) > 2 {
+			return nil, fmt.Errorf("invalid metadata pair %q", pair)
+		}
+		var value []byte
+		if len(fields) == 2 {
+			var err error
+			if value, err = base64.StdEncoding.DecodeString(fields[1]); err != nil {
+				return nil, fmt.Errorf("decode metadata value of %q: %v", fields[0], err)
+			}
+		}
+		meta[fields[0]] = string(value)
+	}
+	return meta, nil
+}
+
+// Parse Upload-Checksum header: algorithm and base64 encoded checksum of the chunk
+func parseUploadChecksum(header string) (hash.Hash, []byte, error) {
+	fields := strings.Fields(header)
+	if len(fields) != 2 {
+		return nil, nil, fmt.Errorf("invalid Upload-Checksum header")
+	}
+	var h hash.Hash
+	switch fields[0] {
+	case "md5":
+		h = md5.New()
+	case "sha1":
+		h = sha1.New()
+	case "sha256":
+		h = sha256.New()
+	default:
+		return nil, nil, fmt.Errorf("unsupported checksum algorithm %q", fields[0])
+	}
+	sum, err := base64.StdEncoding.DecodeString(fields[1])
+	if err != nil {
+		return nil, nil, fmt.Errorf("decode checksum: %v", err)
+	}
+	return h, sum, nil
+}
+
+// Handler of tus requests; OPTIONS requests are served without auth
+func (a *Api) UploadsHandler() http.Handler {
+	withAuth := a.HandlerWithAuth(a.HandleUploads)
+	return a.Handler(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodOptions {
+			a.HandleUploadsOptions(w, r)
+			return
+		}
+		withAuth.ServeHTTP(w, r)
+	})
+}
+
+// Describe server capabilities; does not need auth so that clients can discover them
+func (a *Api) HandleUploadsOptions(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Tus-Resumable", tusVersion)
+	w.Header().Set("Tus-Version", tusVersion)
+	w.Header().Set("Tus-Extension", tusExtensions)
+	w.Header().Set("Tus-Max-Size", strconv.FormatInt(a.config().maxUploadSize(), 10))
+	w.Header().Set("Tus-Checksum-Algorithm", tusChecksumAlgorithms)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Route tus requests: POST /v1/uploads creates upload, HEAD/PATCH/DELETE /v1/uploads/{id} query
+// offset, append chunk and terminate upload
+// Note: needs auth
+func (a *Api) HandleUploads(w http.ResponseWriter, r *http.Request, userId int64) {
+	w.Header().Set("Tus-Resumable", tusVersion)
+	if r.Header.Get("Tus-Resumable") != tusVersion {
+		w.Header().Set("Tus-Version", tusVersion)
+		replyWithError(w, http.StatusPreconditionFailed, fmt.Errorf("unsupported tus version %q", r.Header.Get("Tus-Resumable")))
+		return
+	}
+	id := strings.Trim(strings.TrimPrefix(r.URL.Path, "/v1/uploads"), "/")
+	switch {
+	case id == "" && r.Method == http.MethodPost:
+		a.handleCreateUpload(w, r, userId)
+	case id == "" || strings.Contains(id, "/"):
+		replyWithError(w, http.StatusNotFound, fmt.Errorf("unknown upload resource"))
+	case r.Method == http.MethodHead:
+		a.handleUploadOffset(w, r, userId, id)
+	case r.Method == http.MethodPatch:
+		a.handleUploadChunk(w, r, userId, id)
+	case r.Method == http.MethodDelete:
+		a.handleTerminateUpload(w, r, userId, id)
+	default:
+		replyWithError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s is not allowed", r.Method))
+	}
+}
+
+func (a *Api) handleCreateUpload(w http.ResponseWriter, r *http.Request, userId int64) {
+	if r.Header.Get("Upload-Defer-Length") != "" {
+		replyWithError(w, http.StatusBadRequest, fmt.Errorf("deferred upload length is not supported"))
+		return
+	}
+	length, err := strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64)
+	if err != nil || length < 0 {
+		replyWithError(w, http.StatusBadRequest, fmt.Errorf("invalid Upload-Length header"))
+		return
+	}
+	if length > a.config().maxUploadSize() {
+		replyWithError(w, http.StatusRequestEntityTooLarge, errContentTooLarge)
+		return
+	}
+	metadata := r.Header.Get("Upload-Metadata")
+	if _, err := parseUploadMetadata(metadata); err != nil {
+		replyWithError(w, http.StatusBadRequest, fmt.Errorf("parse Upload-Metadata header: %v", err))
+		return
+	}
+	id, err := randomToken(16)
+	if err != nil {
+		err = fmt.Errorf("generate upload id: %v", err)
+		logE.Print(err)
+		replyWithError(w, http.StatusInternalServerError, err)
+		return
+	}
+	u := &upload{
+		Id:        id,
+		OwnerId:   userId,
+		Length:    length,
+		Metadata:  metadata,
+		ExpiresAt: time.Now().Add(a.config().uploadExpiration()),
+	}
+	if err := os.MkdirAll(a.config().uploadsDir(), 0750); err != nil {
+		err = fmt.Errorf("create uploads dir: %v", err)
+		logE.Print(err)
+		replyWithError(w, http.StatusInternalServerError, err)
+		return
+	}
+	f, err := os.OpenFile(a.uploadPath(id), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0640)
+	if err != nil {
+		err = fmt.Errorf("create upload file: %v", err)
+		logE.Print(err)
+		replyWithError(w, http.StatusInternalServerError, err)
+		return
+	}
+	f.Close()
+	if err := a.store.InsertUpload(u); err != nil {
+		os.Remove(a.uploadPath(id))
+		err = fmt.Errorf("insert upload: %v", err)
+		logE.Print(err)
+		replyWithError(w, http.StatusInternalServerError, err)
+		return
+	}
+	// Empty upload is complete as soon as it is created
+	if length == 0 {
+		if err := a.finishUpload(r, u); err != nil {
+			err = fmt.Errorf("finish upload %s: %v", id, err)
+			logE.Print(err)
+			replyWithError(w, http.StatusInternalServerError, err)
+			return
+		}
+		w.Header().Set("Audyos-Record-Id", strconv.FormatInt(u.RecordId.Int64, 10))
+	}
+	w.Header().Set("Location", "/v1/uploads/"+id)
+	w.Header().Set("Upload-Expires", u.ExpiresAt.UTC().Format(http.TimeFormat))
+	w.WriteHeader(http.StatusCreated)
+}
+
+// Select upload of user replying with error if it does not exist or has expired
+func (a *Api) selectActiveUpload(w http.ResponseWriter, id string, userId int64) *upload {
+	u, err := a.store.SelectUpload(id, userId)
+	if err == sql.ErrNoRows {
+		replyWithError(w, http.StatusNotFound, fmt.Errorf("no upload %s", id))
+		return nil
+	}
+	if err != nil {
+		err = fmt.Errorf("select upload %s: %v", id, err)
+		logE.Print(err)
+		replyWithError(w, http.StatusInternalServerError, err)
+		return nil
+	}
+	if !time.Now().Before(u.ExpiresAt) {
+		replyWithError(w, http.StatusGone, fmt.Errorf("upload %s has expired", id))
+		return nil
+	}
+	return u
+}
+
+func (a *Api) setUploadHeaders(w http.ResponseWriter, u *upload) {
+	w.Header().Set("Upload-Offset", strconv.FormatInt(u.Offset, 10))
+	w.Header().Set("Upload-Length", strconv.FormatInt(u.Length, 10))
+	w.Header().Set("Upload-Expires", u.ExpiresAt.UTC().Format(http.TimeFormat))
+	if u.RecordId.Valid {
+		w.Header().Set("Audyos-Record-Id", strconv.FormatInt(u.RecordId.Int64, 10))
+	}
+}
+
+func (a *Api) handleUploadOffset(w http.ResponseWriter, r *http.Request, userId int64, id string) {
+	u := a.selectActiveUpload(w, id, userId)
+	if u == nil {
+		return
+	}
+	a.setUploadHeaders(w, u)
+	if u.Metadata != "" {
+		w.Header().Set("Upload-Metadata", u.Metadata)
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+}
+
+func (a *Api) handleUploadChunk(w http.ResponseWriter, r *http.Request, userId int64, id string) {
+	if r.Header.Get("Content-Type") != tusOffsetContentType {
+		replyWithError(w, http.StatusUnsupportedMediaType, fmt.Errorf("expected %s body", tusOffsetContentType))
+		return
+	}
+	offset, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil || offset < 0 {
+		replyWithError(w, http.StatusBadRequest, fmt.Errorf("invalid Upload-Offset header"))
+		return
+	}
+	var checksum hash.Hash
+	var expectedSum []byte
+	if header := r.Header.Get("Upload-Checksum"); header != "" {
+		if checksum, expectedSum, err = parseUploadChecksum(header); err != nil {
+			replyWithError(w, http.StatusBadRequest, err)
+			return
+		}
+	}
+	if !lockUpload(id) {
+		replyWithError(w, http.StatusLocked, fmt.Errorf("upload %s is being written by another request", id))
+		return
+	}
+	defer unlockUpload(id)
+	u := a.selectActiveUpload(w, id, userId)
+	if u == nil {
+		return
+	}
+	if u.RecordId.Valid {
+		a.setUploadHeaders(w, u)
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	if offset != u.Offset {
+		replyWithError(w, http.StatusConflict, fmt.Errorf("upload offset is %d, got %d", u.Offset, offset))
+		return
+	}
+	if offset < u.Length {
+		written, err := a.appendUploadChunk(u, r.Body, checksum, expectedSum)
+		if written > 0 {
+			if ok, updErr := a.store.UpdateUploadOffset(id, u.Offset, u.Offset+written); updErr != nil || !ok {
+				updErr = fmt.Errorf("update offset of upload %s: %v", id, updErr)
+				logE.Print(updErr)
+				replyWithError(w, http.StatusInternalServerError, updErr)
+				return
+			}
+			u.Offset += written
+		}
+		if err == errChecksumMismatch {
+			replyWithError(w, statusChecksumMismatch, err)
+			return
+		}
+		if err != nil {
+			// Bytes received before connection broke are kept, client resumes from new offset
+			err = fmt.Errorf("write chunk of upload %s: %v", id, err)
+			logI.Print(err)
+			replyWithError(w, http.StatusInternalServerError, err)
+			return
+		}
+	}
+	if u.Offset == u.Length {
+		if err := a.finishUpload(r, u); err != nil {
+			err = fmt.Errorf("finish upload %s: %v", id, err)
+			logE.Print(err)
+			replyWithError(w, http.StatusInternalServerError, err)
+			return
+		}
+	}
+	a.setUploadHeaders(w, u)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+var errChecksumMismatch = fmt.Errorf("checksum mismatch")
+
+// Append chunk to upload file, never going beyond declared upload length. If checksum is given,
+// chunk is kept only if it is received completely and matches the checksum.
+func (a *Api) appendUploadChunk(u *upload, body io.Reader, checksum hash.Hash, expectedSum []byte) (int64, error) {
+	f, err := os.OpenFile(a.uploadPath(u.Id), os.O_WRONLY, 0640)
+	if err != nil {
+		return 0, fmt.Errorf("open upload file: %v", err)
+	}
+	defer f.Close()
+	// Drop bytes left by chunk which failed to be accounted
+	if err := f.Truncate(u.Offset); err != nil {
+		return 0, fmt.Errorf("truncate upload file: %v", err)
+	}
+	if _, err := f.Seek(u.Offset, io.SeekStart); err != nil {
+		return 0, fmt.Errorf("seek upload file: %v", err)
+	}
+	var dst io.Writer = f
+	if checksum != nil {
+		dst = io.MultiWriter(f, checksum)
+	}
+	written, copyErr := io.Copy(dst, io.LimitReader(body, u.Length-u.Offset))
+	if checksum != nil && (copyErr != nil || string(checksum.Sum(nil)) != string(expectedSum)) {
+		if err := f.Truncate(u.Offset); err != nil {
+			return 0, fmt.Errorf("truncate upload file: %v", err)
+		}
+		if copyErr != nil {
+			return 0, copyErr
+		}
+		return 0, errChecksumMismatch
+	}
+	if err := f.Sync(); err != nil {
+		return 0, fmt.Errorf("sync upload file: %v", err)
+	}
+	return written, copyErr
+}
+
+// Turn complete upload into a record of its owner
+func (a *Api) finishUpload(r *http.Request, u *upload) error {
+	meta, err := parseUploadMetadata(u.Metadata)
+	if err != nil {
+		return fmt.Errorf("parse metadata: %v", err)
+	}
+	// Declared filetype is only trusted by createRecord if it is audio one
+	rec := &recordInfo{Name: meta["name"], OwnerId: u.OwnerId, ContentType: meta["filetype"], UploadId: u.Id}
+	if rec.Name == "" {
+		rec.Name = meta["filename"]
+	}
+	if rec.Name == "" {
+		rec.Name = "Upload " + u.Id
+	}
+	f, err := os.Open(a.uploadPath(u.Id))
+	if err != nil {
+		return fmt.Errorf("open upload file: %v", err)
+	}
+	defer f.Close()
+	if err := a.createRecord(r.Context(), rec, f); err != nil {
+		return err
+	}
+	u.RecordId = sql.NullInt64{Int64: rec.Id, Valid: true}
+	if err := os.Remove(a.uploadPath(u.Id)); err != nil {
+		logE.Printf("remove file of finished upload %s: %v", u.Id, err)
+	}
+	return nil
+}
+
+func (a *Api) handleTerminateUpload(w http.ResponseWriter, r *http.Request, userId int64, id string) {
+	if !lockUpload(id) {
+		replyWithError(w, http.StatusLocked, fmt.Errorf("upload %s is being written by another request", id))
+		return
+	}
+	defer unlockUpload(id)
+	ok, err := a.store.DeleteUpload(id, userId)
+	if err != nil {
+		err = fmt.Errorf("delete upload %s: %v", id, err)
+		logE.Print(err)
+		replyWithError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if !ok {
+		replyWithError(w, http.StatusNotFound, fmt.Errorf("no upload %s", id))
+		return
+	}
+	if err := os.Remove(a.uploadPath(id)); err != nil && !os.IsNotExist(err) {
+		logE.Printf("remove file of terminated upload %s: %v", id, err)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}